@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// alertSubject identifies what an alert is about: the total traffic, a section or a client
+type alertSubject struct {
+	// kind of subject, which is also the name of the logged field that contains the subject's name
+	kind string
+	name string
+}
+
+// Kinds of alert subjects
+const (
+	totalSubject   = "total"
+	sectionSubject = "section"
+	clientSubject  = "client"
+)
+
+// Titles used to name the alert subjects in log messages
+var alertSubjectTitles = map[string]string{
+	totalSubject:   "Total",
+	sectionSubject: "Section",
+	clientSubject:  "Client",
+}
+
+// Names of the alerting rules
+const (
+	trafficRule         = "traffic"
+	serverErrorRateRule = "server_error_rate"
+	clientErrorRateRule = "client_error_rate"
+	hitsAnomalyRule     = "hits_anomaly"
+	bytesAnomalyRule    = "bytes_anomaly"
+	noDataRule          = "no_data"
+	logFileRule         = "log_file"
+)
+
+// alertKey identifies an alert by the rule that raised it and its subject
+type alertKey struct {
+	rule    string
+	subject alertSubject
+}
+
+// AlertState is the state of an alert in its lifecycle
+type AlertState string
+
+// Alert states
+const (
+	// the threshold of the rule is exceeded, but not for long enough for the alert to fire
+	AlertPending AlertState = "pending"
+	// the threshold of the rule has been exceeded for long enough
+	AlertFiring AlertState = "firing"
+	// the threshold of the rule is no longer exceeded
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert represents an alert raised by a rule for a subject, at a given point of its lifecycle
+type Alert struct {
+	// time at which the alert got into its current state
+	Time  time.Time  `json:"time"`
+	State AlertState `json:"state"`
+
+	Rule string `json:"rule"`
+	// severity of the alert, and the highest severity it reached since it started
+	Severity     Severity `json:"severity,omitempty"`
+	PeakSeverity Severity `json:"peak_severity,omitempty"`
+	// severities with which the notifiers were notified of the alert since it started, so that its resolution
+	// is sent to every notifier that was notified of it
+	NotifiedSeverities []Severity `json:"notified_severities,omitempty"`
+	// kind of subject of the alert: the total traffic, a section or a client
+	Subject string `json:"subject"`
+	// name of the section or client the alert is about
+	Name string `json:"name,omitempty"`
+	// log file from which the entries that raised the alert were read
+	Source string `json:"source,omitempty"`
+
+	// last value observed by the rule, its highest value since the alert started, and the threshold
+	// above which the rule raises the alert
+	Value     float64 `json:"value"`
+	Peak      float64 `json:"peak"`
+	Threshold float64 `json:"threshold"`
+
+	// time at which the threshold started being exceeded, at which the alert started firing, and
+	// at which it was resolved
+	StartsAt time.Time `json:"starts_at"`
+	FiringAt time.Time `json:"firing_at"`
+	EndsAt   time.Time `json:"ends_at"`
+
+	// duration over which the rule observes its value
+	Window Duration `json:"window"`
+	// sections with the most hits over the last 2 minutes when the alert changed state
+	TopSections []SectionStats `json:"top_sections,omitempty"`
+
+	// whether the notifications of this state change were suppressed by a silence or a maintenance window
+	Silenced bool `json:"silenced,omitempty"`
+	// whether this is a reminder that the alert is still firing rather than a state change
+	Renotified bool `json:"renotified,omitempty"`
+
+	// last time the notifiers were notified of the alert
+	notifiedAt time.Time
+}
+
+// Summary returns a human readable description of the alert
+func (a Alert) Summary() string {
+	subject := alertSubjectTitles[a.Subject]
+	if a.Name != "" {
+		subject = fmt.Sprintf("%s %s", subject, a.Name)
+	}
+
+	state := strings.ToUpper(string(a.State))
+	if a.Severity != "" {
+		state += "/" + strings.ToUpper(string(a.Severity))
+	}
+
+	return fmt.Sprintf("[%s] %s %s: %g (threshold %g, peak %g)",
+		state,
+		subject,
+		strings.Replace(a.Rule, "_", " ", -1),
+		a.Value,
+		a.Threshold,
+		a.Peak,
+	)
+}
+
+// alertTransition describes how the state of an alert changed after being evaluated
+type alertTransition int
+
+// Possible alert transitions
+const (
+	// the alert was not firing and still isn't
+	alertInactive alertTransition = iota
+	// the alert just started firing
+	alertRaised
+	// the alert was already firing and still is, and its severity changed or it was notified again
+	alertOngoing
+	// the alert was already firing and still is, with nothing new to report
+	alertUnchanged
+	// the alert was firing and just went back to normal
+	alertResolved
+)
+
+// updateAlert updates the state of an alert depending on the value observed by its rule and on whether its
+// threshold is currently exceeded, records its state changes in the alert history and returns the resulting
+// transition. An alert only starts firing once its threshold has been exceeded for the configured pending period.
+// Alerts that keep firing are only reported again when their severity changes or when they are due to be notified
+// again, according to the re-notification interval of their severity. Alerts evaluated at a refresh are all
+// dated at the time of the refresh, so that they don't depend on the time spent evaluating them.
+func (lp *LogProcessor) updateAlert(key alertKey, value, threshold float64, exceeded bool) alertTransition {
+	return lp.updateAlertAt(key, lp.refreshedAt, value, threshold, exceeded)
+}
+
+// updateAlertAt updates the state of an alert like updateAlert, at the given time rather than at the time of the
+// refresh, for alerts that are evaluated outside of refreshes
+func (lp *LogProcessor) updateAlertAt(key alertKey, now time.Time, value, threshold float64, exceeded bool) alertTransition {
+	if lp.alerts == nil {
+		lp.alerts = make(map[alertKey]*Alert)
+	}
+
+	alert, ok := lp.alerts[key]
+	if !exceeded {
+		if !ok {
+			return alertInactive
+		}
+
+		delete(lp.alerts, key)
+		wasFiring := alert.State == AlertFiring
+
+		alert.Value = value
+		alert.Threshold = threshold
+		alert.EndsAt = now
+		lp.setAlertState(alert, AlertResolved, now)
+
+		if wasFiring {
+			return alertResolved
+		}
+		return alertInactive
+	}
+
+	if !ok {
+		alert = &Alert{
+			Rule:     key.rule,
+			Subject:  key.subject.kind,
+			Name:     key.subject.name,
+			Source:   lp.source,
+			Peak:     value,
+			StartsAt: now,
+			Window:   Duration{lp.ruleWindow(key.rule)},
+		}
+		lp.alerts[key] = alert
+	}
+
+	alert.Value = value
+	alert.Threshold = threshold
+	if value > alert.Peak {
+		alert.Peak = value
+	}
+
+	severity := lp.alertSeverity(key.rule, value, threshold)
+	if severityRanks[severity] > severityRanks[alert.PeakSeverity] {
+		alert.PeakSeverity = severity
+	}
+
+	if alert.State == AlertFiring {
+		if severity != alert.Severity {
+			alert.Severity = severity
+			lp.setAlertState(alert, AlertFiring, now)
+			return alertOngoing
+		}
+
+		interval := lp.renotifyIntervals[severity]
+		if interval > 0 && now.Sub(alert.notifiedAt) >= interval {
+			lp.renotify(alert, now)
+			return alertOngoing
+		}
+		return alertUnchanged
+	}
+	alert.Severity = severity
+
+	if now.Sub(alert.StartsAt) < lp.alertPendingPeriod {
+		if alert.State != AlertPending {
+			lp.setAlertState(alert, AlertPending, now)
+		}
+		return alertInactive
+	}
+
+	alert.FiringAt = now
+	lp.setAlertState(alert, AlertFiring, now)
+	return alertRaised
+}
+
+// setAlertState changes the state of an alert, records it into the alert history and notifies the notifiers,
+// unless the alert is silenced
+func (lp *LogProcessor) setAlertState(alert *Alert, state AlertState, now time.Time) {
+	alert.State = state
+	alert.Time = now
+	alert.Renotified = false
+	lp.publishAlert(alert, now, true)
+}
+
+// renotify notifies the notifiers again of an alert that is still firing, without recording it into the
+// alert history since its state did not change
+func (lp *LogProcessor) renotify(alert *Alert, now time.Time) {
+	alert.Renotified = true
+	lp.publishAlert(alert, now, false)
+}
+
+// publishAlert records an alert into the alert history when asked to, and notifies the notifiers unless
+// the alert is silenced
+func (lp *LogProcessor) publishAlert(alert *Alert, now time.Time, record bool) {
+	alert.TopSections = lp.topRecentSections(lp.topHitsNumber)
+	alert.notifiedAt = now
+
+	var reason string
+	if lp.silences != nil {
+		alert.Silenced, reason = lp.silences.Silenced(*alert, now)
+	}
+
+	if record && lp.history != nil {
+		err := lp.history.Record(*alert)
+		if err != nil {
+			lp.log.Error().Err(err).Str("rule", alert.Rule).Msg("Could not record alert into the alert history")
+		}
+	}
+
+	if alert.Silenced {
+		lp.log.Debug().
+			Str("rule", alert.Rule).
+			Str("state", string(alert.State)).
+			Str("silenced_by", reason).
+			Msg("Alert notifications silenced")
+		return
+	}
+
+	if alert.State != AlertResolved && !alert.notifiedWith(alert.Severity) {
+		alert.NotifiedSeverities = append(alert.NotifiedSeverities, alert.Severity)
+	}
+	lp.notify(*alert)
+}
+
+// notifiedWith returns whether the notifiers were notified of the alert with a severity
+func (a Alert) notifiedWith(severity Severity) bool {
+	for _, notified := range a.NotifiedSeverities {
+		if notified == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleWindow returns the duration over which a rule observes its value
+func (lp *LogProcessor) ruleWindow(rule string) time.Duration {
+	switch rule {
+	case trafficRule, serverErrorRateRule, clientErrorRateRule:
+		return 2 * time.Minute
+	case noDataRule:
+		return lp.noDataTimeout
+	default:
+		return lp.refreshPeriod
+	}
+}
+
+// ActiveAlerts returns the alerts that are currently pending or firing
+func (lp *LogProcessor) ActiveAlerts() []Alert {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	return lp.activeAlerts()
+}
+
+// activeAlerts returns the alerts that are currently pending or firing, sorted by rule and subject
+func (lp *LogProcessor) activeAlerts() []Alert {
+	alerts := make([]Alert, 0, len(lp.alerts))
+	for _, alert := range lp.alerts {
+		alerts = append(alerts, *alert)
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		if alerts[i].Subject != alerts[j].Subject {
+			return alerts[i].Subject < alerts[j].Subject
+		}
+		return alerts[i].Name < alerts[j].Name
+	})
+	return alerts
+}
+
+// alertingSubjects returns the subjects of a given kind that currently have an alert raised by a rule,
+// whether it is pending or firing
+func (lp *LogProcessor) alertingSubjects(rule, kind string) []string {
+	var names []string
+	for key := range lp.alerts {
+		if key.rule == rule && key.subject.kind == kind {
+			names = append(names, key.subject.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/ullaakut/gonx"
+)
+
+// analysisBuckets are the durations of the buckets in which the traffic over time is reported. The
+// shortest duration which gives at most maxAnalysisBuckets buckets is used
+var analysisBuckets = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+const maxAnalysisBuckets = 60
+
+// maxAnalysisTraffic is the maximum number of buckets of the traffic over time, which are kept in memory while
+// log files are read
+const maxAnalysisTraffic = 10000
+
+// analysisReport is the result of the analysis of log files
+type analysisReport struct {
+	Files       []string
+	GeneratedAt time.Time
+
+	// time of the first and last entries
+	From time.Time
+	To   time.Time
+
+	Lines         int
+	ParseFailures int
+	Entries       int
+	Bytes         uint64
+
+	Bucket      time.Duration
+	Traffic     []analysisBucket
+	MaxHits     int
+	TopSections []analysisCount
+	TopClients  []analysisCount
+	Classes     []analysisCount
+	Statuses    []analysisCount
+
+	// state changes of the alerts that would have been raised with the configuration
+	Alerts []Alert
+
+	// aggregations of the entries while they are read
+	traffic  map[time.Time]*analysisBucket
+	sections map[string]*analysisCount
+	clients  map[string]*analysisCount
+	statuses map[string]*analysisCount
+	classes  statusCounts
+}
+
+// analysisBucket is the traffic received during a bucket of time
+type analysisBucket struct {
+	Time         time.Time
+	Hits         int
+	Bytes        uint64
+	ServerErrors int
+}
+
+// analysisCount is the traffic of a section, client or status
+type analysisCount struct {
+	Name         string
+	Hits         int
+	Bytes        uint64
+	ServerErrors int
+	// percentage of the entries
+	Share float64
+}
+
+// alertCollector keeps the state changes of alerts in memory
+type alertCollector struct {
+	alerts []Alert
+}
+
+// Record adds an alert to the collected alerts
+func (c *alertCollector) Record(alert Alert) error {
+	c.alerts = append(c.alerts, alert)
+	return nil
+}
+
+// analyzeCommand processes historical log files in one pass, and writes a report of their traffic and of the
+// alerts that would have been raised with the configured rules
+func analyzeCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON configuration file overriding the default values")
+	fromStr := flags.String("from", "", "only analyze entries after this time (date, RFC3339 time or duration such as 24h)")
+	toStr := flags.String("to", "", "only analyze entries before this time (date, RFC3339 time or duration such as 1h)")
+	format := flags.String("format", "markdown", "format of the report, markdown or html")
+	output := flags.String("output", "", "path to the file to which the report is written, instead of the standard output")
+	top := flags.Int("top", 10, "number of top sections and clients in the report")
+	bucket := flags.Duration("bucket", 0, "duration of the buckets of the traffic over time, chosen from the analyzed period by default")
+
+	files, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("usage: hk-agent analyze [flags] <files...>")
+	}
+
+	var render func(io.Writer, *analysisReport) error
+	switch *format {
+	case "markdown", "md":
+		render = renderMarkdownReport
+	case "html":
+		render = renderHTMLReport
+	default:
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+
+	config, err := loadConfigFlag(*configPath)
+	if err != nil {
+		return err
+	}
+	logFormat, ok := logFormats[config.LogFormat]
+	if !ok {
+		return fmt.Errorf("unknown log format %q", config.LogFormat)
+	}
+
+	now := time.Now()
+	from, err := parseTimeFilter(*fromStr, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFilter(*toStr, now)
+	if err != nil {
+		return err
+	}
+
+	// the entries are aggregated and fed to the alert simulation as they are read, instead of being kept in
+	// memory
+	feed := make(chan *HTTPEntry, 1024)
+	alerts := make(chan []Alert, 1)
+	go func() {
+		alerts <- simulateAlerts(config, feed)
+	}()
+
+	report := &analysisReport{Files: files, GeneratedAt: now}
+	err = report.read(files, logFormat, from, to, func(entry *HTTPEntry) error {
+		feed <- entry
+		return report.add(entry, *bucket)
+	})
+	close(feed)
+	report.Alerts = <-alerts
+	if err != nil {
+		return err
+	}
+	if err := report.summarize(*top, *bucket); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return render(out, report)
+}
+
+// parseInterspersed parses flags which can be given before, between or after the positional arguments, and
+// returns the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// read reads the entries of log files in the given format between from and to, and calls a function with
+// them in chronological order. Files ending with ".gz" are decompressed, and are merged as they are read since
+// they are not necessarily given in chronological order. Zero times disable the corresponding filter, and
+// entries without a valid time are counted as parse failures
+func (r *analysisReport) read(files []string, format string, from, to time.Time, fn func(entry *HTTPEntry) error) error {
+	log := NewZeroLog(ioutil.Discard, JSON)
+	parser := gonx.NewParser(format)
+
+	sources := make([]*analysisSource, 0, len(files))
+	defer func() {
+		for _, source := range sources {
+			source.file.Close()
+		}
+	}()
+	for _, path := range files {
+		file, err := openLogReader(path)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", path, err)
+		}
+		sources = append(sources, &analysisSource{path: path, file: file})
+	}
+
+	// next reads the next entry of a file between from and to
+	next := func(source *analysisSource) error {
+		source.next = nil
+		for source.file.Scan() {
+			line := source.file.Text()
+			if line == "" {
+				continue
+			}
+
+			r.Lines++
+			parsed, err := parser.ParseString(line)
+			if err != nil {
+				r.ParseFailures++
+				continue
+			}
+
+			entry := NewHTTPEntry(log, parsed)
+			if entry.Time.IsZero() {
+				r.ParseFailures++
+				continue
+			}
+			if !from.IsZero() && entry.Time.Before(from) {
+				continue
+			}
+			if !to.IsZero() && entry.Time.After(to) {
+				continue
+			}
+			source.next = entry
+			return nil
+		}
+		if err := source.file.Err(); err != nil {
+			return fmt.Errorf("could not read %s: %v", source.path, err)
+		}
+		return nil
+	}
+
+	for _, source := range sources {
+		if err := next(source); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var first *analysisSource
+		for _, source := range sources {
+			if source.next != nil && (first == nil || source.next.Time.Before(first.next.Time)) {
+				first = source
+			}
+		}
+		if first == nil {
+			return nil
+		}
+
+		if err := fn(first.next); err != nil {
+			return err
+		}
+		if err := next(first); err != nil {
+			return err
+		}
+	}
+}
+
+// analysisSource is a log file being read, with its next entry
+type analysisSource struct {
+	path string
+	file *logReader
+	next *HTTPEntry
+}
+
+// logReader is a log file opened for reading line by line, decompressed if its name ends with ".gz"
+type logReader struct {
+	*bufio.Scanner
+	file *os.File
+	gz   *gzip.Reader
+}
+
+// openLogReader opens a log file for reading line by line
+func openLogReader(path string) (*logReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &logReader{file: file}
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		f.gz, err = gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		reader = f.gz
+	}
+
+	f.Scanner = bufio.NewScanner(reader)
+	f.Scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return f, nil
+}
+
+// Close closes the log file
+func (f *logReader) Close() error {
+	if f.gz != nil {
+		f.gz.Close()
+	}
+	return f.file.Close()
+}
+
+// readLogFile calls a function with every line of a log file
+func readLogFile(path string, fn func(line string)) error {
+	file, err := openLogReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for file.Scan() {
+		fn(file.Text())
+	}
+	return file.Err()
+}
+
+// add aggregates the traffic of an entry. The traffic over time is aggregated in buckets of the given
+// duration, or of the shortest of analysisBuckets which keeps at most maxAnalysisTraffic buckets when it is
+// zero. An error is returned when more buckets would be needed
+func (r *analysisReport) add(entry *HTTPEntry, bucket time.Duration) error {
+	if r.sections == nil {
+		r.sections = make(map[string]*analysisCount)
+		r.clients = make(map[string]*analysisCount)
+		r.statuses = make(map[string]*analysisCount)
+		r.traffic = make(map[time.Time]*analysisBucket)
+		r.Bucket = bucket
+		if r.Bucket <= 0 {
+			r.Bucket = analysisBuckets[0]
+		}
+	}
+
+	if r.Entries == 0 || entry.Time.Before(r.From) {
+		r.From = entry.Time
+	}
+	if r.Entries == 0 || entry.Time.After(r.To) {
+		r.To = entry.Time
+	}
+	r.Entries++
+	r.Bytes += entry.Size
+
+	key := entry.Time.Truncate(r.Bucket)
+	b, ok := r.traffic[key]
+	if !ok {
+		b = &analysisBucket{Time: key}
+		r.traffic[key] = b
+	}
+	b.Hits++
+	b.Bytes += entry.Size
+	if entry.Status/100 == 5 {
+		b.ServerErrors++
+	}
+
+	count := func(counts map[string]*analysisCount, name string) {
+		c, ok := counts[name]
+		if !ok {
+			c = &analysisCount{Name: name}
+			counts[name] = c
+		}
+		c.Hits++
+		c.Bytes += entry.Size
+		if entry.Status/100 == 5 {
+			c.ServerErrors++
+		}
+	}
+	count(r.sections, entry.Section)
+	count(r.clients, entry.ClientAddress)
+	count(r.statuses, fmt.Sprint(entry.Status))
+	r.classes.add(entry.Status)
+
+	if len(r.traffic) <= maxAnalysisTraffic {
+		return nil
+	}
+	if bucket <= 0 {
+		for _, duration := range analysisBuckets {
+			if duration > r.Bucket {
+				r.coarsen(duration)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the traffic over time needs more than %d buckets of %v, use a longer -bucket or a shorter period", maxAnalysisTraffic, r.Bucket)
+}
+
+// coarsen merges the buckets of the traffic over time into longer buckets
+func (r *analysisReport) coarsen(bucket time.Duration) {
+	traffic := make(map[time.Time]*analysisBucket)
+	for key, b := range r.traffic {
+		key = key.Truncate(bucket)
+		merged, ok := traffic[key]
+		if !ok {
+			merged = &analysisBucket{Time: key}
+			traffic[key] = merged
+		}
+		merged.merge(b)
+	}
+	r.traffic = traffic
+	r.Bucket = bucket
+}
+
+// summarize computes the reported traffic over time, and the top sections, clients and statuses, once all the
+// entries are added. The duration of the buckets is chosen from the analyzed period unless it is given
+func (r *analysisReport) summarize(top int, bucket time.Duration) error {
+	if r.Entries == 0 {
+		return nil
+	}
+
+	if bucket <= 0 {
+		for _, duration := range analysisBuckets {
+			if duration >= r.Bucket && (r.To.Sub(r.From)/duration < maxAnalysisBuckets || duration == analysisBuckets[len(analysisBuckets)-1]) {
+				r.coarsen(duration)
+				break
+			}
+		}
+	}
+
+	// every bucket between the first and last entries is reported, so that gaps in the traffic are visible
+	start := r.From.Truncate(r.Bucket)
+	buckets := r.To.Sub(start)/r.Bucket + 1
+	if buckets > maxAnalysisTraffic {
+		return fmt.Errorf("the traffic over time needs %d buckets of %v, more than %d, use a longer -bucket or a shorter period", buckets, r.Bucket, maxAnalysisTraffic)
+	}
+	r.Traffic = make([]analysisBucket, buckets)
+	for i := range r.Traffic {
+		r.Traffic[i].Time = start.Add(time.Duration(i) * r.Bucket)
+	}
+	for key, b := range r.traffic {
+		r.Traffic[int(key.Sub(start)/r.Bucket)].merge(b)
+	}
+	for _, b := range r.Traffic {
+		if b.Hits > r.MaxHits {
+			r.MaxHits = b.Hits
+		}
+	}
+
+	r.TopSections = r.rank(r.sections, top)
+	r.TopClients = r.rank(r.clients, top)
+
+	for class := 1; class < len(r.classes); class++ {
+		r.Classes = append(r.Classes, analysisCount{
+			Name:  statusClasses[class],
+			Hits:  r.classes[class],
+			Share: r.classes.rate(class),
+		})
+	}
+
+	for _, status := range r.statuses {
+		status.Share = 100 * float64(status.Hits) / float64(r.Entries)
+		r.Statuses = append(r.Statuses, *status)
+	}
+	sort.Slice(r.Statuses, func(i, j int) bool {
+		return r.Statuses[i].Name < r.Statuses[j].Name
+	})
+	return nil
+}
+
+// merge adds the traffic of another bucket to the bucket
+func (b *analysisBucket) merge(other *analysisBucket) {
+	b.Hits += other.Hits
+	b.Bytes += other.Bytes
+	b.ServerErrors += other.ServerErrors
+}
+
+// rank returns the n counts with the most hits
+func (r *analysisReport) rank(counts map[string]*analysisCount, n int) []analysisCount {
+	ranked := make([]analysisCount, 0, len(counts))
+	for _, c := range counts {
+		c.Share = 100 * float64(c.Hits) / float64(r.Entries)
+		ranked = append(ranked, *c)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits == ranked[j].Hits {
+			return ranked[i].Name < ranked[j].Name
+		}
+		return ranked[i].Hits > ranked[j].Hits
+	})
+
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// simulateAlerts runs a log processor over entries sorted by time, refreshing it as often as the agent would,
+// and returns the alert state changes it records once the entries channel is closed
+func simulateAlerts(config Config, entries <-chan *HTTPEntry) []Alert {
+	if config.RefreshPeriod.Duration <= 0 {
+		for range entries {
+		}
+		return nil
+	}
+
+	collector := &alertCollector{}
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	clock := &replayClock{}
+	lp := NewLogProcessor(log, log, config, collector, nil, nil, nil, clock.Now)
+
+	replay := &replayer{processor: lp, clock: clock, period: config.RefreshPeriod.Duration}
+	replay.Run(entries)
+
+	return collector.alerts
+}
+
+// reportFuncs are the functions available in the report templates
+var reportFuncs = map[string]interface{}{
+	"bytes": formatBytes,
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.1f%%", value)
+	},
+	"bar": func(hits, max, width int) int {
+		if max == 0 {
+			return 0
+		}
+		return hits * width / max
+	},
+	"repeat": strings.Repeat,
+	"md":     markdownEscaper.Replace,
+	"upper":  strings.ToUpper,
+	"inc": func(i int) int {
+		return i + 1
+	},
+}
+
+// markdownEscaper escapes the characters that would break Markdown tables
+var markdownEscaper = strings.NewReplacer("|", `\|`, "`", "\\`", "\n", " ")
+
+func renderMarkdownReport(w io.Writer, report *analysisReport) error {
+	tmpl, err := texttemplate.New("report").Funcs(reportFuncs).Parse(markdownReportTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, report)
+}
+
+func renderHTMLReport(w io.Writer, report *analysisReport) error {
+	tmpl, err := htmltemplate.New("report").Funcs(reportFuncs).Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, report)
+}
+
+const markdownReportTemplate = `# hk-agent analysis
+
+* Files: {{ range $i, $file := .Files }}{{ if $i }}, {{ end }}` + "`{{ md $file }}`" + `{{ end }}
+* Period: {{ if .Entries }}{{ time .From }} to {{ time .To }}{{ else }}no entries{{ end }}
+* Entries: {{ .Entries }} ({{ bytes .Bytes }}), out of {{ .Lines }} lines of which {{ .ParseFailures }} could not be parsed
+* Generated at: {{ time .GeneratedAt }}
+
+## Traffic over time
+{{ if .Traffic }}
+Hits, bytes and server errors (5xx) every {{ .Bucket }}.
+
+| Time | Hits | Bytes | 5xx | |
+|------|-----:|------:|----:|-|
+{{ range .Traffic }}| {{ time .Time }} | {{ .Hits }} | {{ bytes .Bytes }} | {{ .ServerErrors }} | {{ repeat "█" (bar .Hits $.MaxHits 30) }} |
+{{ end }}{{ else }}
+No traffic.
+{{ end }}
+## Top sections
+{{ if .TopSections }}
+| # | Section | Hits | Share | Bytes | 5xx |
+|--:|---------|-----:|------:|------:|----:|
+{{ range $i, $section := .TopSections }}| {{ inc $i }} | {{ md $section.Name }} | {{ $section.Hits }} | {{ percent $section.Share }} | {{ bytes $section.Bytes }} | {{ $section.ServerErrors }} |
+{{ end }}{{ else }}
+No sections.
+{{ end }}
+## Top clients
+{{ if .TopClients }}
+| # | Client | Hits | Share | Bytes |
+|--:|--------|-----:|------:|------:|
+{{ range $i, $client := .TopClients }}| {{ inc $i }} | {{ md $client.Name }} | {{ $client.Hits }} | {{ percent $client.Share }} | {{ bytes $client.Bytes }} |
+{{ end }}{{ else }}
+No clients.
+{{ end }}
+## Status codes
+{{ if .Statuses }}
+| Class | Hits | Share |
+|-------|-----:|------:|
+{{ range .Classes }}| {{ .Name }} | {{ .Hits }} | {{ percent .Share }} |
+{{ end }}
+| Status | Hits | Share |
+|--------|-----:|------:|
+{{ range .Statuses }}| {{ md .Name }} | {{ .Hits }} | {{ percent .Share }} |
+{{ end }}{{ else }}
+No status codes.
+{{ end }}
+## Alerts
+{{ if .Alerts }}
+Alert state changes that would have been recorded with the current configuration.
+
+| Time | State | Severity | Rule | Subject | Value | Threshold |
+|------|-------|----------|------|---------|------:|----------:|
+{{ range .Alerts }}| {{ time .Time }} | {{ upper (printf "%s" .State) }} | {{ .Severity }} | {{ .Rule }} | {{ .Subject }}{{ if .Name }} {{ md .Name }}{{ end }} | {{ printf "%.4g" .Value }} | {{ printf "%.4g" .Threshold }} |
+{{ end }}{{ else }}
+No alert would have been raised with the current configuration.
+{{ end }}`
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hk-agent analysis</title>
+<style>
+  body { font-family: sans-serif; margin: 24px auto; max-width: 1000px; color: #222; }
+  h1 { font-size: 24px; }
+  h2 { font-size: 18px; margin-top: 32px; border-bottom: 1px solid #e4e7eb; padding-bottom: 4px; }
+  table { border-collapse: collapse; width: 100%; font-size: 14px; }
+  th, td { padding: 4px 8px; border-bottom: 1px solid #e4e7eb; text-align: right; }
+  th.text, td.text { text-align: left; }
+  .chart { display: flex; align-items: flex-end; height: 160px; gap: 1px; border-bottom: 1px solid #9aa5b1; }
+  .chart div { flex: 1; background: #2680c2; min-width: 1px; }
+  .chart div.errors { background: #e12d39; }
+  .axis { display: flex; justify-content: space-between; font-size: 12px; color: #7b8794; }
+  .firing { color: #e12d39; }
+  .pending { color: #cb6e17; }
+  .resolved { color: #199473; }
+</style>
+</head>
+<body>
+<h1>hk-agent analysis</h1>
+<ul>
+  <li>Files: {{ range $i, $file := .Files }}{{ if $i }}, {{ end }}<code>{{ $file }}</code>{{ end }}</li>
+  <li>Period: {{ if .Entries }}{{ time .From }} to {{ time .To }}{{ else }}no entries{{ end }}</li>
+  <li>Entries: {{ .Entries }} ({{ bytes .Bytes }}), out of {{ .Lines }} lines of which {{ .ParseFailures }} could not be parsed</li>
+  <li>Generated at: {{ time .GeneratedAt }}</li>
+</ul>
+
+<h2>Traffic over time</h2>
+{{ if .Traffic }}
+<p>Hits every {{ .Bucket }}, buckets with server errors (5xx) are highlighted.</p>
+<div class="chart">
+{{ range .Traffic }}<div{{ if .ServerErrors }} class="errors"{{ end }} style="height: {{ bar .Hits $.MaxHits 100 }}%" title="{{ time .Time }}: {{ .Hits }} hits, {{ bytes .Bytes }}, {{ .ServerErrors }} server errors"></div>
+{{ end }}</div>
+<div class="axis"><span>{{ time (index .Traffic 0).Time }}</span><span>{{ .MaxHits }} hits at most</span></div>
+{{ else }}
+<p>No traffic.</p>
+{{ end }}
+
+<h2>Top sections</h2>
+{{ if .TopSections }}
+<table>
+<tr><th>#</th><th class="text">Section</th><th>Hits</th><th>Share</th><th>Bytes</th><th>5xx</th></tr>
+{{ range $i, $section := .TopSections }}<tr><td>{{ inc $i }}</td><td class="text">{{ $section.Name }}</td><td>{{ $section.Hits }}</td><td>{{ percent $section.Share }}</td><td>{{ bytes $section.Bytes }}</td><td>{{ $section.ServerErrors }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No sections.</p>
+{{ end }}
+
+<h2>Top clients</h2>
+{{ if .TopClients }}
+<table>
+<tr><th>#</th><th class="text">Client</th><th>Hits</th><th>Share</th><th>Bytes</th></tr>
+{{ range $i, $client := .TopClients }}<tr><td>{{ inc $i }}</td><td class="text">{{ $client.Name }}</td><td>{{ $client.Hits }}</td><td>{{ percent $client.Share }}</td><td>{{ bytes $client.Bytes }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No clients.</p>
+{{ end }}
+
+<h2>Status codes</h2>
+{{ if .Statuses }}
+<table>
+<tr><th class="text">Class</th><th>Hits</th><th>Share</th></tr>
+{{ range .Classes }}<tr><td class="text">{{ .Name }}</td><td>{{ .Hits }}</td><td>{{ percent .Share }}</td></tr>
+{{ end }}</table>
+<br>
+<table>
+<tr><th class="text">Status</th><th>Hits</th><th>Share</th></tr>
+{{ range .Statuses }}<tr><td class="text">{{ .Name }}</td><td>{{ .Hits }}</td><td>{{ percent .Share }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No status codes.</p>
+{{ end }}
+
+<h2>Alerts</h2>
+{{ if .Alerts }}
+<p>Alert state changes that would have been recorded with the current configuration.</p>
+<table>
+<tr><th class="text">Time</th><th class="text">State</th><th class="text">Severity</th><th class="text">Rule</th><th class="text">Subject</th><th>Value</th><th>Threshold</th></tr>
+{{ range .Alerts }}<tr class="{{ .State }}"><td class="text">{{ time .Time }}</td><td class="text">{{ upper (printf "%s" .State) }}</td><td class="text">{{ .Severity }}</td><td class="text">{{ .Rule }}</td><td class="text">{{ .Subject }}{{ if .Name }} {{ .Name }}{{ end }}</td><td>{{ printf "%.4g" .Value }}</td><td>{{ printf "%.4g" .Threshold }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No alert would have been raised with the current configuration.</p>
+{{ end }}
+</body>
+</html>
+`
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	from := flags.String("from", "", "")
+	format := flags.String("format", "", "")
+
+	files, err := parseInterspersed(flags, []string{"a.log", "-from", "1h", "b.log.gz", "--format", "html", "c.log"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"a.log", "b.log.gz", "c.log"}) || *from != "1h" || *format != "html" {
+		t.Errorf("unexpected files %v and flags from=%q format=%q", files, *from, *format)
+	}
+}
+
+// This test ensures that the analyze command reads plain and compressed log files in one pass, and reports
+// their traffic and the alerts that would have been raised
+func TestAnalyzeCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	line := func(client, section string, status, size int, minute, second int) string {
+		return fmt.Sprintf("%s - - [08/May/2018:10:%02d:%02d +0000] \"GET %s/page HTTP/1.0\" %d %d\n", client, minute, second, section, status, size)
+	}
+
+	// the second file contains the first entries, and a burst of traffic exceeding the threshold
+	var first, second bytes.Buffer
+	first.WriteString(line("10.0.0.1", "/api", 200, 1000, 5, 0))
+	first.WriteString(line("10.0.0.2", "/a|b", 500, 1000, 5, 30))
+	first.WriteString("not a log line\n")
+	first.WriteString(line("10.0.0.1", "/api", 200, 1000, 30, 0))
+	second.WriteString(line("10.0.0.1", "/api", 200, 1000, 0, 0))
+	second.WriteString(line("10.0.0.3", "/static", 404, 1000, 0, 10))
+	for i := 0; i < 3; i++ {
+		second.WriteString(line("10.0.0.3", "/downloads", 200, 1024*1024, 10, i))
+	}
+
+	firstPath := filepath.Join(dir, "access.log")
+	if err := ioutil.WriteFile(firstPath, first.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write log file: %v", err)
+	}
+
+	secondPath := filepath.Join(dir, "access.log.1.gz")
+	file, err := os.Create(secondPath)
+	if err != nil {
+		t.Fatalf("could not create log file: %v", err)
+	}
+	gz := gzip.NewWriter(file)
+	gz.Write(second.Bytes())
+	gz.Close()
+	file.Close()
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"traffic_threshold": 2, "no_data_timeout": "0s"}`), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	err = analyzeCommand([]string{firstPath, "-config", configPath, secondPath, "-to", "2018-05-08T10:20:00Z"}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report := out.String()
+
+	for _, expected := range []string{
+		"* Period: 2018-05-08 10:00:00 UTC to 2018-05-08 10:10:02 UTC",
+		"* Entries: 7 (3.0MB), out of 9 lines of which 1 could not be parsed",
+		"Hits, bytes and server errors (5xx) every 1m0s.",
+		"| 2018-05-08 10:00:00 UTC | 2 | 2.0KB | 0 | ████████████████████ |",
+		"| 2018-05-08 10:04:00 UTC | 0 | 0B | 0 |  |",
+		"| 2018-05-08 10:10:00 UTC | 3 | 3.0MB | 0 | ██████████████████████████████ |",
+		"| 1 | /downloads | 3 | 42.9% | 3.0MB | 0 |",
+		"| 2 | /api | 2 | 28.6% | 2.0KB | 0 |",
+		`| /a\|b | 1 | 14.3% | 1000B | 1 |`,
+		"| 1 | 10.0.0.3 | 4 | 57.1% | 3.0MB |",
+		"| 5xx | 1 | 14.3% |",
+		"| 404 | 1 | 14.3% |",
+		"| 2018-05-08 10:10:10 UTC | FIRING | warning | traffic | total | 3 | 2 |",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected report to contain %q, got:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, "10:30:00") {
+		t.Errorf("expected entries after the end of the period to be ignored, got:\n%s", report)
+	}
+
+	out.Reset()
+	err = analyzeCommand([]string{"-format", "html", "-config", configPath, firstPath, secondPath}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report = out.String()
+	for _, expected := range []string{
+		"<!DOCTYPE html>",
+		"<td class=\"text\">/a|b</td>",
+		"<tr class=\"firing\">",
+		"<div class=\"errors\" style=\"height: 66%\"",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected HTML report to contain %q, got:\n%s", expected, report)
+		}
+	}
+
+	if err := analyzeCommand(nil, out); err == nil {
+		t.Error("expected an error without files")
+	}
+	if err := analyzeCommand([]string{"-format", "pdf", firstPath}, out); err == nil {
+		t.Error("expected an error with an unknown format")
+	}
+	if err := analyzeCommand([]string{filepath.Join(dir, "missing.log")}, out); err == nil {
+		t.Error("expected an error with a missing file")
+	}
+}
+
+// This test ensures that entries whose date cannot be parsed are counted as parse failures instead of
+// stretching the analyzed period, and that too many buckets of traffic are refused
+func TestAnalyzeCommandInvalidTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	lines := "10.0.0.1 - - [08/May/2018:10:00:00 +0000] \"GET /api/page HTTP/1.0\" 200 1000\n" +
+		"10.0.0.1 - - [99/Foo/2018:10:00:30 +0000] \"GET /api/page HTTP/1.0\" 200 1000\n" +
+		"10.0.0.1 - - [08/May/2018:10:01:00 +0000] \"GET /api/page HTTP/1.0\" 200 1000\n"
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatalf("could not write log file: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := analyzeCommand([]string{"-bucket", "1s", path}, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report := out.String()
+	for _, expected := range []string{
+		"* Period: 2018-05-08 10:00:00 UTC to 2018-05-08 10:01:00 UTC",
+		"* Entries: 2 (2.0KB), out of 3 lines of which 1 could not be parsed",
+		"Hits, bytes and server errors (5xx) every 1s.",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected report to contain %q, got:\n%s", expected, report)
+		}
+	}
+
+	lines += "10.0.0.1 - - [09/May/2018:10:00:00 +0000] \"GET /api/page HTTP/1.0\" 200 1000\n"
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatalf("could not write log file: %v", err)
+	}
+	if err := analyzeCommand([]string{"-bucket", "1s", path}, out); err == nil {
+		t.Error("expected an error with more than the maximum number of buckets")
+	}
+
+	out.Reset()
+	if err := analyzeCommand([]string{path}, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "every 30m0s.") {
+		t.Errorf("expected buckets of 30 minutes over a day, got:\n%s", out.String())
+	}
+}
+
+// This test ensures that the buckets of the traffic over time are merged into longer ones while entries are
+// added, when their duration is chosen from the analyzed period
+func TestAnalysisReportCoarsensTraffic(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	report := &analysisReport{}
+	for i := 0; i <= maxAnalysisTraffic; i++ {
+		entry := &HTTPEntry{Section: "/a", Size: 10, Status: 200, Time: baseTime.Add(time.Duration(i) * time.Minute)}
+		if err := report.add(entry, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if report.Bucket != 5*time.Minute || len(report.traffic) > maxAnalysisTraffic {
+		t.Errorf("expected %d buckets of 5m at most, got %d buckets of %v", maxAnalysisTraffic, len(report.traffic), report.Bucket)
+	}
+
+	if err := report.summarize(10, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hits := 0
+	for _, b := range report.Traffic {
+		hits += b.Hits
+	}
+	if report.Bucket != 3*time.Hour || hits != maxAnalysisTraffic+1 {
+		t.Errorf("expected %d hits in buckets of 3h, got %d hits in buckets of %v", maxAnalysisTraffic+1, hits, report.Bucket)
+	}
+}
+
+func TestSimulateAlerts(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 2
+	config.NoDataTimeout = Duration{}
+
+	// 2MB are received in 10s, then nothing for 5 minutes
+	entries := []*HTTPEntry{
+		{Section: "/a", Size: 1024 * 1024, Status: 200, Time: baseTime},
+		{Section: "/a", Size: 1024 * 1024, Status: 200, Time: baseTime.Add(5 * time.Second)},
+		{Section: "/a", Size: 10, Status: 200, Time: baseTime.Add(5 * time.Minute)},
+	}
+
+	feed := make(chan *HTTPEntry, len(entries))
+	for _, entry := range entries {
+		feed <- entry
+	}
+	close(feed)
+
+	alerts := simulateAlerts(config, feed)
+	if len(alerts) != 2 {
+		t.Fatalf("expected the traffic alert to fire and resolve, got %+v", alerts)
+	}
+	if alerts[0].State != AlertFiring || !alerts[0].Time.Equal(baseTime.Add(10*time.Second)) {
+		t.Errorf("unexpected firing alert %+v", alerts[0])
+	}
+	if alerts[1].State != AlertResolved || !alerts[1].Time.Equal(baseTime.Add(2*time.Minute)) {
+		t.Errorf("unexpected resolved alert %+v", alerts[1])
+	}
+}
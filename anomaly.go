@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+
+	"github.com/rs/zerolog"
+)
+
+// ewmaDetector detects values of a series that deviate from its exponentially weighted moving average
+// by more than a given number of standard deviations, in either direction
+type ewmaDetector struct {
+	// weight of the latest value in the moving average, between 0 and 1
+	alpha float64
+	// number of standard deviations beyond which a value is anomalous
+	k float64
+	// number of values to observe before detecting anomalies
+	warmup int
+
+	samples  int
+	mean     float64
+	variance float64
+}
+
+func newEWMADetector(alpha, k float64, warmup int) *ewmaDetector {
+	return &ewmaDetector{
+		alpha:  alpha,
+		k:      k,
+		warmup: warmup,
+	}
+}
+
+// observe adds a value to the series, and returns the value that was expected, by how many standard deviations
+// the observed value deviates from it and whether this deviation is anomalous
+func (d *ewmaDetector) observe(value float64) (expected, deviation float64, anomalous bool) {
+	expected = d.mean
+
+	if d.samples == 0 {
+		d.mean = value
+	} else {
+		// a constant series has no variance, so use a minimal standard deviation to avoid
+		// considering the smallest change as an infinite deviation
+		stdDev := math.Max(math.Sqrt(d.variance), math.Max(1, 0.01*math.Abs(d.mean)))
+		deviation = (value - d.mean) / stdDev
+		anomalous = d.samples >= d.warmup && math.Abs(deviation) > d.k
+
+		// anomalous values are not learned, otherwise a lasting spike or drop would quickly become the
+		// expected traffic and resolve its own alert
+		if !anomalous {
+			diff := value - d.mean
+			increment := d.alpha * diff
+			d.mean += increment
+			d.variance = (1 - d.alpha) * (d.variance + diff*increment)
+		}
+	}
+	d.samples++
+
+	return expected, deviation, anomalous
+}
+
+// Checks the number of hits and bytes received since the last refresh against their moving averages
+// Prints a warning when they deviate from it, whether it is a spike or a drop, and an information
+// message when they are back to normal.
+func (lp *LogProcessor) checkAnomalies(entries []*HTTPEntry) {
+	if lp.hitsDetector == nil || lp.bytesDetector == nil {
+		return
+	}
+
+	bytes := uint64(0)
+	for _, entry := range entries {
+		bytes += entry.Size
+	}
+
+	lp.checkAnomaly(hitsAnomalyRule, "hits", lp.hitsDetector, float64(len(entries)))
+	lp.checkAnomaly(bytesAnomalyRule, "bytes", lp.bytesDetector, float64(bytes))
+}
+
+// Observes a new value of a series and updates the state of its alert
+func (lp *LogProcessor) checkAnomaly(rule, name string, detector *ewmaDetector, value float64) {
+	expected, deviation, anomalous := detector.observe(value)
+
+	direction := "spike"
+	if deviation < 0 {
+		direction = "drop"
+	}
+
+	var event *zerolog.Event
+	var message string
+	key := alertKey{rule: rule, subject: alertSubject{kind: totalSubject}}
+	switch lp.updateAlert(key, math.Abs(deviation), detector.k, anomalous) {
+	case alertRaised:
+		event = lp.firingEvent(key).Str("direction", direction)
+		message = "deviate from the expected traffic"
+	case alertOngoing:
+		event = lp.firingEvent(key).Str("direction", direction)
+		message = "still deviate from the expected traffic"
+	case alertResolved:
+		event = lp.report.Info()
+		message = "are back to the expected traffic"
+	default:
+		return
+	}
+
+	event.
+		Float64(name, value).
+		Float64("expected", math.Round(expected)).
+		Float64("deviation", math.Round(deviation*10)/10).
+		Float64("sensitivity", detector.k).
+		Msgf("Total %s since the last refresh %s", name, message)
+}
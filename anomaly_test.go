@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEWMADetector(t *testing.T) {
+	detector := newEWMADetector(0.2, 3, 5)
+
+	// learn a series oscillating around 100
+	for i := 0; i < 20; i++ {
+		value := 95.0
+		if i%2 == 0 {
+			value = 105
+		}
+		_, _, anomalous := detector.observe(value)
+		if anomalous {
+			t.Fatalf("value %v should not be anomalous after %d observations", value, i)
+		}
+	}
+
+	expected, deviation, anomalous := detector.observe(300)
+	if !anomalous || deviation <= 3 {
+		t.Errorf("expected spike to be anomalous with a positive deviation, got anomalous=%v deviation=%v", anomalous, deviation)
+	}
+	if expected < 95 || expected > 105 {
+		t.Errorf("expected value should be around 100, was %v", expected)
+	}
+
+	detector = newEWMADetector(0.2, 3, 5)
+	for i := 0; i < 20; i++ {
+		detector.observe(100 + float64(i%3))
+	}
+	_, deviation, anomalous = detector.observe(0)
+	if !anomalous || deviation >= -3 {
+		t.Errorf("expected drop to zero to be anomalous with a negative deviation, got anomalous=%v deviation=%v", anomalous, deviation)
+	}
+}
+
+// This test ensures that a sustained drop stays anomalous instead of becoming the expected traffic after a few
+// refreshes
+func TestEWMADetectorSustainedDrop(t *testing.T) {
+	detector := newEWMADetector(0.2, 3, 5)
+	for i := 0; i < 20; i++ {
+		detector.observe(100 + float64(i%3))
+	}
+
+	for i := 0; i < 30; i++ {
+		if _, _, anomalous := detector.observe(0); !anomalous {
+			t.Fatalf("expected the drop to still be anomalous after %d refreshes", i)
+		}
+	}
+
+	if expected, _, _ := detector.observe(100); expected < 100 || expected > 102 {
+		t.Errorf("expected the drop not to change the expected value, got %v", expected)
+	}
+}
+
+func TestEWMADetectorWarmup(t *testing.T) {
+	detector := newEWMADetector(0.2, 3, 10)
+
+	detector.observe(10)
+	if _, _, anomalous := detector.observe(10000); anomalous {
+		t.Error("values should not be anomalous during warmup")
+	}
+}
+
+// This test ensures that the log processor raises an alert when no entries are received anymore after
+// a steady traffic, and that the alert is resolved once the traffic comes back
+func TestAnomalyAlerting(t *testing.T) {
+	b := []byte{}
+	buffer := bytes.NewBuffer(b)
+	log := NewZeroLog(buffer, JSON)
+
+	config := DefaultConfig()
+	config.Anomaly = AnomalyConfig{Enabled: true, Smoothing: 0.2, Sensitivity: 3, Warmup: 5}
+	lp := NewLogProcessor(log, log, config, nil, nil, nil, nil, time.Now)
+
+	entries := make([]*HTTPEntry, 50)
+	for i := range entries {
+		entries[i] = &HTTPEntry{Section: "/", Status: 200, Size: 100, Time: time.Now()}
+	}
+
+	for i := 0; i < 10; i++ {
+		lp.Add(entries)
+	}
+	// the alert keeps firing while the drop lasts
+	for i := 0; i < 10; i++ {
+		lp.Add(nil)
+	}
+	if strings.Contains(buffer.String(), "back to the expected traffic") {
+		t.Errorf("expected the alert to keep firing during a sustained drop, got %s", buffer.String())
+	}
+	lp.Add(entries)
+
+	expectedLogs := []string{
+		`{"level":"warn","direction":"drop","hits":0,"expected":50,"deviation":-50,"sensitivity":3,"message":"Total hits since the last refresh deviate from the expected traffic"}`,
+		`{"level":"warn","direction":"drop","bytes":0,"expected":5000,"deviation":-100,"sensitivity":3,"message":"Total bytes since the last refresh deviate from the expected traffic"}`,
+		`"message":"Total hits since the last refresh are back to the expected traffic"`,
+	}
+	for _, expected := range expectedLogs {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected log %s", expected)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// api serves the HTTP API of the agent
+type api struct {
+	log       *zerolog.Logger
+	processor *LogProcessor
+	silences  *silenceStore
+	// file path to the alert history, which is empty when it is disabled
+	historyPath string
+	// rollups of the traffic, which are disabled when their path is empty
+	rollups RollupConfig
+	now     func() time.Time
+}
+
+func newAPI(log *zerolog.Logger, processor *LogProcessor, silences *silenceStore, historyPath string, rollups RollupConfig, now func() time.Time) *api {
+	return &api{
+		log:         log,
+		processor:   processor,
+		silences:    silences,
+		historyPath: historyPath,
+		rollups:     rollups,
+		now:         now,
+	}
+}
+
+// Handler returns the HTTP handler of the API
+func (a *api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sections/top", a.handleTopSections)
+	mux.HandleFunc("/api/top/", a.handleHeavyHitters)
+	mux.HandleFunc("/api/stats", a.handleStats)
+	mux.HandleFunc("/api/statuses", a.handleStatuses)
+	mux.HandleFunc("/api/alerts", a.handleAlerts)
+	mux.HandleFunc("/api/alerts/history", a.handleAlertHistory)
+	mux.HandleFunc("/api/rollups", a.handleRollups)
+	mux.HandleFunc("/api/silences", a.handleSilences)
+	mux.HandleFunc("/api/silences/", a.handleSilence)
+	return mux
+}
+
+// serveAPI serves the HTTP API on the given address
+func serveAPI(log *zerolog.Logger, address string, handler http.Handler) {
+	log.Info().Str("api_address", address).Msg("Serving HTTP API")
+
+	err := http.ListenAndServe(address, handler)
+	if err != nil {
+		log.Error().Err(err).Str("api_address", address).Msg("HTTP API stopped")
+	}
+}
+
+// handleTopSections returns the sections with the most hits over the last 2 minutes, or over the window given by
+// the window parameter. The number of sections is given by the n parameter, and is the configured number of top
+// hits by default
+func (a *api) handleTopSections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := a.processor.topHitsNumber
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid number of sections %q", value))
+			return
+		}
+	}
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		a.writeJSON(w, http.StatusOK, a.processor.TopSections(n))
+		return
+	}
+
+	sections, err := a.processor.RankedSections(window, n)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, sections)
+}
+
+// handleHeavyHitters returns the most frequent keys of a dimension since the agent started, such as
+// /api/top/clients. The number of keys is given by the n parameter, and is the configured number of top hits by
+// default
+func (a *api) handleHeavyHitters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := a.processor.topHitsNumber
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid number of keys %q", value))
+			return
+		}
+	}
+
+	hitters, err := a.processor.HeavyHitters(strings.TrimPrefix(r.URL.Path, "/api/top/"), n)
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, hitters)
+}
+
+// handleStats returns statistics about the traffic over the last 2 minutes
+func (a *api) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, a.processor.WindowStats())
+}
+
+// handleStatuses returns the status classes of the entries from the last 2 minutes
+func (a *api) handleStatuses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, a.processor.StatusBreakdown())
+}
+
+// handleAlerts returns the alerts that are currently pending or firing
+func (a *api) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, a.processor.ActiveAlerts())
+}
+
+// handleAlertHistory returns the alert state changes recorded in the alert history, filtered with the same
+// from, to and rule parameters as the "alerts history" command
+func (a *api) handleAlertHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.historyPath == "" {
+		a.writeError(w, http.StatusNotFound, fmt.Errorf("alert history is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	now := a.now()
+	from, err := parseTimeFilter(query.Get("from"), now)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseTimeFilter(query.Get("to"), now)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	history, err := readAlertHistory(a.historyPath, from, to)
+	if err != nil && !os.IsNotExist(err) {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	alerts := []Alert{}
+	for _, alert := range history {
+		if rule := query.Get("rule"); rule == "" || alert.Rule == rule {
+			alerts = append(alerts, alert)
+		}
+	}
+	a.writeJSON(w, http.StatusOK, alerts)
+}
+
+// handleRollups returns the traffic and the top sections of a time range, read from the rollups. The time range
+// is given by the from and to parameters, the resolution by the resolution parameter and the number of sections
+// by the n parameter, 10 by default
+func (a *api) handleRollups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.rollups.Path == "" {
+		a.writeError(w, http.StatusNotFound, fmt.Errorf("rollups are disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	now := a.now()
+	from, err := parseTimeFilter(query.Get("from"), now)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseTimeFilter(query.Get("to"), now)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n := 10
+	if value := query.Get("n"); value != "" {
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid number of sections %q", value))
+			return
+		}
+	}
+
+	resolution := query.Get("resolution")
+	switch resolution {
+	case "", "auto", "minute", "hour", "day":
+	default:
+		a.writeError(w, http.StatusBadRequest, fmt.Errorf("unknown resolution %q", resolution))
+		return
+	}
+
+	result, err := queryRollups(a.rollups, from, to, resolution, n, now)
+	if err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, result)
+}
+
+// handleSilences lists the silences on GET, and creates a silence on POST. Silences that don't have a start
+// time start right away
+func (a *api) handleSilences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		silences, err := a.silences.List(a.now())
+		if err != nil {
+			a.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		a.writeJSON(w, http.StatusOK, silences)
+	case http.MethodPost:
+		var silence Silence
+		err := json.NewDecoder(r.Body).Decode(&silence)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if silence.StartsAt.IsZero() {
+			silence.StartsAt = a.now()
+		}
+		if err := silence.Validate(); err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		silence, err = a.silences.Add(silence, a.now())
+		if err == errNoSilencesFile {
+			a.writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			a.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		a.log.Info().Str("silence_id", silence.ID).Str("comment", silence.Comment).Msg("Silence created from the API")
+		a.writeJSON(w, http.StatusCreated, silence)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSilence removes a silence on DELETE
+func (a *api) handleSilence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/silences/")
+	err := a.silences.Remove(id, a.now())
+	if err == errSilenceNotFound {
+		a.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	a.log.Info().Str("silence_id", id).Msg("Silence removed from the API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		a.log.Error().Err(err).Msg("Could not write API response")
+	}
+}
+
+func (a *api) writeError(w http.ResponseWriter, status int, err error) {
+	a.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
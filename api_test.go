@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// This test ensures that the statistics endpoints of the API return the current state of the log processor,
+// and that they can be queried while entries are being processed
+func TestStatsAPI(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	historyPath := filepath.Join(dir, "alert_history.jsonl")
+	history, err := openAlertHistory(historyPath)
+	if err != nil {
+		t.Fatalf("could not open alert history: %v", err)
+	}
+	defer history.Close()
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 1
+	config.TopHitsNumber = 2
+	lp := NewLogProcessor(log, log, config, history, nil, nil, nil, func() time.Time { return baseTime })
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Path: "/api/user", ClientAddress: "10.0.0.1", Status: 200, Size: 1024 * 1024, Time: baseTime},
+		{Section: "/api", Path: "/api/user", ClientAddress: "10.0.0.1", Status: 500, Size: 100, Time: baseTime},
+		{Section: "/static", Status: 304, Size: 10, Time: baseTime},
+		{Section: "/user", Status: 404, Size: 10, Time: baseTime},
+	})
+
+	server := httptest.NewServer(newAPI(log, lp, nil, historyPath, RollupConfig{}, func() time.Time { return baseTime }).Handler())
+	defer server.Close()
+
+	get := func(path string, expectedStatus int, value interface{}) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("expected status %d for %s, got %d", expectedStatus, path, resp.StatusCode)
+			return
+		}
+		if value != nil {
+			if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+				t.Errorf("could not decode response to %s: %v", path, err)
+			}
+		}
+	}
+
+	// entries keep being processed while the API is queried
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			lp.Add(nil)
+		}
+	}()
+	get("/api/stats", http.StatusOK, nil)
+	<-done
+
+	var top []SectionStats
+	get("/api/sections/top", http.StatusOK, &top)
+	if len(top) != 2 || top[0].Section != "/api" || top[0].Hits != 2 || top[0].Bytes != 1024*1024+100 {
+		t.Errorf("unexpected top sections %+v", top)
+	}
+	get("/api/sections/top?n=5", http.StatusOK, &top)
+	if len(top) != 3 {
+		t.Errorf("expected 3 sections, got %+v", top)
+	}
+	get("/api/sections/top?n=0", http.StatusBadRequest, nil)
+	get("/api/sections/top?n=five", http.StatusBadRequest, nil)
+
+	var hitters []HeavyHitter
+	get("/api/top/clients?n=1", http.StatusOK, &hitters)
+	if len(hitters) != 1 || hitters[0].Key != "10.0.0.1" || hitters[0].Count != 2 {
+		t.Errorf("unexpected top clients %+v", hitters)
+	}
+	get("/api/top/paths", http.StatusOK, &hitters)
+	if len(hitters) != 1 || hitters[0].Key != "/api/user" || hitters[0].Count != 2 {
+		t.Errorf("unexpected top paths %+v", hitters)
+	}
+	get("/api/top/referers", http.StatusNotFound, nil)
+
+	var stats WindowStats
+	get("/api/stats", http.StatusOK, &stats)
+	if stats.Entries != 4 || stats.TotalEntries != 4 || stats.Sections != 3 || stats.ActiveAlerts != 1 || !stats.Time.Equal(baseTime) {
+		t.Errorf("unexpected window stats %+v", stats)
+	}
+
+	var statuses struct {
+		Total    map[string]int            `json:"total"`
+		Sections map[string]map[string]int `json:"sections"`
+	}
+	get("/api/statuses", http.StatusOK, &statuses)
+	if statuses.Total["2xx"] != 1 || statuses.Total["3xx"] != 1 || statuses.Total["4xx"] != 1 || statuses.Total["5xx"] != 1 {
+		t.Errorf("unexpected total statuses %v", statuses.Total)
+	}
+	if statuses.Sections["/api"]["5xx"] != 1 || statuses.Sections["/api"]["2xx"] != 1 {
+		t.Errorf("unexpected section statuses %v", statuses.Sections)
+	}
+
+	var alerts []Alert
+	get("/api/alerts", http.StatusOK, &alerts)
+	if len(alerts) != 1 || alerts[0].Rule != trafficRule || alerts[0].State != AlertFiring {
+		t.Errorf("unexpected active alerts %+v", alerts)
+	}
+
+	get("/api/alerts/history?rule=traffic&from=1h", http.StatusOK, &alerts)
+	if len(alerts) != 1 || alerts[0].State != AlertFiring {
+		t.Errorf("unexpected alert history %+v", alerts)
+	}
+	get("/api/alerts/history?rule=no_data", http.StatusOK, &alerts)
+	if len(alerts) != 0 {
+		t.Errorf("expected alert history to be filtered by rule, got %+v", alerts)
+	}
+	get("/api/alerts/history?from=yesterday", http.StatusBadRequest, nil)
+
+	resp, err := http.Post(server.URL+"/api/stats", "application/json", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// commandNotifier executes a command on every alert state change, for example to automatically remediate
+// an issue. Alert details are given to the command through environment variables and as JSON on its
+// standard input. Commands are queued and executed asynchronously, with a limited number of them running
+// at the same time
+type commandNotifier struct {
+	log    *zerolog.Logger
+	config CommandConfig
+
+	queue chan Alert
+	done  sync.WaitGroup
+}
+
+// newCommandNotifier creates a command notifier and starts executing its queued commands
+func newCommandNotifier(log *zerolog.Logger, config CommandConfig) (*commandNotifier, error) {
+	if config.Command == "" {
+		return nil, fmt.Errorf("command notifier has no command")
+	}
+	if config.MaxConcurrency < 1 {
+		config.MaxConcurrency = 1
+	}
+
+	c := &commandNotifier{
+		log:    log,
+		config: config,
+		queue:  make(chan Alert, config.QueueSize),
+	}
+
+	for i := 0; i < config.MaxConcurrency; i++ {
+		c.done.Add(1)
+		go c.run()
+	}
+
+	return c, nil
+}
+
+// Notify queues the execution of the command for an alert, or returns an error if the queue is full
+func (c *commandNotifier) Notify(alert Alert) error {
+	select {
+	case c.queue <- alert:
+		return nil
+	default:
+		return errNotificationQueueFull
+	}
+}
+
+// Close stops accepting alerts and waits for the queued commands to be executed
+func (c *commandNotifier) Close() error {
+	close(c.queue)
+	c.done.Wait()
+	return nil
+}
+
+func (c *commandNotifier) run() {
+	defer c.done.Done()
+
+	for alert := range c.queue {
+		c.execute(alert)
+	}
+}
+
+// execute runs the command for an alert and logs its result
+func (c *commandNotifier) execute(alert Alert) {
+	input, err := json.Marshal(alert)
+	if err != nil {
+		c.log.Error().Err(err).Str("command", c.config.Command).Msg("Could not encode alert for command")
+		return
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(c.config.Command, c.config.Args...)
+	cmd.Env = append(os.Environ(), alertEnvironment(alert)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	start := time.Now()
+	waited := true
+	err = cmd.Start()
+	if err == nil {
+		waited, err = c.wait(cmd)
+	}
+	duration := time.Since(start)
+
+	// the output and the exit status are still being written when the command could not be waited for
+	exitStatus := -1
+	output, errorOutput := "", ""
+	if waited {
+		if cmd.ProcessState != nil {
+			exitStatus = cmd.ProcessState.ExitCode()
+		}
+		output, errorOutput = strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String())
+	}
+
+	if err != nil {
+		c.log.Error().
+			Err(err).
+			Str("command", c.config.Command).
+			Str("rule", alert.Rule).
+			Str("state", string(alert.State)).
+			Int("exit_status", exitStatus).
+			Str("stderr", errorOutput).
+			Dur("duration", duration).
+			Msg("Alert command failed")
+		return
+	}
+
+	c.log.Info().
+		Str("command", c.config.Command).
+		Str("rule", alert.Rule).
+		Str("state", string(alert.State)).
+		Int("exit_status", exitStatus).
+		Str("stdout", output).
+		Str("stderr", errorOutput).
+		Dur("duration", duration).
+		Msg("Alert command executed")
+}
+
+// commandWaitDelay is how long a command that timed out is waited for once it is killed. Processes that left
+// its process group can keep its output open, in which case the command is not waited for any longer
+const commandWaitDelay = 5 * time.Second
+
+// wait waits for a started command to exit, and kills its process group when it does not exit before the
+// timeout. It returns false if the command could still not be waited for after commandWaitDelay
+func (c *commandNotifier) wait(cmd *exec.Cmd) (bool, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if c.config.Timeout.Duration > 0 {
+		timer := time.NewTimer(c.config.Timeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-timeout:
+	}
+
+	err := killProcessGroup(cmd)
+	if err != nil {
+		c.log.Error().Err(err).Str("command", c.config.Command).Msg("Could not kill alert command")
+	}
+
+	timedOut := fmt.Errorf("command timed out after %s", c.config.Timeout.Duration)
+	select {
+	case <-done:
+		return true, timedOut
+	case <-time.After(commandWaitDelay):
+		return false, timedOut
+	}
+}
+
+// alertEnvironment returns the environment variables describing an alert
+func alertEnvironment(alert Alert) []string {
+	return []string{
+		"HK_ALERT_STATE=" + string(alert.State),
+		"HK_ALERT_RULE=" + alert.Rule,
+		"HK_ALERT_SEVERITY=" + string(alert.Severity),
+		"HK_ALERT_SUBJECT=" + alert.Subject,
+		"HK_ALERT_NAME=" + alert.Name,
+		fmt.Sprintf("HK_ALERT_VALUE=%g", alert.Value),
+		fmt.Sprintf("HK_ALERT_PEAK=%g", alert.Peak),
+		fmt.Sprintf("HK_ALERT_THRESHOLD=%g", alert.Threshold),
+		"HK_ALERT_TIME=" + alert.Time.Format(time.RFC3339),
+		"HK_ALERT_STARTS_AT=" + alert.StartsAt.Format(time.RFC3339),
+		"HK_ALERT_SUMMARY=" + alert.Summary(),
+	}
+}
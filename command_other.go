@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing, as process groups are not supported on this platform
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills a started command. The processes it started keep running
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
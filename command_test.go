@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer that can be written by several goroutines, such as the workers of a notifier
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestCommandNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "output")
+
+	buffer := &bytes.Buffer{}
+	log := NewZeroLog(buffer, JSON)
+	command, err := newCommandNotifier(log, CommandConfig{
+		Command:        "sh",
+		Args:           []string{"-c", `echo "$HK_ALERT_STATE $HK_ALERT_RULE $HK_ALERT_NAME $HK_ALERT_VALUE" > ` + output + `; cat >> ` + output + `; echo failing >&2; exit 3`},
+		Timeout:        Duration{5 * time.Second},
+		MaxConcurrency: 1,
+		QueueSize:      1,
+	})
+	if err != nil {
+		t.Fatalf("could not create command notifier: %v", err)
+	}
+
+	command.Notify(Alert{State: AlertFiring, Rule: trafficRule, Subject: sectionSubject, Name: "/api", Value: 3})
+	command.Close()
+
+	result, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("command was not executed: %v", err)
+	}
+
+	lines := strings.SplitN(string(result), "\n", 2)
+	if lines[0] != "firing traffic /api 3" {
+		t.Errorf("unexpected alert environment variables: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"rule":"traffic"`) || !strings.Contains(lines[1], `"name":"/api"`) {
+		t.Errorf("expected alert to be given as JSON on standard input, got %s", lines[1])
+	}
+
+	if !strings.Contains(buffer.String(), `"exit_status":3,"stderr":"failing"`) || !strings.Contains(buffer.String(), `"message":"Alert command failed"`) {
+		t.Errorf("expected exit status and stderr to be logged, got %s", buffer.String())
+	}
+}
+
+func TestCommandNotifierTimeout(t *testing.T) {
+	// both commands run at the same time, and log their result from their own worker
+	buffer := &syncBuffer{}
+	log := NewZeroLog(buffer, JSON)
+	command, err := newCommandNotifier(log, CommandConfig{
+		Command:        "sleep",
+		Args:           []string{"10"},
+		Timeout:        Duration{50 * time.Millisecond},
+		MaxConcurrency: 2,
+		QueueSize:      2,
+	})
+	if err != nil {
+		t.Fatalf("could not create command notifier: %v", err)
+	}
+
+	start := time.Now()
+	command.Notify(Alert{State: AlertFiring, Rule: trafficRule, Subject: totalSubject})
+	command.Notify(Alert{State: AlertResolved, Rule: trafficRule, Subject: totalSubject})
+	command.Close()
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected commands to be killed after their timeout")
+	}
+	if strings.Count(buffer.String(), `"error":"command timed out after 50ms"`) != 2 {
+		t.Errorf("expected both commands to time out, got %s", buffer.String())
+	}
+}
+
+// This test ensures that the processes started by a command are killed along with it when it times out, so
+// that a child keeping its output open does not block its worker
+func TestCommandNotifierTimeoutKillsChildren(t *testing.T) {
+	buffer := &syncBuffer{}
+	log := NewZeroLog(buffer, JSON)
+	command, err := newCommandNotifier(log, CommandConfig{
+		Command:        "sh",
+		Args:           []string{"-c", "sleep 10 & sleep 10"},
+		Timeout:        Duration{50 * time.Millisecond},
+		MaxConcurrency: 1,
+		QueueSize:      1,
+	})
+	if err != nil {
+		t.Fatalf("could not create command notifier: %v", err)
+	}
+
+	start := time.Now()
+	command.Notify(Alert{State: AlertFiring, Rule: trafficRule, Subject: totalSubject})
+	command.Close()
+
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("expected the children of the command to be killed after its timeout, took %v", time.Since(start))
+	}
+	if !strings.Contains(buffer.String(), `"error":"command timed out after 50ms"`) {
+		t.Errorf("expected the command to time out, got %s", buffer.String())
+	}
+}
+
+// This test ensures that the commands that are still queued when the agent stops are executed
+func TestCommandNotifierDrainsQueueOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "output")
+	log := NewZeroLog(ioutil.Discard, JSON)
+	command, err := newCommandNotifier(log, CommandConfig{
+		Command:        "sh",
+		Args:           []string{"-c", `sleep 0.05; echo "$HK_ALERT_STATE" >> ` + output},
+		MaxConcurrency: 1,
+		QueueSize:      3,
+	})
+	if err != nil {
+		t.Fatalf("could not create command notifier: %v", err)
+	}
+
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil, []Notifier{command}, nil, nil, time.Now)
+	for _, state := range []AlertState{AlertPending, AlertFiring, AlertResolved} {
+		lp.notify(Alert{State: state, Rule: trafficRule, Subject: totalSubject})
+	}
+	lp.Close(5 * time.Second)
+
+	result, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("commands were not executed: %v", err)
+	}
+	if string(result) != "pending\nfiring\nresolved\n" {
+		t.Errorf("expected all the queued commands to be executed, got %q", result)
+	}
+}
+
+func TestCommandNotifierQueueFull(t *testing.T) {
+	log := NewZeroLog(&bytes.Buffer{}, JSON)
+	command, err := newCommandNotifier(log, CommandConfig{
+		Command:        "sleep",
+		Args:           []string{"0.2"},
+		MaxConcurrency: 1,
+		QueueSize:      1,
+	})
+	if err != nil {
+		t.Fatalf("could not create command notifier: %v", err)
+	}
+	defer command.Close()
+
+	alert := Alert{State: AlertFiring, Rule: trafficRule, Subject: totalSubject}
+	command.Notify(alert)
+	time.Sleep(50 * time.Millisecond)
+	command.Notify(alert)
+
+	if err := command.Notify(alert); err != errNotificationQueueFull {
+		t.Errorf("expected queue full error, got %v", err)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -10,41 +15,642 @@ import (
 
 // Config represents the HKAgent configuration
 type Config struct {
-	// log level used by the logger
-	LogLevel string
+	// log level of the agent diagnostics
+	LogLevel string `json:"log_level"`
+
+	// destination and format of the agent diagnostics, "stderr" and "console" by default
+	Diagnostics OutputConfig `json:"diagnostics"`
+
+	// destination and format of the reports, which are the statistics of every refresh and the alerts,
+	// "stdout" and "console" by default
+	Report OutputConfig `json:"report"`
 
 	// file path to the log file that will be read by hk-agent
-	LogFilePath string
+	LogFilePath string `json:"log_file_path"`
+
+	// format of the lines of the log file, "common" (Common Log Format) by default, or "combined" (Combined Log
+	// Format) for the user agents to be parsed
+	LogFormat string `json:"log_format"`
 
 	// traffic threshold that triggers an alert when traffic from the last 2mns represents more
 	// megabytes than this number
-	TrafficThreshold uint64
+	TrafficThreshold uint64 `json:"traffic_threshold"`
+
+	// traffic thresholds in megabytes for specific sections, which trigger an alert naming the
+	// section when its traffic from the last 2mns exceeds them
+	SectionTrafficThresholds map[string]uint64 `json:"section_traffic_thresholds"`
+
+	// traffic thresholds in megabytes for specific client addresses or CIDR ranges, which trigger
+	// an alert naming the client when its traffic from the last 2mns exceeds them
+	ClientTrafficThresholds map[string]uint64 `json:"client_traffic_thresholds"`
+
+	// percentage of server errors (5xx) amongst the requests from the last 2mns that triggers an
+	// alert, for the total traffic as well as for each section. 0 disables this alert
+	ServerErrorRateThreshold float64 `json:"server_error_rate_threshold"`
+
+	// percentage of client errors (4xx) amongst the requests from the last 2mns that triggers an
+	// alert, for the total traffic as well as for each section. 0 disables this alert
+	ClientErrorRateThreshold float64 `json:"client_error_rate_threshold"`
+
+	// minimum number of requests from the last 2mns for error rate alerts to be raised, so that a
+	// single failed request does not trigger them
+	ErrorRateMinRequests int `json:"error_rate_min_requests"`
+
+	// detection of anomalies in the number of hits and bytes received at every refresh
+	Anomaly AnomalyConfig `json:"anomaly"`
+
+	// duration after which an alert is triggered when no new entries were received from the log file.
+	// 0 disables this alert
+	NoDataTimeout Duration `json:"no_data_timeout"`
+
+	// duration for which the threshold of a rule needs to be exceeded before its alert starts firing.
+	// Until then, the alert is pending
+	AlertPendingPeriod Duration `json:"alert_pending_period"`
+
+	// severities of the alerts raised by each rule, keyed by rule name, such as "traffic" or "no_data".
+	// Alerts are warnings by default
+	Severities map[string]RuleSeverityConfig `json:"severities"`
+
+	// intervals at which alerts that keep firing are logged and notified again, for each severity. By default,
+	// firing alerts are only reported again when their severity changes
+	RenotifyIntervals map[Severity]Duration `json:"renotify_intervals"`
+
+	// file path to the file in which all alert state changes are recorded, as JSON lines. The
+	// history can be printed using the "alerts history" command. Empty disables the alert history
+	AlertHistoryPath string `json:"alert_history_path"`
+
+	// webhooks to which alert state changes are sent
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// SMTP servers through which alerts are sent by email when they start firing and when they are resolved
+	Emails []EmailConfig `json:"emails"`
+
+	// commands executed on every alert state change, for example to automatically remediate issues
+	Commands []CommandConfig `json:"commands"`
+
+	// silences suppressing the notifications of the alerts they match between their start and end times
+	Silences []Silence `json:"silences"`
+
+	// file path to the file in which the silences created from the CLI or the API are stored. Empty only
+	// allows the silences of the configuration
+	SilencesPath string `json:"silences_path"`
+
+	// file path to the file in which the state of the agent is saved, so that the top sections, the recent
+	// traffic and the active alerts are restored when it restarts. Empty disables it
+	StatePath string `json:"state_path"`
+
+	// interval at which the state of the agent is saved. It is also saved when the agent stops
+	StateSnapshotInterval Duration `json:"state_snapshot_interval"`
+
+	// recurring silences, during which alerts are still evaluated and recorded but not notified
+	MaintenanceWindows []MaintenanceWindowConfig `json:"maintenance_windows"`
+
+	// address on which the HTTP API listens, such as "localhost:8080". Empty disables the API
+	APIAddress string `json:"api_address"`
+
+	// file to which the report of every refresh is appended, as JSON lines or CSV
+	Export ExportConfig `json:"export"`
+
+	// per-minute rollups of the traffic, downsampled to hourly and daily rollups, which can be queried with the
+	// "rollups" command or the API
+	Rollups RollupConfig `json:"rollups"`
+
+	// StatsD server to which the statistics of every refresh are sent
+	StatsD StatsDConfig `json:"statsd"`
+
+	// OpenTelemetry collector to which the statistics of every refresh and alert state changes are exported
+	OTLP OTLPConfig `json:"otlp"`
+
+	// address on which Prometheus metrics are served on /metrics, such as "localhost:9100". Empty disables them
+	MetricsAddress string `json:"metrics_address"`
+
+	// address on which the web UI is served, such as "localhost:8081". Empty disables it
+	WebUIAddress string `json:"web_ui_address"`
+
+	// maximum number of sections that have their own metrics. The traffic of the other sections is
+	// exported with the "other" section label, so that the number of metrics stays bounded
+	MetricsMaxSections int `json:"metrics_max_sections"`
 
 	// number of top hits to display when processing metrics
-	TopHitsNumber int
+	TopHitsNumber int `json:"top_hits_number"`
+
+	// windows over which the top sections are displayed next to the top sections since the agent started,
+	// such as "5m" or "1h". "0s" is the last refresh
+	TopWindows []Duration `json:"top_windows"`
+
+	// duration after which the weight of a hit is halved in the decayed ranking of the sections, which favors
+	// recent hits without forgetting older ones. 0 disables the decayed ranking
+	TopDecayHalfLife Duration `json:"top_decay_half_life"`
+
+	// bounds on the memory used to count the hits of every section, path, client and user agent since the
+	// agent started
+	HeavyHitters HeavyHittersConfig `json:"heavy_hitters"`
 
 	// period after which the agent should fetch new logs and display new metrics/alerts
-	RefreshPeriod time.Duration
+	RefreshPeriod Duration `json:"refresh_period"`
+
+	// duration for which entries received out of order are waited for. The recent traffic is evaluated over
+	// the 2 minutes ending at the time of the refresh minus this duration, so alerts are delayed by it. Entries
+	// older than the window are dropped
+	AllowedLateness Duration `json:"allowed_lateness"`
+
+	// full-screen terminal dashboard, displayed instead of the log lines
+	Dashboard DashboardConfig `json:"dashboard"`
+
+	// replay of an archived log file, in which the clock of the agent follows the timestamps of the log entries
+	Replay ReplayConfig `json:"replay"`
+}
+
+// OutputConfig configures the destination and format of an output of the agent
+type OutputConfig struct {
+	// "stdout", "stderr", "discard", or the path to a file to which the output is appended
+	Destination string `json:"destination"`
+
+	// "console" for human-readable lines, or "json" for JSON lines
+	Format string `json:"format"`
+}
+
+// DashboardConfig configures the full-screen terminal dashboard
+type DashboardConfig struct {
+	// displays the dashboard, which can also be enabled with the -dashboard flag
+	Enabled bool `json:"enabled"`
+
+	// file path to the file to which the diagnostics and reports written to the terminal are redirected
+	// while the dashboard is displayed. Empty discards them
+	LogFilePath string `json:"log_file_path"`
+}
+
+// ReplayConfig configures the replay of an archived log file. The file is read from its beginning, and the
+// entries are processed at every refresh period of a clock starting at the time of the first entry, so that
+// the alerts raised when the logs were written are reproduced
+type ReplayConfig struct {
+	// replays the log file, which can also be enabled with the -replay flag
+	Enabled bool `json:"enabled"`
+
+	// number of times faster than real time the log file is replayed, 1 by default. 0 replays it as fast
+	// as possible
+	Speed float64 `json:"speed"`
+
+	// sends the alerts of the replay to the webhooks, emails, commands and OpenTelemetry collector. They are
+	// disabled by default, so that replaying old logs does not page anyone
+	Notify bool `json:"notify"`
+
+	// records the alerts of the replay into the alert history. It is disabled by default, so that old alerts
+	// are not mixed with the live ones
+	RecordHistory bool `json:"record_history"`
+
+	// exports the metrics of the replay to the rollups, the export files, StatsD, the Prometheus endpoint and
+	// the OpenTelemetry collector. They are disabled by default, so that old traffic is not mixed with the live
+	// metrics
+	RecordMetrics bool `json:"record_metrics"`
+}
+
+// AnomalyConfig configures the detection of traffic spikes and drops, which compares the hits and bytes
+// received at every refresh to their exponentially weighted moving average
+type AnomalyConfig struct {
+	// enables the anomaly detection
+	Enabled bool `json:"enabled"`
+
+	// weight of the latest refresh in the moving average, between 0 and 1. Higher values adapt faster
+	// to changes in the traffic. Anomalous refreshes are not learned, so a lasting change keeps firing
+	Smoothing float64 `json:"smoothing"`
+
+	// number of standard deviations from the moving average beyond which the traffic is anomalous
+	Sensitivity float64 `json:"sensitivity"`
+
+	// number of refreshes used to learn the usual traffic before detecting anomalies
+	Warmup int `json:"warmup"`
+}
+
+// HeavyHittersConfig configures the tracking of the most frequent sections, paths, clients and user agents,
+// which only counts a fixed number of keys so that its memory stays bounded however many distinct keys are seen
+type HeavyHittersConfig struct {
+	// number of keys tracked for each dimension. Every key seen more often than 1/capacity of the time is
+	// tracked, and the counts can be overestimated by at most the total number of hits divided by the capacity
+	Capacity int `json:"capacity"`
+
+	// error of the count-min sketch estimating the counts of the keys that are not tracked, as a fraction of
+	// the total number of hits, up to 1. The sketch keeps keys seen only once from evicting frequent ones. 0
+	// disables it. Its width is bounded, so errors below e/65536 are not reached
+	Epsilon float64 `json:"epsilon"`
+
+	// probability that an estimation of the sketch is beyond its error, strictly between 0 and 1
+	Delta float64 `json:"delta"`
+}
+
+// WebhookConfig configures a webhook to which alert state changes are sent
+type WebhookConfig struct {
+	// URL of the webhook
+	URL string `json:"url"`
+
+	// HTTP method used to call the webhook, POST by default
+	Method string `json:"method"`
+
+	// HTTP headers sent to the webhook, for example to authenticate
+	Headers map[string]string `json:"headers"`
+
+	// Go template of the request body, which is executed with the alert. The "json" function can be used
+	// to encode values as JSON, for example {"text": {{ json .Summary }}}. By default, the alert is sent as JSON
+	Template string `json:"template"`
+
+	// timeout of each request to the webhook
+	Timeout Duration `json:"timeout"`
+
+	// number of times a failed request is retried, waiting for RetryBackoff before the first retry and
+	// twice as long before each of the following ones
+	MaxRetries   int      `json:"max_retries"`
+	RetryBackoff Duration `json:"retry_backoff"`
+
+	// maximum number of notifications waiting to be sent, after which new notifications are dropped
+	QueueSize int `json:"queue_size"`
+
+	// severities of the alerts sent to the webhook. Empty sends alerts of any severity
+	Severities []Severity `json:"severities"`
+}
+
+// UnmarshalJSON reads a webhook configuration, using default values for the fields that are not set
+func (wc *WebhookConfig) UnmarshalJSON(data []byte) error {
+	// use another type to avoid calling this method recursively
+	type webhookConfig WebhookConfig
+	config := webhookConfig{
+		Method:       "POST",
+		Timeout:      Duration{10 * time.Second},
+		MaxRetries:   5,
+		RetryBackoff: Duration{time.Second},
+		QueueSize:    100,
+	}
+
+	err := unmarshalStrict(data, &config)
+	*wc = WebhookConfig(config)
+	return err
+}
+
+// EmailConfig configures an SMTP server through which alerts are sent by email
+type EmailConfig struct {
+	// address and port of the SMTP server
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// credentials used to authenticate to the SMTP server, if any
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// connections are upgraded with STARTTLS when the server supports it, unless this is set
+	DisableStartTLS bool `json:"disable_starttls"`
+
+	// sender and recipients of the emails
+	From string   `json:"from"`
+	To   []string `json:"to"`
+
+	// prefix of the subject of the emails
+	SubjectPrefix string `json:"subject_prefix"`
+
+	// minimum duration between two emails. Alerts that change state in the meantime are sent together
+	// in a digest email at the end of the interval
+	DigestInterval Duration `json:"digest_interval"`
+
+	// timeout of the connection to the SMTP server
+	Timeout Duration `json:"timeout"`
+
+	// maximum number of alerts waiting to be sent, after which new alerts are dropped
+	QueueSize int `json:"queue_size"`
+
+	// severities of the alerts sent by email. Empty sends alerts of any severity
+	Severities []Severity `json:"severities"`
+}
+
+// UnmarshalJSON reads an email configuration, using default values for the fields that are not set
+func (ec *EmailConfig) UnmarshalJSON(data []byte) error {
+	// use another type to avoid calling this method recursively
+	type emailConfig EmailConfig
+	config := emailConfig{
+		Port:           587,
+		SubjectPrefix:  "[hk-agent]",
+		DigestInterval: Duration{5 * time.Minute},
+		Timeout:        Duration{10 * time.Second},
+		QueueSize:      100,
+	}
+
+	err := unmarshalStrict(data, &config)
+	*ec = EmailConfig(config)
+	return err
+}
+
+// CommandConfig configures a command executed on every alert state change. The alert is given to the
+// command as JSON on its standard input, and through HK_ALERT_* environment variables
+type CommandConfig struct {
+	// path to the command and its arguments
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+
+	// duration after which the command is killed
+	Timeout Duration `json:"timeout"`
+
+	// maximum number of commands running at the same time
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// maximum number of commands waiting to be executed, after which new alerts are dropped
+	QueueSize int `json:"queue_size"`
+
+	// severities of the alerts for which the command is executed. Empty executes it for any severity
+	Severities []Severity `json:"severities"`
+}
+
+// UnmarshalJSON reads a command configuration, using default values for the fields that are not set
+func (cc *CommandConfig) UnmarshalJSON(data []byte) error {
+	// use another type to avoid calling this method recursively
+	type commandConfig CommandConfig
+	config := commandConfig{
+		Timeout:        Duration{30 * time.Second},
+		MaxConcurrency: 4,
+		QueueSize:      100,
+	}
+
+	err := unmarshalStrict(data, &config)
+	*cc = CommandConfig(config)
+	return err
+}
+
+// ExportConfig configures the file to which the report of every refresh is appended
+type ExportConfig struct {
+	// file path to the export file. Empty disables the export
+	Path string `json:"path"`
+
+	// format of the export, "jsonl" by default or "csv"
+	Format string `json:"format"`
+
+	// size in bytes after which the export file is rotated. 0 disables the rotation
+	MaxSize int64 `json:"max_size"`
+
+	// number of rotated files that are kept
+	MaxFiles int `json:"max_files"`
+}
+
+// RollupConfig configures the rollups of the traffic, which aggregate the hits, bytes and status classes of
+// every section by minute, hour and day
+type RollupConfig struct {
+	// directory in which the rollups are stored. Empty disables them
+	Path string `json:"path"`
+
+	// durations for which the minute, hourly and daily rollups are kept, 48h, 720h and 8760h by default.
+	// 0 keeps them forever
+	MinuteRetention Duration `json:"minute_retention"`
+	HourRetention   Duration `json:"hour_retention"`
+	DayRetention    Duration `json:"day_retention"`
+}
+
+// StatsDConfig configures a StatsD server to which the statistics of every refresh are sent
+type StatsDConfig struct {
+	// address and port of the StatsD server, such as "localhost:8125". Empty disables StatsD
+	Address string `json:"address"`
+
+	// prefix of the metric names
+	Prefix string `json:"prefix"`
+
+	// sends sections and status classes as DogStatsD tags instead of putting them in the metric names
+	DogStatsD bool `json:"dogstatsd"`
+
+	// DogStatsD tags added to all metrics, such as {"env": "production"}
+	Tags map[string]string `json:"tags"`
+
+	// maximum size of the UDP packets, in which several metrics are sent together
+	MaxPacketSize int `json:"max_packet_size"`
+}
+
+// OTLPConfig configures an OpenTelemetry collector to which the statistics of every refresh are exported as
+// metrics, and alert state changes as log records
+type OTLPConfig struct {
+	// URL of the collector, such as "http://localhost:4318" with HTTP/protobuf or "https://collector:4317"
+	// with gRPC, which requires TLS: plaintext gRPC endpoints are rejected. Empty disables the export
+	Endpoint string `json:"endpoint"`
+
+	// protocol used to export, "http/protobuf" by default or "grpc"
+	Protocol string `json:"protocol"`
+
+	// headers sent with every request, for example to authenticate
+	Headers map[string]string `json:"headers"`
+
+	// attributes added to the resource describing the agent, along with its host name and log file path
+	ResourceAttributes map[string]string `json:"resource_attributes"`
+
+	// skips the verification of the collector's TLS certificate
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// timeout of each request to the collector
+	Timeout Duration `json:"timeout"`
+
+	// maximum number of requests waiting to be sent, after which new ones are dropped
+	QueueSize int `json:"queue_size"`
+}
+
+// errOTLPPlaintextGRPC is returned when gRPC is configured with a plaintext endpoint: gRPC requires HTTP/2, which
+// the standard library only supports over TLS, so plaintext collectors must be reached with HTTP/protobuf
+var errOTLPPlaintextGRPC = fmt.Errorf("OTLP gRPC endpoint must use https, plaintext collectors such as http://localhost:4317 are not supported: use the %s protocol and its port 4318 instead", otlpHTTPProtobuf)
+
+// validate checks that the OTLP exporter can be created from the configuration
+func (oc OTLPConfig) validate() error {
+	if oc.Endpoint == "" {
+		return nil
+	}
+	switch oc.Protocol {
+	case otlpHTTPProtobuf:
+		return nil
+	case otlpGRPC:
+		if !strings.HasPrefix(oc.Endpoint, "https://") {
+			return errOTLPPlaintextGRPC
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown OTLP protocol %q: expected %s or %s", oc.Protocol, otlpHTTPProtobuf, otlpGRPC)
+	}
+}
+
+// validate checks that the heavy hitters track at least one key, and that the sketch has a usable error and
+// probability when it is enabled
+func (hc HeavyHittersConfig) validate() error {
+	if hc.Capacity < 1 {
+		return fmt.Errorf("heavy hitters capacity must be at least 1, got %d", hc.Capacity)
+	}
+	if hc.Epsilon < 0 || hc.Epsilon > 1 {
+		return fmt.Errorf("heavy hitters epsilon must be between 0 and 1, got %v", hc.Epsilon)
+	}
+	if hc.Epsilon > 0 && (hc.Delta <= 0 || hc.Delta >= 1) {
+		return fmt.Errorf("heavy hitters delta must be strictly between 0 and 1, got %v", hc.Delta)
+	}
+	return nil
+}
+
+// MaintenanceWindowConfig configures a recurring silence
+type MaintenanceWindowConfig struct {
+	// alerts matched by the maintenance window. Empty matchers match any alert
+	Matcher
+
+	// cron-like schedule at which the maintenance window starts, such as "0 2 * * 0" for every Sunday at 2am
+	Schedule string `json:"schedule"`
+
+	// duration of the maintenance window
+	Duration Duration `json:"duration"`
+}
+
+// Duration is a time.Duration that can be written as a string such as "10s" in configuration files
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration from either a string such as "1m30s" or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return json.Unmarshal(data, &d.Duration)
+	}
+
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+// MarshalJSON writes a duration as a string such as "1m30s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 // DefaultConfig generates a configuration structure with the default values
 func DefaultConfig() Config {
 	return Config{
-		LogLevel:         "DEBUG",
-		LogFilePath:      "logs",
-		TrafficThreshold: 1,
-		TopHitsNumber:    3,
-		RefreshPeriod:    10 * time.Second,
+		LogLevel:                 "DEBUG",
+		Diagnostics:              OutputConfig{Destination: "stderr", Format: "console"},
+		Report:                   OutputConfig{Destination: "stdout", Format: "console"},
+		LogFilePath:              "logs",
+		LogFormat:                "common",
+		TrafficThreshold:         1,
+		ServerErrorRateThreshold: 10,
+		ErrorRateMinRequests:     20,
+		Anomaly: AnomalyConfig{
+			Smoothing:   0.1,
+			Sensitivity: 3,
+			Warmup:      30,
+		},
+		NoDataTimeout:         Duration{5 * time.Minute},
+		StateSnapshotInterval: Duration{time.Minute},
+		MetricsMaxSections:    100,
+		TopHitsNumber:         3,
+		TopWindows:            []Duration{{lastRefreshWindow}, {5 * time.Minute}, {time.Hour}},
+		HeavyHitters: HeavyHittersConfig{
+			Capacity: defaultHeavyHittersCapacity,
+			Epsilon:  0.001,
+			Delta:    0.01,
+		},
+		Export: ExportConfig{
+			Format:   exportJSONLines,
+			MaxSize:  10 * 1024 * 1024,
+			MaxFiles: 5,
+		},
+		Rollups: RollupConfig{
+			MinuteRetention: Duration{48 * time.Hour},
+			HourRetention:   Duration{30 * 24 * time.Hour},
+			DayRetention:    Duration{365 * 24 * time.Hour},
+		},
+		StatsD: StatsDConfig{
+			Prefix:        "hk_agent.",
+			MaxPacketSize: 1432,
+		},
+		OTLP: OTLPConfig{
+			Protocol:  otlpHTTPProtobuf,
+			Timeout:   Duration{10 * time.Second},
+			QueueSize: 100,
+		},
+		RefreshPeriod: Duration{10 * time.Second},
+		Replay:        ReplayConfig{Speed: 1},
+	}
+}
+
+// unmarshalStrict decodes JSON like LoadConfig does, refusing the fields that don't exist, for the configurations
+// that read their own default values because they are part of a list
+func unmarshalStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// LoadConfig reads a JSON configuration file and overrides the default values with its content
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return config, err
 	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return config, err
+	}
+
+	err = config.OTLP.validate()
+	if err != nil {
+		return config, err
+	}
+
+	err = config.HeavyHitters.validate()
+	return config, err
 }
 
 // Print prints the current configuration
 func (c Config) Print(log *zerolog.Logger) {
 	log.Debug().
 		Str("log_level", c.LogLevel).
+		Str("diagnostics_destination", c.Diagnostics.Destination).
+		Str("diagnostics_format", c.Diagnostics.Format).
+		Str("report_destination", c.Report.Destination).
+		Str("report_format", c.Report.Format).
 		Str("log_file_path", c.LogFilePath).
-		Dur("refresh_period", c.RefreshPeriod).
+		Str("log_format", c.LogFormat).
+		Dur("refresh_period", c.RefreshPeriod.Duration).
+		Dur("allowed_lateness", c.AllowedLateness.Duration).
 		Uint64("traffic_threshold", c.TrafficThreshold).
+		Int("section_traffic_thresholds", len(c.SectionTrafficThresholds)).
+		Int("client_traffic_thresholds", len(c.ClientTrafficThresholds)).
+		Float64("server_error_rate_threshold", c.ServerErrorRateThreshold).
+		Float64("client_error_rate_threshold", c.ClientErrorRateThreshold).
+		Int("error_rate_min_requests", c.ErrorRateMinRequests).
+		Bool("anomaly_detection", c.Anomaly.Enabled).
+		Dur("no_data_timeout", c.NoDataTimeout.Duration).
+		Dur("alert_pending_period", c.AlertPendingPeriod.Duration).
+		Int("rule_severities", len(c.Severities)).
+		Int("renotify_intervals", len(c.RenotifyIntervals)).
+		Str("alert_history_path", c.AlertHistoryPath).
+		Int("webhooks", len(c.Webhooks)).
+		Int("emails", len(c.Emails)).
+		Int("commands", len(c.Commands)).
+		Int("silences", len(c.Silences)).
+		Str("silences_path", c.SilencesPath).
+		Str("state_path", c.StatePath).
+		Dur("state_snapshot_interval", c.StateSnapshotInterval.Duration).
+		Int("maintenance_windows", len(c.MaintenanceWindows)).
+		Str("api_address", c.APIAddress).
+		Str("export_path", c.Export.Path).
+		Str("rollups_path", c.Rollups.Path).
+		Str("statsd_address", c.StatsD.Address).
+		Str("otlp_endpoint", c.OTLP.Endpoint).
+		Str("metrics_address", c.MetricsAddress).
+		Str("web_ui_address", c.WebUIAddress).
+		Int("metrics_max_sections", c.MetricsMaxSections).
 		Int("top_hits_number", c.TopHitsNumber).
+		Int("top_windows", len(c.TopWindows)).
+		Dur("top_decay_half_life", c.TopDecayHalfLife.Duration).
+		Int("heavy_hitters_capacity", c.HeavyHitters.Capacity).
+		Bool("dashboard", c.Dashboard.Enabled).
+		Bool("replay", c.Replay.Enabled).
+		Float64("replay_speed", c.Replay.Speed).
+		Bool("replay_notify", c.Replay.Notify).
+		Bool("replay_record_history", c.Replay.RecordHistory).
+		Bool("replay_record_metrics", c.Replay.RecordMetrics).
 		Msg("Configuration")
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// This test ensures that the nested configurations keep their default values for the fields that are not set,
+// and that unknown fields are refused at any depth
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	load := func(content string) (Config, error) {
+		path := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("could not write configuration: %v", err)
+		}
+		return LoadConfig(path)
+	}
+
+	config, err := load(`{"statsd": {"address": "localhost:8125"}, "webhooks": [{"url": "http://localhost"}], "replay": {"enabled": true}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.StatsD.Prefix != "hk_agent." || config.StatsD.MaxPacketSize != 1432 {
+		t.Errorf("expected the StatsD defaults to be kept, got %+v", config.StatsD)
+	}
+	if len(config.Webhooks) != 1 || config.Webhooks[0].Method != "POST" || config.Webhooks[0].Timeout.Duration != 10*time.Second {
+		t.Errorf("expected the webhook defaults to be used, got %+v", config.Webhooks)
+	}
+	if !config.Replay.Enabled || config.Replay.Speed != 1 {
+		t.Errorf("expected the replay defaults to be kept, got %+v", config.Replay)
+	}
+
+	for _, content := range []string{
+		`{"statsd": {"adress": "localhost:8125"}}`,
+		`{"otlp": {"endpoint": "http://localhost:4318", "protocl": "grpc"}}`,
+		`{"rollups": {"path": "rollups", "retention": "1h"}}`,
+		`{"webhooks": [{"url": "http://localhost", "metod": "PUT"}]}`,
+		`{"emails": [{"host": "localhost", "too": ["ops@example.com"]}]}`,
+		`{"commands": [{"command": "true", "timout": "1s"}]}`,
+	} {
+		if _, err := load(content); err == nil {
+			t.Errorf("expected an error for the unknown field of %s", content)
+		}
+	}
+}
+
+// This test ensures that heavy hitters configurations which would track nothing or allocate an unusable sketch
+// are refused
+func TestLoadConfigHeavyHitters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	for content, valid := range map[string]bool{
+		`{"heavy_hitters": {"capacity": 10}}`:                   true,
+		`{"heavy_hitters": {"epsilon": 0}}`:                     true,
+		`{"heavy_hitters": {"epsilon": 1, "delta": 0.5}}`:       true,
+		`{"heavy_hitters": {"capacity": 0}}`:                    false,
+		`{"heavy_hitters": {"capacity": -1}}`:                   false,
+		`{"heavy_hitters": {"epsilon": -0.1}}`:                  false,
+		`{"heavy_hitters": {"epsilon": 1.5}}`:                   false,
+		`{"heavy_hitters": {"delta": 0}}`:                       false,
+		`{"heavy_hitters": {"delta": 1}}`:                       false,
+		`{"heavy_hitters": {"epsilon": 0.001, "delta": -0.01}}`: false,
+		`{"heavy_hitters": {"epsilon": 0, "delta": 0}}`:         true,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("could not write configuration: %v", err)
+		}
+		_, err := LoadConfig(path)
+		if valid && err != nil {
+			t.Errorf("unexpected error for %s: %v", content, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("expected an error for %s", content)
+		}
+	}
+}
+
+// This test ensures that the agent does not write files into its working directory unless it is configured to
+func TestDefaultConfigPaths(t *testing.T) {
+	config := DefaultConfig()
+	if config.StatePath != "" || config.AlertHistoryPath != "" || config.SilencesPath != "" {
+		t.Errorf("expected the state, alert history and silences files to be disabled by default, got %q, %q and %q",
+			config.StatePath, config.AlertHistoryPath, config.SilencesPath)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ANSI escape sequences used by the dashboard
+const (
+	ansiAltScreen   = "\x1b[?1049h"
+	ansiMainScreen  = "\x1b[?1049l"
+	ansiHideCursor  = "\x1b[?25l"
+	ansiShowCursor  = "\x1b[?25h"
+	ansiClearScreen = "\x1b[H\x1b[2J"
+	ansiReset       = "\x1b[0m"
+	ansiBold        = "\x1b[1m"
+	ansiDim         = "\x1b[2m"
+	ansiRed         = "\x1b[31m"
+	ansiGreen       = "\x1b[32m"
+	ansiYellow      = "\x1b[33m"
+	ansiCyan        = "\x1b[36m"
+)
+
+// sparklineRunes are the characters of sparklines, from the lowest to the highest value
+var sparklineRunes = []rune("▁▂▃▄▅▆▇█")
+
+// dashboardAlerts is the number of past alerts kept in the alert pane
+const dashboardAlerts = 100
+
+// allSections is used to retrieve all sections from the log processor, which are then filtered by the dashboard
+const allSections = 1 << 30
+
+// trafficPoint is the traffic received at a refresh
+type trafficPoint struct {
+	time  time.Time
+	hits  int
+	bytes uint64
+}
+
+// dashboardSnapshot is the state of the log processor displayed by the dashboard
+type dashboardSnapshot struct {
+	stats    WindowStats
+	sections []SectionStats
+	statuses StatusBreakdown
+	points   []trafficPoint
+	alerts   []Alert
+	active   []Alert
+}
+
+// dashboard is a full-screen terminal dashboard, which displays the top sections, sparklines of the traffic
+// over the last 2 minutes, the status codes and the past alerts, refreshed at every refresh of the log
+// processor. It receives the statistics of every refresh as a metrics sink and alerts as a notifier
+type dashboard struct {
+	out       io.Writer
+	processor *LogProcessor
+	source    string
+	refresh   time.Duration
+
+	mu sync.Mutex
+	// display settings, changed with the keyboard
+	topN    int
+	filter  string
+	editing bool
+	input   string
+	paused  bool
+	// traffic of the last refreshes and past alerts
+	points []trafficPoint
+	alerts []Alert
+	// last state of the log processor that was displayed, which is kept while the dashboard is paused
+	snapshot dashboardSnapshot
+	// size of the terminal
+	width  int
+	height int
+
+	redraw chan struct{}
+	quit   chan struct{}
+}
+
+func newDashboard(out io.Writer, config Config) *dashboard {
+	return &dashboard{
+		out:     out,
+		source:  config.LogFilePath,
+		refresh: config.RefreshPeriod.Duration,
+		topN:    config.TopHitsNumber,
+		width:   80,
+		height:  24,
+		redraw:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Flush records the traffic of a refresh and schedules a redraw
+func (d *dashboard) Flush(stats RefreshStats) error {
+	d.mu.Lock()
+	d.points = append(d.points, trafficPoint{time: stats.Time, hits: stats.Hits, bytes: stats.Bytes})
+
+	// only keep the points of the last 2 minutes
+	for len(d.points) > 0 && stats.Time.Sub(d.points[0].time) >= 2*time.Minute {
+		d.points = d.points[1:]
+	}
+	d.mu.Unlock()
+
+	d.scheduleRedraw()
+	return nil
+}
+
+// Notify adds an alert to the alert pane
+func (d *dashboard) Notify(alert Alert) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.alerts = append(d.alerts, alert)
+	if len(d.alerts) > dashboardAlerts {
+		d.alerts = d.alerts[len(d.alerts)-dashboardAlerts:]
+	}
+	return nil
+}
+
+func (d *dashboard) scheduleRedraw() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// Done is closed when the user quits the dashboard
+func (d *dashboard) Done() <-chan struct{} {
+	return d.quit
+}
+
+// Run sets up the terminal, then draws the dashboard at every refresh and handles the keys read from the
+// input until the user quits. The terminal is restored by Close
+func (d *dashboard) Run(in *os.File) {
+	setTerminalMode(in, "cbreak", "-echo")
+	if height, width, ok := terminalSize(in); ok {
+		d.height, d.width = height, width
+	}
+	fmt.Fprint(d.out, ansiAltScreen+ansiHideCursor)
+
+	keys := make(chan byte)
+	go func() {
+		reader := bufio.NewReader(in)
+		for {
+			key, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			keys <- key
+		}
+	}()
+
+	d.draw()
+	for {
+		select {
+		case key := <-keys:
+			if !d.HandleKey(key) {
+				close(d.quit)
+				return
+			}
+		case <-d.redraw:
+			if height, width, ok := terminalSize(in); ok {
+				d.mu.Lock()
+				d.height, d.width = height, width
+				d.mu.Unlock()
+			}
+		}
+		d.draw()
+	}
+}
+
+// Close restores the terminal
+func (d *dashboard) Close(in *os.File) {
+	fmt.Fprint(d.out, ansiShowCursor+ansiMainScreen)
+	setTerminalMode(in, "-cbreak", "echo")
+}
+
+// HandleKey changes the display settings according to a key, and returns false when the user quits:
+// "q" quits, "p" pauses, "+" and "-" change the number of top sections, and "/" starts typing a section
+// filter, which is applied with enter and cleared with escape
+func (d *dashboard) HandleKey(key byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.editing {
+		switch key {
+		case '\r', '\n':
+			d.filter = d.input
+			d.editing = false
+		case 0x1b:
+			d.filter = ""
+			d.editing = false
+		case 0x7f, '\b':
+			if len(d.input) > 0 {
+				d.input = d.input[:len(d.input)-1]
+			}
+		default:
+			if key >= ' ' && key < 0x7f {
+				d.input += string(key)
+			}
+		}
+		return true
+	}
+
+	switch key {
+	case 'q', 'Q':
+		return false
+	case 'p', 'P', ' ':
+		d.paused = !d.paused
+	case '+', '=':
+		d.topN++
+	case '-', '_':
+		if d.topN > 1 {
+			d.topN--
+		}
+	case '/':
+		d.editing = true
+		d.input = d.filter
+	case 0x1b:
+		d.filter = ""
+	}
+	return true
+}
+
+// draw takes a snapshot of the log processor unless the dashboard is paused, and draws the dashboard
+func (d *dashboard) draw() {
+	var snapshot dashboardSnapshot
+	if d.processor != nil {
+		snapshot = dashboardSnapshot{
+			stats:    d.processor.WindowStats(),
+			sections: d.processor.TopSections(allSections),
+			statuses: d.processor.StatusBreakdown(),
+			active:   d.processor.ActiveAlerts(),
+		}
+	}
+
+	d.mu.Lock()
+	if !d.paused {
+		snapshot.points = append([]trafficPoint(nil), d.points...)
+		snapshot.alerts = append([]Alert(nil), d.alerts...)
+		d.snapshot = snapshot
+	}
+	frame := d.render(d.snapshot)
+	d.mu.Unlock()
+
+	fmt.Fprint(d.out, ansiClearScreen+frame)
+}
+
+// render renders a snapshot into a frame that fits the terminal
+func (d *dashboard) render(snapshot dashboardSnapshot) string {
+	frame := &dashboardFrame{width: d.width}
+
+	// header
+	header := fmt.Sprintf("hk-agent  %s  %s  refresh %s", d.source, snapshot.stats.Time.Format("15:04:05"), d.refresh)
+	if d.paused {
+		header += "  [PAUSED]"
+	}
+	if d.filter != "" {
+		header += "  filter: " + d.filter
+	}
+	frame.line(ansiBold, header)
+	frame.rule()
+
+	// traffic over the alert window
+	frame.line("", fmt.Sprintf("Last 2 minutes: %d hits, %s, %d sections, %d active alerts",
+		snapshot.stats.Entries, formatBytes(snapshot.stats.Bytes), snapshot.stats.Sections, len(snapshot.active)))
+	hits := make([]float64, len(snapshot.points))
+	bandwidth := make([]float64, len(snapshot.points))
+	for i, point := range snapshot.points {
+		hits[i] = float64(point.hits) / d.refresh.Seconds()
+		bandwidth[i] = float64(point.bytes) / d.refresh.Seconds()
+	}
+	frame.line(ansiCyan, fmt.Sprintf("Requests   %s %.1f/s", sparkline(hits), last(hits)))
+	frame.line(ansiCyan, fmt.Sprintf("Bandwidth  %s %s/s", sparkline(bandwidth), formatBytes(uint64(last(bandwidth)))))
+	frame.rule()
+
+	// status codes
+	total := snapshot.statuses.Total.total()
+	barWidth := d.width - 24
+	if barWidth < 10 {
+		barWidth = 10
+	}
+	for class := 1; class < len(snapshot.statuses.Total); class++ {
+		count := snapshot.statuses.Total[class]
+		ratio := 0.0
+		if total > 0 {
+			ratio = float64(count) / float64(total)
+		}
+		color := ansiGreen
+		if class == 4 {
+			color = ansiYellow
+		} else if class == 5 {
+			color = ansiRed
+		}
+		frame.line(color, fmt.Sprintf("%s %-*s %6d %5.1f%%", statusClasses[class], barWidth, strings.Repeat("█", int(ratio*float64(barWidth)+0.5)), count, 100*ratio))
+	}
+	frame.rule()
+
+	// top sections
+	var sections []SectionStats
+	for _, section := range snapshot.sections {
+		if d.filter == "" || strings.Contains(section.Section, d.filter) {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) > d.topN {
+		sections = sections[:d.topN]
+	}
+	frame.line(ansiBold, fmt.Sprintf("%-3s %-24s %8s %10s %6s %6s %6s %6s", "#", "SECTION", "HITS", "BYTES", "2xx", "3xx", "4xx", "5xx"))
+	for i, section := range sections {
+		statuses := snapshot.statuses.Sections[section.Section]
+		frame.line("", fmt.Sprintf("%-3d %-24s %8d %10s %6d %6d %6d %6d",
+			i+1, section.Section, section.Hits, formatBytes(section.Bytes), statuses[2], statuses[3], statuses[4], statuses[5]))
+	}
+	frame.rule()
+
+	// footer, which is rendered now to know how many lines are left for the alerts
+	footer := "q quit  p pause  +/- top sections  / filter  esc clear filter"
+	if d.editing {
+		footer = "filter: " + d.input + "_"
+	}
+
+	// past alerts, most recent first, in the remaining lines
+	frame.line(ansiBold, "Alerts")
+	available := d.height - len(frame.lines) - 2
+	if len(snapshot.alerts) == 0 && available > 0 {
+		frame.line(ansiDim, "no alerts")
+	}
+	for i := len(snapshot.alerts) - 1; i >= 0 && available > 0; i, available = i-1, available-1 {
+		alert := snapshot.alerts[i]
+		color := ansiYellow
+		switch alert.State {
+		case AlertFiring:
+			color = ansiRed
+		case AlertResolved:
+			color = ansiGreen
+		}
+		frame.line(color, alert.Time.Format("15:04:05")+" "+alert.Summary())
+	}
+
+	frame.rule()
+	frame.line(ansiDim, footer)
+	return frame.String()
+}
+
+// dashboardFrame builds the lines of a frame, truncated to the width of the terminal
+type dashboardFrame struct {
+	width int
+	lines []string
+}
+
+func (f *dashboardFrame) line(color, text string) {
+	if utf8.RuneCountInString(text) > f.width {
+		text = string([]rune(text)[:f.width])
+	}
+	if color != "" {
+		text = color + text + ansiReset
+	}
+	f.lines = append(f.lines, text)
+}
+
+func (f *dashboardFrame) rule() {
+	f.line(ansiDim, strings.Repeat("─", f.width))
+}
+
+func (f *dashboardFrame) String() string {
+	return strings.Join(f.lines, "\r\n")
+}
+
+// sparkline draws values as a line of bars, scaled to the highest value
+func sparkline(values []float64) string {
+	max := 0.0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+
+	line := make([]rune, len(values))
+	for i, value := range values {
+		level := 0
+		if max > 0 {
+			level = int(value / max * float64(len(sparklineRunes)-1))
+		}
+		line[i] = sparklineRunes[level]
+	}
+	return string(line)
+}
+
+func last(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return values[len(values)-1]
+}
+
+// formatBytes formats a number of bytes with a binary unit, such as "1.5MB"
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes)
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1fPB", value/unit)
+}
+
+// redirect redirects an output written to the terminal to the log file of the dashboard, or discards it
+func (dc DashboardConfig) redirect(output OutputConfig) OutputConfig {
+	switch output.Destination {
+	case "", "stdout", "stderr":
+		output.Destination = dc.LogFilePath
+		if output.Destination == "" {
+			output.Destination = "discard"
+		}
+	}
+	return output
+}
+
+// setTerminalMode changes the mode of the terminal with stty, for example to read keys as they are typed
+func setTerminalMode(terminal *os.File, args ...string) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = terminal
+	cmd.Run()
+}
+
+// terminalSize returns the number of rows and columns of the terminal
+func terminalSize(terminal *os.File) (int, int, bool) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = terminal
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	fields := strings.Fields(string(bytes.TrimSpace(output)))
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	rows, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	cols, err := strconv.Atoi(fields[1])
+	if err != nil || rows == 0 || cols == 0 {
+		return 0, 0, false
+	}
+	return rows, cols, true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		values   []float64
+		expected string
+	}{
+		{nil, ""},
+		{[]float64{0, 0, 0}, "▁▁▁"},
+		{[]float64{1, 2, 4, 8}, "▁▂▄█"},
+		{[]float64{5, 5}, "██"},
+	}
+
+	for _, test := range tests {
+		if line := sparkline(test.values); line != test.expected {
+			t.Errorf("expected sparkline of %v to be %q, got %q", test.values, test.expected, line)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes    uint64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1536, "1.5KB"},
+		{5 * 1024 * 1024, "5.0MB"},
+		{3 * 1024 * 1024 * 1024, "3.0GB"},
+	}
+
+	for _, test := range tests {
+		if formatted := formatBytes(test.bytes); formatted != test.expected {
+			t.Errorf("expected %d bytes to be formatted as %q, got %q", test.bytes, test.expected, formatted)
+		}
+	}
+}
+
+// This test ensures that the dashboard displays the traffic, statuses, top sections and alerts of the log
+// processor, and that the keyboard controls change what it displays
+func TestDashboard(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 1
+	config.TopHitsNumber = 2
+
+	out := &bytes.Buffer{}
+	board := newDashboard(out, config)
+	board.width, board.height = 100, 40
+
+	lp := NewLogProcessor(log, log, config, nil, []Notifier{board}, []MetricsSink{board}, nil, func() time.Time { return now })
+	board.processor = lp
+
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 1024, Time: baseTime},
+		{Section: "/static", Status: 304, Size: 10, Time: baseTime},
+	})
+	now = now.Add(10 * time.Second)
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 2 * 1024 * 1024, Time: now},
+		{Section: "/api", Status: 500, Size: 100, Time: now},
+		{Section: "/user", Status: 404, Size: 10, Time: now},
+	})
+
+	// a refresh schedules a redraw
+	select {
+	case <-board.redraw:
+	default:
+		t.Error("expected a redraw to be scheduled")
+	}
+
+	frame := func() string {
+		out.Reset()
+		board.draw()
+		return out.String()
+	}
+
+	screen := frame()
+	for _, expected := range []string{
+		"Last 2 minutes: 5 hits, 2.0MB, 3 sections, 1 active alerts",
+		"Requests   ▅█ 0.3/s",
+		"Bandwidth  ▁█ 204.8KB/s",
+		"/api                            3",
+		"/static                         1",
+		"FIRING",
+		"Total traffic",
+	} {
+		if !strings.Contains(screen, expected) {
+			t.Errorf("expected dashboard to contain %q, got:\n%s", expected, screen)
+		}
+	}
+	if strings.Contains(screen, "/user") {
+		t.Errorf("expected dashboard to only display the top 2 sections, got:\n%s", screen)
+	}
+
+	// display more sections
+	board.HandleKey('+')
+	if screen = frame(); !strings.Contains(screen, "/user") {
+		t.Errorf("expected dashboard to display the top 3 sections, got:\n%s", screen)
+	}
+
+	// filter the sections
+	for _, key := range []byte("//sta\r") {
+		board.HandleKey(key)
+	}
+	screen = frame()
+	if !strings.Contains(screen, "filter: /sta") || strings.Contains(screen, "/api  ") || !strings.Contains(screen, "/static") {
+		t.Errorf("expected dashboard to only display sections matching the filter, got:\n%s", screen)
+	}
+	board.HandleKey(0x1b)
+	if screen = frame(); !strings.Contains(screen, "/api  ") {
+		t.Errorf("expected the filter to be cleared, got:\n%s", screen)
+	}
+
+	// the display is frozen while the dashboard is paused
+	board.HandleKey('p')
+	now = now.Add(10 * time.Second)
+	lp.Add([]*HTTPEntry{{Section: "/new", Status: 200, Size: 10, Time: now}})
+	screen = frame()
+	if !strings.Contains(screen, "[PAUSED]") || strings.Contains(screen, "/new") {
+		t.Errorf("expected dashboard to be paused, got:\n%s", screen)
+	}
+	board.HandleKey('p')
+	if screen = frame(); !strings.Contains(screen, "/new") {
+		t.Errorf("expected dashboard to be resumed, got:\n%s", screen)
+	}
+
+	// lines never exceed the width of the terminal
+	board.width = 20
+	for _, line := range strings.Split(frame(), "\r\n") {
+		line = strings.TrimPrefix(line, ansiClearScreen)
+		for _, code := range []string{ansiReset, ansiBold, ansiDim, ansiRed, ansiGreen, ansiYellow, ansiCyan} {
+			line = strings.Replace(line, code, "", -1)
+		}
+		if length := len([]rune(line)); length > 20 {
+			t.Errorf("expected line %q to be truncated to 20 characters, got %d", line, length)
+		}
+	}
+
+	if !board.HandleKey('x') || board.HandleKey('q') {
+		t.Error("expected only q to quit the dashboard")
+	}
+}
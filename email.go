@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// emailBody is the template of the body of alert emails, which is executed with a list of alerts
+var emailBody = template.Must(template.New("email").Funcs(template.FuncMap{
+	"time": formatHistoryTime,
+	"inc":  func(i int) int { return i + 1 },
+}).Parse(`{{ range . }}{{ .Summary }}
+
+    Rule:       {{ .Rule }}
+    Severity:   {{ .Severity }}
+    Subject:    {{ .Subject }}{{ if .Name }} {{ .Name }}{{ end }}
+    Window:     {{ .Window }}
+    Value:      {{ .Value }}
+    Threshold:  {{ .Threshold }}
+    Peak:       {{ .Peak }}
+    Started at: {{ time .StartsAt }}
+    Ended at:   {{ time .EndsAt }}
+{{ if .TopSections }}
+    Top sections:
+{{ range $idx, $section := .TopSections }}      #{{ inc $idx }} {{ $section.Section }}: {{ $section.Hits }} hits, {{ $section.Bytes }} bytes
+{{ end }}{{ end }}
+{{ end }}`))
+
+// emailNotifier sends alerts by email when they start firing and when they are resolved. Alerts are sent
+// asynchronously, and when they change state more often than the digest interval, they are batched into a
+// single digest email so that a flapping rule does not flood the recipients
+type emailNotifier struct {
+	log    *zerolog.Logger
+	config EmailConfig
+
+	queue    chan Alert
+	done     sync.WaitGroup
+	lastSent time.Time
+	// send sends an email to the recipients, which can be replaced for testing
+	send func(subject, body string) error
+}
+
+// newEmailNotifier creates an email notifier and starts sending its queued alerts
+func newEmailNotifier(log *zerolog.Logger, config EmailConfig) (*emailNotifier, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("email notifier has no SMTP host")
+	}
+	if config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email notifier needs a sender and at least one recipient")
+	}
+
+	e := &emailNotifier{
+		log:    log,
+		config: config,
+		queue:  make(chan Alert, config.QueueSize),
+	}
+	e.send = e.sendSMTP
+
+	e.done.Add(1)
+	go e.run()
+
+	return e, nil
+}
+
+// Notify queues an alert that started firing or was resolved to be sent by email
+func (e *emailNotifier) Notify(alert Alert) error {
+	if alert.State != AlertFiring && alert.State != AlertResolved {
+		return nil
+	}
+
+	select {
+	case e.queue <- alert:
+		return nil
+	default:
+		return errNotificationQueueFull
+	}
+}
+
+// Close stops accepting alerts and waits for the queued ones to be sent. The digest being batched is sent
+// right away rather than at the end of the digest interval, so that it is not lost when the agent stops
+func (e *emailNotifier) Close() error {
+	close(e.queue)
+	e.done.Wait()
+	return nil
+}
+
+func (e *emailNotifier) run() {
+	defer e.done.Done()
+
+	var pending []Alert
+	var flush <-chan time.Time
+	for {
+		select {
+		case alert, ok := <-e.queue:
+			if !ok {
+				// the notifier is closed, so the pending digest can't wait for the end of the interval
+				if len(pending) > 0 {
+					e.deliver(pending)
+				}
+				return
+			}
+
+			pending = append(pending, alert)
+			if flush != nil {
+				// a digest is already scheduled
+				continue
+			}
+
+			wait := e.config.DigestInterval.Duration - time.Since(e.lastSent)
+			if wait <= 0 {
+				e.deliver(pending)
+				pending = nil
+				continue
+			}
+			flush = time.After(wait)
+		case <-flush:
+			e.deliver(pending)
+			pending = nil
+			flush = nil
+		}
+	}
+}
+
+// deliver sends a single alert or a digest of alerts by email
+func (e *emailNotifier) deliver(alerts []Alert) {
+	e.lastSent = time.Now()
+
+	subject := alerts[0].Summary()
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("%d alert changes", len(alerts))
+	}
+	if e.config.SubjectPrefix != "" {
+		subject = e.config.SubjectPrefix + " " + subject
+	}
+
+	body := &bytes.Buffer{}
+	err := emailBody.Execute(body, alerts)
+	if err == nil {
+		err = e.send(subject, body.String())
+	}
+	if err != nil {
+		e.log.Error().Err(err).Str("smtp_host", e.config.Host).Int("alerts", len(alerts)).Msg("Could not send alert email")
+		return
+	}
+
+	e.log.Debug().Str("smtp_host", e.config.Host).Int("alerts", len(alerts)).Msg("Alert email sent")
+}
+
+// sendSMTP sends an email to the recipients through the configured SMTP server, upgrading the connection
+// with STARTTLS when it is supported and authenticating when credentials are configured
+func (e *emailNotifier) sendSMTP(subject, body string) error {
+	address := net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port))
+	conn, err := net.DialTimeout("tcp", address, e.config.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+
+	// the timeout also bounds the whole SMTP exchange, so that a server which stops answering does not block
+	// the notifications
+	if e.config.Timeout.Duration > 0 {
+		err = conn.SetDeadline(time.Now().Add(e.config.Timeout.Duration))
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	client, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !e.config.DisableStartTLS {
+		err = client.StartTLS(&tls.Config{ServerName: e.config.Host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(e.config.From)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range e.config.To {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(message, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	_, err = writer.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sentEmail struct {
+	subject string
+	body    string
+}
+
+func TestEmailNotifierDigest(t *testing.T) {
+	var mu sync.Mutex
+	var sent []sentEmail
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	e := &emailNotifier{
+		log: log,
+		config: EmailConfig{
+			Host:           "localhost",
+			SubjectPrefix:  "[hk-agent]",
+			DigestInterval: Duration{100 * time.Millisecond},
+		},
+		queue: make(chan Alert, 10),
+		send: func(subject, body string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, sentEmail{subject: subject, body: body})
+			return nil
+		},
+	}
+	e.done.Add(1)
+	go e.run()
+
+	baseTime := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+	firing := Alert{
+		Time:        baseTime,
+		State:       AlertFiring,
+		Rule:        trafficRule,
+		Subject:     sectionSubject,
+		Name:        "/api",
+		Value:       3,
+		Peak:        3,
+		Threshold:   2,
+		StartsAt:    baseTime,
+		Window:      Duration{2 * time.Minute},
+		TopSections: []SectionStats{{Section: "/api", Hits: 42, Bytes: 3145728}},
+	}
+	resolved := firing
+	resolved.State = AlertResolved
+	resolved.Value = 0
+	resolved.EndsAt = baseTime.Add(time.Minute)
+
+	// pending alerts are not sent
+	e.Notify(Alert{State: AlertPending, Rule: trafficRule, Subject: totalSubject})
+	// the first alert is sent right away
+	e.Notify(firing)
+	time.Sleep(20 * time.Millisecond)
+	// a flapping alert is batched into a digest
+	for i := 0; i < 5; i++ {
+		e.Notify(resolved)
+		e.Notify(firing)
+	}
+	e.Close()
+
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 emails to be sent, got %d", len(sent))
+	}
+
+	if sent[0].subject != "[hk-agent] [FIRING] Section /api traffic: 3 (threshold 2, peak 3)" {
+		t.Errorf("unexpected subject for first email: %s", sent[0].subject)
+	}
+	expectedLines := []string{
+		"Rule:       traffic",
+		"Subject:    section /api",
+		"Window:     2m0s",
+		"Value:      3",
+		"Threshold:  2",
+		"Started at: 2018-05-08T08:00:00Z",
+		"Ended at:   -",
+		"#1 /api: 42 hits, 3145728 bytes",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(sent[0].body, line) {
+			t.Errorf("expected email body to contain %q, got:\n%s", line, sent[0].body)
+		}
+	}
+
+	if sent[1].subject != "[hk-agent] 10 alert changes" {
+		t.Errorf("unexpected subject for digest email: %s", sent[1].subject)
+	}
+	if strings.Count(sent[1].body, "[RESOLVED]") != 5 || strings.Count(sent[1].body, "[FIRING]") != 5 {
+		t.Errorf("expected digest to contain all alert changes, got:\n%s", sent[1].body)
+	}
+}
+
+// This test ensures that the digest being batched is sent when the notifier is closed, without waiting for the
+// end of the digest interval
+func TestEmailNotifierFlushesDigestOnClose(t *testing.T) {
+	var mu sync.Mutex
+	var sent []sentEmail
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	config := EmailConfig{Host: "localhost", From: "agent@example.com", To: []string{"ops@example.com"}, DigestInterval: Duration{time.Hour}, QueueSize: 10}
+	e, err := newEmailNotifier(log, config)
+	if err != nil {
+		t.Fatalf("could not create email notifier: %v", err)
+	}
+	e.send = func(subject, body string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, sentEmail{subject: subject, body: body})
+		return nil
+	}
+
+	firing := Alert{State: AlertFiring, Severity: SeverityWarning, Rule: trafficRule, Subject: totalSubject, Value: 3, Threshold: 2, Peak: 3}
+	resolved := firing
+	resolved.State = AlertResolved
+	resolved.NotifiedSeverities = []Severity{SeverityWarning}
+
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil, []Notifier{routeSeverities(e, []Severity{SeverityWarning})}, nil, nil, time.Now)
+	for _, alert := range []Alert{firing, resolved, firing} {
+		lp.notify(alert)
+	}
+	lp.Close(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || sent[1].subject != "2 alert changes" {
+		t.Fatalf("expected the first alert and a digest of the next 2 to be sent, got %+v", sent)
+	}
+}
+
+// fakeSMTPServer accepts a single SMTP session and records the commands and the data it received
+func fakeSMTPServer(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		session := &bytes.Buffer{}
+		reader := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		reply("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			session.WriteString(line)
+
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				reply("250 OK")
+			case inData:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(line, "AUTH"):
+				reply("235 Authentication successful")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 Go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 Bye")
+				received <- session.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+		received <- session.String()
+	}()
+
+	return listener, received
+}
+
+func TestEmailNotifierSMTP(t *testing.T) {
+	listener, received := fakeSMTPServer(t)
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	e := &emailNotifier{
+		log: log,
+		config: EmailConfig{
+			Host:     "127.0.0.1",
+			Port:     portNumber,
+			Username: "agent",
+			Password: "secret",
+			From:     "agent@example.com",
+			To:       []string{"oncall@example.com", "ops@example.com"},
+			Timeout:  Duration{time.Second},
+		},
+	}
+
+	err := e.sendSMTP("[hk-agent] test", "Alert body\n")
+	if err != nil {
+		t.Fatalf("unexpected error when sending email: %v", err)
+	}
+
+	session := <-received
+	expected := []string{
+		"AUTH PLAIN",
+		"MAIL FROM:<agent@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"To: oncall@example.com, ops@example.com\r\n",
+		"Subject: [hk-agent] test\r\n",
+		"Alert body\r\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(session, line) {
+			t.Errorf("expected SMTP session to contain %q, got:\n%s", line, session)
+		}
+	}
+}
+
+// This test ensures that sending an email fails once the timeout elapses when the SMTP server accepts the
+// connection but never answers
+func TestEmailNotifierSMTPTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never send the greeting
+		bufio.NewReader(conn).ReadString('\n')
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	e := &emailNotifier{
+		log: NewZeroLog(bytes.NewBuffer([]byte{}), JSON),
+		config: EmailConfig{
+			Host:    "127.0.0.1",
+			Port:    portNumber,
+			From:    "agent@example.com",
+			To:      []string{"oncall@example.com"},
+			Timeout: Duration{100 * time.Millisecond},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- e.sendSMTP("[hk-agent] test", "Alert body\n")
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error when the SMTP server does not answer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected sending the email to time out")
+	}
+}
+
+func TestNewEmailNotifierErrors(t *testing.T) {
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+
+	if _, err := newEmailNotifier(log, EmailConfig{From: "agent@example.com", To: []string{"ops@example.com"}}); err == nil {
+		t.Error("expected an error when the SMTP host is missing")
+	}
+	if _, err := newEmailNotifier(log, EmailConfig{Host: "localhost", From: "agent@example.com"}); err == nil {
+		t.Error("expected an error when there are no recipients")
+	}
+}
@@ -11,6 +11,18 @@ import (
 	"github.com/ullaakut/gonx"
 )
 
+// commonLogFormat is the format of the lines of HTTP log files (Common Log Format)
+const commonLogFormat = `$client_address $identifier $user_id [$time] "$request" $status $size`
+
+// combinedLogFormat is the Common Log Format followed by the referer and the user agent (Combined Log Format)
+const combinedLogFormat = commonLogFormat + ` "$http_referer" "$http_user_agent"`
+
+// logFormats are the formats of the log files that can be configured, by name
+var logFormats = map[string]string{
+	"common":   commonLogFormat,
+	"combined": combinedLogFormat,
+}
+
 // HTTPEntry represents an entry in an HTTP log file
 type HTTPEntry struct {
 	ClientAddress string `json:"client_address"`
@@ -20,8 +32,11 @@ type HTTPEntry struct {
 	TimeStr       string `json:"time"`
 	StatusStr     string `json:"status"`
 	SizeStr       string `json:"size"`
+	Referer       string `json:"http_referer"`
+	UserAgent     string `json:"http_user_agent"`
 
 	Section string
+	Path    string
 	Status  uint64
 	Size    uint64
 	Time    time.Time
@@ -49,6 +64,7 @@ func (h *HTTPEntry) parseStrings(log *zerolog.Logger) {
 	if err != nil {
 		log.Warn().Err(err).Msg("could not parse section")
 	}
+	h.Path = parsePath(h.Request)
 }
 
 // NewHTTPEntry instanciates a new HTTPEntry from a gonx.Entry
@@ -66,7 +82,7 @@ func NewHTTPEntry(log *zerolog.Logger, entry *gonx.Entry) *HTTPEntry {
 
 	httpEntry.parseStrings(log)
 
-	log.Info().
+	log.Debug().
 		Str("client_address", httpEntry.ClientAddress).
 		Str("identifier", httpEntry.Identifier).
 		Str("user_id", httpEntry.UserID).
@@ -105,3 +121,18 @@ func parseSection(log *zerolog.Logger, request string) (string, error) {
 	// otherwise, return only the section
 	return request[sectionPos : subsectionPos+sectionPos], nil
 }
+
+// parsePath returns the path of a request without its query string, such as "/api/user" for
+// "GET /api/user?id=1 HTTP/1.1"
+func parsePath(request string) string {
+	fields := strings.Fields(request)
+	if len(fields) < 2 {
+		return request
+	}
+
+	path := fields[1]
+	if pos := strings.IndexAny(path, "?#"); pos != -1 {
+		path = path[:pos]
+	}
+	return path
+}
@@ -148,3 +148,21 @@ func TestNewHTTPEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestCombinedLogFormat(t *testing.T) {
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	parser := gonx.NewParser(logFormats["combined"])
+
+	entry, err := parser.ParseString(`10.0.0.1 - - [08/May/2017:08:08:19 +0000] "GET /api/user?id=1 HTTP/1.1" 200 512 "https://example.com/" "curl/7.58.0"`)
+	if err != nil {
+		t.Fatalf("gonx external library failed to parse test log: %v", err)
+	}
+
+	result := NewHTTPEntry(log, entry)
+	if result.Section != "/api" || result.Path != "/api/user" {
+		t.Errorf("expected section /api and path /api/user, got %s and %s", result.Section, result.Path)
+	}
+	if result.Referer != "https://example.com/" || result.UserAgent != "curl/7.58.0" {
+		t.Errorf("expected the referer and the user agent to be parsed, got %q and %q", result.Referer, result.UserAgent)
+	}
+}
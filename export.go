@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formats of the report export
+const (
+	exportJSONLines = "jsonl"
+	exportCSV       = "csv"
+)
+
+// exportCSVHeader contains the columns of the CSV report export
+var exportCSVHeader = []string{
+	"time", "hits", "bytes", "total_entries", "window_hits", "window_bytes",
+	"1xx", "2xx", "3xx", "4xx", "5xx",
+	"top_sections", "pending_alerts", "firing_alerts", "alerts",
+}
+
+// exportRecord is the report of a refresh, as it is exported
+type exportRecord struct {
+	Time         time.Time      `json:"time"`
+	Hits         int            `json:"hits"`
+	Bytes        uint64         `json:"bytes"`
+	TotalEntries int            `json:"total_entries"`
+	WindowHits   int            `json:"window_hits"`
+	WindowBytes  uint64         `json:"window_bytes"`
+	Statuses     statusCounts   `json:"statuses"`
+	TopSections  []SectionStats `json:"top_sections"`
+	Alerts       []exportAlert  `json:"alerts"`
+}
+
+// exportAlert is the state of an alert at a refresh, as it is exported
+type exportAlert struct {
+	Rule      string     `json:"rule"`
+	Subject   string     `json:"subject"`
+	Name      string     `json:"name,omitempty"`
+	State     AlertState `json:"state"`
+	Severity  Severity   `json:"severity,omitempty"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+}
+
+func newExportRecord(stats RefreshStats) exportRecord {
+	record := exportRecord{
+		Time:         stats.Time,
+		Hits:         stats.Hits,
+		Bytes:        stats.Bytes,
+		TotalEntries: stats.TotalEntries,
+		WindowHits:   stats.WindowHits,
+		WindowBytes:  stats.WindowBytes,
+		Statuses:     stats.WindowStatuses,
+		TopSections:  stats.TopSections,
+		Alerts:       make([]exportAlert, 0, len(stats.Alerts)),
+	}
+	if record.TopSections == nil {
+		record.TopSections = []SectionStats{}
+	}
+
+	for _, alert := range stats.Alerts {
+		record.Alerts = append(record.Alerts, exportAlert{
+			Rule:      alert.Rule,
+			Subject:   alert.Subject,
+			Name:      alert.Name,
+			State:     alert.State,
+			Severity:  alert.Severity,
+			Value:     alert.Value,
+			Threshold: alert.Threshold,
+		})
+	}
+
+	return record
+}
+
+// csvRow returns the columns of a record in the CSV report export. Top sections and alerts are joined in
+// a single column each, such as "/api:12;/static:3" and "traffic/total:firing"
+func (r exportRecord) csvRow() []string {
+	row := []string{
+		r.Time.Format(time.RFC3339),
+		strconv.Itoa(r.Hits),
+		strconv.FormatUint(r.Bytes, 10),
+		strconv.Itoa(r.TotalEntries),
+		strconv.Itoa(r.WindowHits),
+		strconv.FormatUint(r.WindowBytes, 10),
+	}
+	for class := 1; class < len(r.Statuses); class++ {
+		row = append(row, strconv.Itoa(r.Statuses[class]))
+	}
+
+	var sections []string
+	for _, section := range r.TopSections {
+		sections = append(sections, fmt.Sprintf("%s:%d", section.Section, section.Hits))
+	}
+
+	var alerts []string
+	pending, firing := 0, 0
+	for _, alert := range r.Alerts {
+		switch alert.State {
+		case AlertPending:
+			pending++
+		case AlertFiring:
+			firing++
+		}
+
+		subject := alert.Subject
+		if alert.Name != "" {
+			subject += " " + alert.Name
+		}
+		alerts = append(alerts, fmt.Sprintf("%s/%s:%s", alert.Rule, subject, alert.State))
+	}
+
+	return append(row,
+		strings.Join(sections, ";"),
+		strconv.Itoa(pending),
+		strconv.Itoa(firing),
+		strings.Join(alerts, ";"),
+	)
+}
+
+// reportExporter appends the report of every refresh to a file, as JSON lines or CSV. The file is rotated
+// when it exceeds its maximum size: it is renamed with a ".1" suffix, the previous ".1" file becomes ".2"
+// and so on, and the oldest files are removed
+type reportExporter struct {
+	config ExportConfig
+	file   *os.File
+	size   int64
+}
+
+// newReportExporter creates a report exporter appending to the configured file
+func newReportExporter(config ExportConfig) (*reportExporter, error) {
+	if config.Format != exportJSONLines && config.Format != exportCSV {
+		return nil, fmt.Errorf("unknown export format %q", config.Format)
+	}
+
+	exporter := &reportExporter{config: config}
+	err := exporter.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return exporter, nil
+}
+
+// open opens the export file, writing the CSV header if the file is empty
+func (e *reportExporter) open() error {
+	file, err := os.OpenFile(e.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	e.file = file
+	e.size = info.Size()
+
+	if e.size == 0 && e.config.Format == exportCSV {
+		return e.write(csvLine(exportCSVHeader))
+	}
+	return nil
+}
+
+// Flush appends the report of a refresh to the export file, rotating it first if it is too large
+func (e *reportExporter) Flush(stats RefreshStats) error {
+	record := newExportRecord(stats)
+
+	var line []byte
+	if e.config.Format == exportCSV {
+		line = csvLine(record.csvRow())
+	} else {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	}
+
+	if e.file == nil {
+		err := e.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the report is still appended to the current file when it cannot be rotated
+	var rotateErr error
+	if e.config.MaxSize > 0 && e.size > 0 && e.size+int64(len(line)) > e.config.MaxSize {
+		rotateErr = e.rotate()
+		if e.file == nil {
+			return rotateErr
+		}
+	}
+
+	err := e.write(line)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+func (e *reportExporter) write(line []byte) error {
+	n, err := e.file.Write(line)
+	e.size += int64(n)
+	return err
+}
+
+// rotate renames the export file and the previously rotated files, and opens a new export file. When the files
+// cannot be renamed, the current export file is opened again, so that the next reports are still exported
+func (e *reportExporter) rotate() error {
+	err := e.file.Close()
+	e.file = nil
+	if err != nil {
+		return err
+	}
+
+	err = e.rename()
+	if err != nil {
+		err = fmt.Errorf("could not rotate export file %s: %v", e.config.Path, err)
+	}
+
+	openErr := e.open()
+	if openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// rename renames the export file and the previously rotated files, removing the oldest ones
+func (e *reportExporter) rename() error {
+	if e.config.MaxFiles <= 0 {
+		return os.Remove(e.config.Path)
+	}
+
+	// the oldest file is overwritten by the one before it
+	for i := e.config.MaxFiles - 1; i > 0; i-- {
+		err := os.Rename(rotatedPath(e.config.Path, i), rotatedPath(e.config.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(e.config.Path, rotatedPath(e.config.Path, 1))
+}
+
+// Close closes the export file
+func (e *reportExporter) Close() error {
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// csvLine encodes the columns of a CSV line
+func csvLine(columns []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// This test ensures that the report of every refresh is appended to the export file as a JSON line
+func TestReportExportJSONLines(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.jsonl")
+	exporter, err := newReportExporter(ExportConfig{Path: path, Format: exportJSONLines})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer exporter.Close()
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 1
+	config.TopHitsNumber = 2
+	lp := NewLogProcessor(log, log, config, nil, nil, []MetricsSink{exporter}, nil, func() time.Time { return now })
+
+	lp.Add([]*HTTPEntry{{Section: "/api", Status: 200, Size: 10, Time: now}})
+	now = now.Add(10 * time.Second)
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 2 * 1024 * 1024, Time: now},
+		{Section: "/static", Status: 500, Size: 10, Time: now},
+		{Section: "/user", Status: 404, Size: 10, Time: now},
+	})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open export file: %v", err)
+	}
+	defer file.Close()
+
+	var records []exportRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("could not decode line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if !records[0].Time.Equal(baseTime) || records[0].Hits != 1 || len(records[0].Alerts) != 0 {
+		t.Errorf("unexpected first record %+v", records[0])
+	}
+
+	record := records[1]
+	if record.Hits != 3 || record.Bytes != 2*1024*1024+20 || record.TotalEntries != 4 || record.WindowHits != 4 {
+		t.Errorf("unexpected traffic in record %+v", record)
+	}
+	if record.Statuses[2] != 2 || record.Statuses[4] != 1 || record.Statuses[5] != 1 {
+		t.Errorf("unexpected statuses in record %+v", record.Statuses)
+	}
+	if len(record.TopSections) != 2 || record.TopSections[0].Section != "/api" || record.TopSections[0].Hits != 2 {
+		t.Errorf("unexpected top sections in record %+v", record.TopSections)
+	}
+	if len(record.Alerts) != 1 || record.Alerts[0].Rule != trafficRule || record.Alerts[0].State != AlertFiring {
+		t.Errorf("unexpected alerts in record %+v", record.Alerts)
+	}
+}
+
+// This test ensures that reports are exported as CSV with a header in every file, and that the export file
+// is rotated once it exceeds its maximum size
+func TestReportExportCSVRotation(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.csv")
+	exporter, err := newReportExporter(ExportConfig{Path: path, Format: exportCSV, MaxSize: 400, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer exporter.Close()
+
+	stats := RefreshStats{
+		Hits:           3,
+		Bytes:          1024,
+		TotalEntries:   3,
+		WindowHits:     3,
+		WindowBytes:    1024,
+		WindowStatuses: statusCounts{2: 2, 5: 1},
+		TopSections:    []SectionStats{{Section: "/api", Hits: 2, Bytes: 1000}, {Section: "/static", Hits: 1, Bytes: 24}},
+		Alerts: []Alert{
+			{Rule: trafficRule, Subject: totalSubject, State: AlertFiring},
+			{Rule: serverErrorRateRule, Subject: sectionSubject, Name: "/api", State: AlertPending},
+		},
+	}
+
+	// the header and two rows fit in a file, so 10 refreshes rotate the file 4 times
+	for i := 0; i < 10; i++ {
+		stats.Time = baseTime.Add(time.Duration(i) * 10 * time.Second)
+		if err := exporter.Flush(stats); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	readCSV := func(path string) [][]string {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("could not open %s: %v", path, err)
+		}
+		defer file.Close()
+
+		rows, err := csv.NewReader(file).ReadAll()
+		if err != nil {
+			t.Fatalf("could not read %s: %v", path, err)
+		}
+		return rows
+	}
+
+	rows := readCSV(path)
+	if len(rows) != 3 || len(rows[0]) != len(exportCSVHeader) || rows[0][0] != "time" {
+		t.Fatalf("expected a header and 2 rows, got %v", rows)
+	}
+	expected := []string{"2018-05-08T10:01:20Z", "3", "1024", "3", "3", "1024", "0", "2", "0", "0", "1", "/api:2;/static:1", "1", "1", "traffic/total:firing;server_error_rate/section /api:pending"}
+	for i, column := range expected {
+		if rows[1][i] != column {
+			t.Errorf("expected column %s to be %q, got %q", exportCSVHeader[i], column, rows[1][i])
+		}
+	}
+
+	// the previous rotated files are kept, and the older ones are removed
+	if rows := readCSV(path + ".1"); len(rows) != 3 || rows[1][0] != "2018-05-08T10:01:00Z" {
+		t.Errorf("unexpected first rotated file %v", rows)
+	}
+	if rows := readCSV(path + ".2"); len(rows) != 3 || rows[1][0] != "2018-05-08T10:00:40Z" {
+		t.Errorf("unexpected second rotated file %v", rows)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept, got %v", err)
+	}
+
+	// the reports are still appended to the export file when it cannot be rotated
+	failing := filepath.Join(dir, "failing.csv")
+	if err := os.Mkdir(failing+".1", 0755); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	failingExporter, err := newReportExporter(ExportConfig{Path: failing, Format: exportCSV, MaxSize: 400, MaxFiles: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer failingExporter.Close()
+
+	for i := 0; i < 4; i++ {
+		stats.Time = baseTime.Add(time.Duration(i) * 10 * time.Second)
+		err := failingExporter.Flush(stats)
+		if i < 2 && err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i >= 2 && err == nil {
+			t.Errorf("expected the rotation to fail at refresh %d", i)
+		}
+	}
+	if rows := readCSV(failing); len(rows) != 5 || rows[4][0] != "2018-05-08T10:00:30Z" {
+		t.Errorf("expected the reports to be appended to the export file that cannot be rotated, got %v", rows)
+	}
+
+	if _, err := newReportExporter(ExportConfig{Path: path, Format: "xml"}); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// AlertRecorder records the state changes of alerts
+type AlertRecorder interface {
+	Record(alert Alert) error
+}
+
+// alertHistory persists the state changes of alerts into a local file, as JSON lines
+type alertHistory struct {
+	file *os.File
+}
+
+// openAlertHistory opens an alert history file, creating it if it does not exist yet
+func openAlertHistory(path string) (*alertHistory, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &alertHistory{file: file}, nil
+}
+
+// Record appends an alert at the end of the alert history file
+func (h *alertHistory) Record(alert Alert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the alert history file
+func (h *alertHistory) Close() error {
+	return h.file.Close()
+}
+
+// readAlertHistory reads the alerts recorded in an alert history file which changed state between from and to.
+// Zero times disable the corresponding filter.
+func readAlertHistory(path string, from, to time.Time) ([]Alert, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var alerts []Alert
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var alert Alert
+		err := json.Unmarshal(scanner.Bytes(), &alert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alert history at line %d: %v", line, err)
+		}
+
+		if !from.IsZero() && alert.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && alert.Time.After(to) {
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, scanner.Err()
+}
+
+// parseTimeFilter parses a time used to filter a time range, which can either be a date, an RFC3339 time or
+// a duration such as "2h", in which case it is relative to now
+func parseTimeFilter(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q: expected a duration such as 2h, a date or an RFC3339 time", value)
+}
+
+// alertsCommand runs the alerts subcommands
+func alertsCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: hk-agent alerts history|silence [flags]")
+	}
+
+	switch args[0] {
+	case "history":
+		return alertsHistoryCommand(args[1:], out)
+	case "silence":
+		return alertsSilenceCommand(args[1:], out)
+	default:
+		return fmt.Errorf("unknown alerts subcommand %q", args[0])
+	}
+}
+
+// alertsHistoryCommand prints the alert history, filtered by time range and rule
+func alertsHistoryCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("alerts history", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON configuration file overriding the default values")
+	fromStr := flags.String("from", "", "only show alert changes after this time (date, RFC3339 time or duration such as 24h)")
+	toStr := flags.String("to", "", "only show alert changes before this time (date, RFC3339 time or duration such as 1h)")
+	rule := flags.String("rule", "", "only show alerts raised by this rule")
+	asJSON := flags.Bool("json", false, "print alerts as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfigFlag(*configPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	from, err := parseTimeFilter(*fromStr, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFilter(*toStr, now)
+	if err != nil {
+		return err
+	}
+
+	if config.AlertHistoryPath == "" {
+		return errors.New("alert history is disabled, set alert_history_path in the configuration")
+	}
+
+	alerts, err := readAlertHistory(config.AlertHistoryPath, from, to)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		for _, alert := range alerts {
+			if *rule != "" && alert.Rule != *rule {
+				continue
+			}
+			if err := encoder.Encode(alert); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tSTATE\tSEVERITY\tRULE\tSUBJECT\tVALUE\tPEAK\tTHRESHOLD\tSTARTED\tENDED")
+	for _, alert := range alerts {
+		if *rule != "" && alert.Rule != *rule {
+			continue
+		}
+
+		subject := alert.Subject
+		if alert.Name != "" {
+			subject = alert.Subject + "=" + alert.Name
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%g\t%g\t%g\t%s\t%s\n",
+			alert.Time.Format(time.RFC3339),
+			strings.ToUpper(string(alert.State)),
+			orDash(string(alert.Severity)),
+			alert.Rule,
+			subject,
+			alert.Value,
+			alert.Peak,
+			alert.Threshold,
+			formatHistoryTime(alert.StartsAt),
+			formatHistoryTime(alert.EndsAt),
+		)
+	}
+	return writer.Flush()
+}
+
+func formatHistoryTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alertRecorderMock keeps recorded alerts in memory
+type alertRecorderMock struct {
+	alerts []Alert
+}
+
+func (m *alertRecorderMock) Record(alert Alert) error {
+	m.alerts = append(m.alerts, alert)
+	return nil
+}
+
+// This test ensures that alerts go through the pending, firing and resolved states, and that every
+// state change is recorded with the start and end times of the alert and its peak value
+func TestAlertLifecycle(t *testing.T) {
+	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
+	startTime := baseTime
+
+	recorder := &alertRecorderMock{}
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	lp := &LogProcessor{
+		log:                log,
+		report:             log,
+		topHitsNumber:      3,
+		trafficThreshold:   1,
+		alertPendingPeriod: 10 * time.Second,
+		refreshPeriod:      10 * time.Second,
+		history:            recorder,
+		now: func() time.Time {
+			return baseTime
+		},
+	}
+
+	newEntry := func(size uint64) *HTTPEntry {
+		return &HTTPEntry{Section: "/", Status: 200, Size: size, Time: baseTime}
+	}
+
+	// exceeds the threshold, pending
+	lp.Add([]*HTTPEntry{newEntry(2 * 1024 * 1024)})
+	// still exceeds the threshold for longer than the pending period, firing
+	baseTime = baseTime.Add(10 * time.Second)
+	lp.Add([]*HTTPEntry{newEntry(3 * 1024 * 1024)})
+	// entries are outdated, resolved once they are removed from the recent entries
+	baseTime = baseTime.Add(5 * time.Minute)
+	lp.Add(nil)
+	lp.Add(nil)
+
+	if len(recorder.alerts) != 3 {
+		t.Fatalf("expected 3 alert state changes to be recorded, got %d", len(recorder.alerts))
+	}
+
+	expectedStates := []AlertState{AlertPending, AlertFiring, AlertResolved}
+	for i, alert := range recorder.alerts {
+		if alert.State != expectedStates[i] {
+			t.Errorf("expected alert state #%d to be %s, was %s instead", i, expectedStates[i], alert.State)
+		}
+		if alert.Rule != trafficRule || alert.Subject != totalSubject {
+			t.Errorf("unexpected alert rule %s and subject %s", alert.Rule, alert.Subject)
+		}
+		if !alert.StartsAt.Equal(startTime) {
+			t.Errorf("expected alert to start at %s, started at %s instead", startTime, alert.StartsAt)
+		}
+	}
+
+	resolved := recorder.alerts[2]
+	if resolved.Peak != 5 || resolved.Value != 0 || resolved.Threshold != 1 {
+		t.Errorf("unexpected values for resolved alert: value %v, peak %v, threshold %v", resolved.Value, resolved.Peak, resolved.Threshold)
+	}
+	if !resolved.EndsAt.Equal(baseTime) || !resolved.FiringAt.Equal(startTime.Add(10*time.Second)) {
+		t.Errorf("unexpected firing and end times for resolved alert: %s, %s", resolved.FiringAt, resolved.EndsAt)
+	}
+}
+
+func TestAlertHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "alert_history.jsonl")
+	history, err := openAlertHistory(path)
+	if err != nil {
+		t.Fatalf("could not open alert history: %v", err)
+	}
+
+	baseTime := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+	alerts := []Alert{
+		{Time: baseTime, State: AlertFiring, Rule: trafficRule, Subject: totalSubject, Value: 3, Peak: 3, Threshold: 1, StartsAt: baseTime},
+		{Time: baseTime.Add(time.Hour), State: AlertFiring, Rule: serverErrorRateRule, Subject: sectionSubject, Name: "/api", Value: 12.5, Peak: 12.5, Threshold: 10, StartsAt: baseTime.Add(time.Hour)},
+		{Time: baseTime.Add(2 * time.Hour), State: AlertResolved, Rule: trafficRule, Subject: totalSubject, Value: 0, Peak: 3, Threshold: 1, StartsAt: baseTime, EndsAt: baseTime.Add(2 * time.Hour)},
+	}
+	for _, alert := range alerts {
+		if err := history.Record(alert); err != nil {
+			t.Fatalf("could not record alert: %v", err)
+		}
+	}
+	history.Close()
+
+	testCases := []struct {
+		from time.Time
+		to   time.Time
+
+		expectedAlerts int
+	}{
+		{expectedAlerts: 3},
+		{from: baseTime.Add(30 * time.Minute), expectedAlerts: 2},
+		{to: baseTime.Add(90 * time.Minute), expectedAlerts: 2},
+		{from: baseTime.Add(30 * time.Minute), to: baseTime.Add(90 * time.Minute), expectedAlerts: 1},
+	}
+	for _, testCase := range testCases {
+		result, err := readAlertHistory(path, testCase.from, testCase.to)
+		if err != nil {
+			t.Fatalf("could not read alert history: %v", err)
+		}
+		if len(result) != testCase.expectedAlerts {
+			t.Errorf("expected %d alerts between %s and %s, got %d", testCase.expectedAlerts, testCase.from, testCase.to, len(result))
+		}
+	}
+
+	config := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(config, []byte(`{"alert_history_path": "`+path+`"}`), 0644)
+	if err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	err = alertsCommand([]string{"history", "-config", config, "-rule", "traffic", "-from", "2018-05-08T08:30:00Z"}, out)
+	if err != nil {
+		t.Fatalf("unexpected error from alerts history command: %v", err)
+	}
+	if !strings.Contains(out.String(), "2018-05-08T10:00:00Z  RESOLVED  -         traffic  total") {
+		t.Errorf("expected resolved traffic alert in alerts history output, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "server_error_rate") || strings.Contains(out.String(), "FIRING") {
+		t.Errorf("expected alerts history output to be filtered, got:\n%s", out.String())
+	}
+}
+
+func TestParseTimeFilter(t *testing.T) {
+	now := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		value string
+
+		expectedTime time.Time
+		expectedErr  bool
+	}{
+		{value: "", expectedTime: time.Time{}},
+		{value: "2h", expectedTime: now.Add(-2 * time.Hour)},
+		{value: "2018-05-07T10:00:00Z", expectedTime: time.Date(2018, time.May, 7, 10, 0, 0, 0, time.UTC)},
+		{value: "yesterday", expectedErr: true},
+	}
+	for _, testCase := range testCases {
+		result, err := parseTimeFilter(testCase.value, now)
+		if testCase.expectedErr != (err != nil) {
+			t.Errorf("unexpected error for %q: %v", testCase.value, err)
+		}
+		if !result.Equal(testCase.expectedTime) {
+			t.Errorf("expected %q to be parsed as %s, got %s", testCase.value, testCase.expectedTime, result)
+		}
+	}
+}
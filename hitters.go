@@ -0,0 +1,334 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// defaultHeavyHittersCapacity is the number of keys tracked by heavy hitters when no capacity is configured
+const defaultHeavyHittersCapacity = 1000
+
+// HeavyHitter is a key tracked by heavy hitters, with an estimation of its count. The count can be
+// overestimated by at most Error, so the key was seen at least Count - Error times
+type HeavyHitter struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+
+	// index of the key in the heap of the tracked keys
+	index int
+}
+
+// dimensions of the entries whose most frequent keys are tracked
+const (
+	sectionsDimension   = "sections"
+	pathsDimension      = "paths"
+	clientsDimension    = "clients"
+	userAgentsDimension = "user_agents"
+)
+
+// topKeys tracks the most frequent sections, paths, clients and user agents since the agent started
+type topKeys struct {
+	sections   *heavyHitters
+	paths      *heavyHitters
+	clients    *heavyHitters
+	userAgents *heavyHitters
+}
+
+func newTopKeys(config HeavyHittersConfig) *topKeys {
+	return &topKeys{
+		sections:   newHeavyHitters(config),
+		paths:      newHeavyHitters(config),
+		clients:    newHeavyHitters(config),
+		userAgents: newHeavyHitters(config),
+	}
+}
+
+// add counts the entries read at a refresh. Sections are counted once per refresh from the sorted entries,
+// while the other dimensions are counted entry by entry. Missing paths, clients and user agents are not counted
+func (t *topKeys) add(sortedData map[string][]*HTTPEntry) {
+	for section, entries := range sortedData {
+		t.sections.add(section, uint64(len(entries)))
+		for _, entry := range entries {
+			if entry.Path != "" {
+				t.paths.add(entry.Path, 1)
+			}
+			if entry.ClientAddress != "" {
+				t.clients.add(entry.ClientAddress, 1)
+			}
+			if entry.UserAgent != "" && entry.UserAgent != "-" {
+				t.userAgents.add(entry.UserAgent, 1)
+			}
+		}
+	}
+}
+
+// dimension returns the heavy hitters of a dimension, such as "sections" or "user_agents"
+func (t *topKeys) dimension(name string) (*heavyHitters, error) {
+	switch name {
+	case sectionsDimension:
+		return t.sections, nil
+	case pathsDimension:
+		return t.paths, nil
+	case clientsDimension:
+		return t.clients, nil
+	case userAgentsDimension:
+		return t.userAgents, nil
+	}
+	return nil, fmt.Errorf("unknown dimension %q", name)
+}
+
+// HeavyHitters returns the n most frequent keys of a dimension since the agent started
+func (lp *LogProcessor) HeavyHitters(dimension string, n int) ([]HeavyHitter, error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.hits == nil {
+		lp.hits = newTopKeys(HeavyHittersConfig{})
+	}
+	hitters, err := lp.hits.dimension(dimension)
+	if err != nil {
+		return nil, err
+	}
+	return hitters.top(n), nil
+}
+
+// heavyHitters tracks the most frequent keys of a stream in bounded memory, with the Space-Saving algorithm:
+// only a fixed number of keys are tracked, and a new key replaces the least frequent tracked key, inheriting
+// its count as a possible overestimation. Every key seen more than N/capacity times out of N is tracked.
+//
+// When a count-min sketch is configured, it estimates the counts of all the keys, including the ones that
+// are not tracked. A new key then only replaces the least frequent tracked key once its estimated count is
+// higher, which prevents a flow of keys that are seen once, such as scanner probes, from evicting the keys
+// that are actually frequent.
+type heavyHitters struct {
+	capacity int
+	keys     map[string]*HeavyHitter
+	// min-heap of the tracked keys by count, whose root is the first key to be replaced
+	heap   hitterHeap
+	sketch *countMinSketch
+}
+
+func newHeavyHitters(config HeavyHittersConfig) *heavyHitters {
+	capacity := config.Capacity
+	if capacity <= 0 {
+		capacity = defaultHeavyHittersCapacity
+	}
+
+	hitters := &heavyHitters{
+		capacity: capacity,
+		keys:     make(map[string]*HeavyHitter, capacity),
+		heap:     make(hitterHeap, 0, capacity),
+	}
+	if config.Epsilon > 0 && config.Delta > 0 {
+		hitters.sketch = newCountMinSketch(config.Epsilon, config.Delta)
+	}
+	return hitters
+}
+
+// add counts n occurrences of a key
+func (h *heavyHitters) add(key string, n uint64) {
+	var estimate uint64
+	if h.sketch != nil {
+		estimate = h.sketch.add(key, n)
+	}
+
+	if hitter, ok := h.keys[key]; ok {
+		hitter.Count += n
+		heap.Fix(&h.heap, hitter.index)
+		return
+	}
+
+	if len(h.heap) < h.capacity {
+		hitter := &HeavyHitter{Key: key, Count: n}
+		if h.sketch != nil {
+			hitter.Count, hitter.Error = estimate, estimate-n
+		}
+		h.keys[key] = hitter
+		heap.Push(&h.heap, hitter)
+		return
+	}
+
+	// the least frequent key is replaced, unless the sketch estimates that the new key is even less frequent
+	min := h.heap[0]
+	count, overestimate := min.Count+n, min.Count
+	if h.sketch != nil {
+		if estimate <= min.Count {
+			return
+		}
+		count, overestimate = estimate, estimate-n
+	}
+
+	delete(h.keys, min.Key)
+	min.Key, min.Count, min.Error = key, count, overestimate
+	h.keys[key] = min
+	heap.Fix(&h.heap, 0)
+}
+
+// top returns the n most frequent keys, sorted by count and then by key
+func (h *heavyHitters) top(n int) []HeavyHitter {
+	hitters := make([]HeavyHitter, 0, len(h.heap))
+	for _, hitter := range h.heap {
+		hitters = append(hitters, *hitter)
+	}
+
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Count == hitters[j].Count {
+			return hitters[i].Key < hitters[j].Key
+		}
+		return hitters[i].Count > hitters[j].Count
+	})
+
+	if len(hitters) > n {
+		hitters = hitters[:n]
+	}
+	return hitters
+}
+
+// restore replaces the tracked keys, keeping the most frequent ones when there are more than the capacity. The
+// sketch is rebuilt from the restored counts, otherwise new keys would have to be seen as often since the
+// restart as the restored keys in total before replacing any of them
+func (h *heavyHitters) restore(hitters []HeavyHitter) {
+	h.keys = make(map[string]*HeavyHitter, h.capacity)
+	h.heap = h.heap[:0]
+
+	if h.sketch != nil {
+		h.sketch.reset()
+		for _, hitter := range hitters {
+			h.sketch.add(hitter.Key, hitter.Count-hitter.Error)
+		}
+	}
+
+	sorted := append([]HeavyHitter(nil), hitters...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Count > sorted[j].Count
+	})
+	if len(sorted) > h.capacity {
+		sorted = sorted[:h.capacity]
+	}
+
+	for i := range sorted {
+		hitter := sorted[i]
+		h.keys[hitter.Key] = &hitter
+		heap.Push(&h.heap, &hitter)
+	}
+}
+
+// count returns the estimated count of a key
+func (h *heavyHitters) count(key string) uint64 {
+	if hitter, ok := h.keys[key]; ok {
+		return hitter.Count
+	}
+	if h.sketch != nil {
+		return h.sketch.estimate(key)
+	}
+	return 0
+}
+
+// hitterHeap is a min-heap of heavy hitters by count, implementing heap.Interface
+type hitterHeap []*HeavyHitter
+
+func (hh hitterHeap) Len() int           { return len(hh) }
+func (hh hitterHeap) Less(i, j int) bool { return hh[i].Count < hh[j].Count }
+
+func (hh hitterHeap) Swap(i, j int) {
+	hh[i], hh[j] = hh[j], hh[i]
+	hh[i].index = i
+	hh[j].index = j
+}
+
+func (hh *hitterHeap) Push(x interface{}) {
+	hitter := x.(*HeavyHitter)
+	hitter.index = len(*hh)
+	*hh = append(*hh, hitter)
+}
+
+func (hh *hitterHeap) Pop() interface{} {
+	old := *hh
+	hitter := old[len(old)-1]
+	*hh = old[:len(old)-1]
+	return hitter
+}
+
+// countMinSketch estimates the counts of keys in a fixed amount of memory. With a probability of 1 - delta,
+// the count of a key is overestimated by at most epsilon times the total of the counts, and it is never
+// underestimated
+type countMinSketch struct {
+	width  uint32
+	counts [][]uint64
+}
+
+// maxSketchWidth and maxSketchDepth bound the memory of a count-min sketch to 5MB, whatever its error and
+// probability
+const (
+	maxSketchWidth = 1 << 16
+	maxSketchDepth = 10
+)
+
+func newCountMinSketch(epsilon, delta float64) *countMinSketch {
+	width := uint32(maxSketchWidth)
+	if epsilon > math.E/maxSketchWidth {
+		width = uint32(math.Ceil(math.E / epsilon))
+	}
+	depth := int(math.Ceil(math.Log(1 / delta)))
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > maxSketchDepth {
+		depth = maxSketchDepth
+	}
+
+	sketch := &countMinSketch{width: width, counts: make([][]uint64, depth)}
+	for i := range sketch.counts {
+		sketch.counts[i] = make([]uint64, width)
+	}
+	return sketch
+}
+
+// add counts n occurrences of a key, and returns its estimated count
+func (s *countMinSketch) add(key string, n uint64) uint64 {
+	estimate := uint64(math.MaxUint64)
+	h1, h2 := sketchHashes(key)
+	for i, row := range s.counts {
+		cell := &row[(h1+uint32(i)*h2)%s.width]
+		*cell += n
+		if *cell < estimate {
+			estimate = *cell
+		}
+	}
+	return estimate
+}
+
+// reset sets the counts of all the keys to zero
+func (s *countMinSketch) reset() {
+	for _, row := range s.counts {
+		for i := range row {
+			row[i] = 0
+		}
+	}
+}
+
+// estimate returns the estimated count of a key
+func (s *countMinSketch) estimate(key string) uint64 {
+	estimate := uint64(math.MaxUint64)
+	h1, h2 := sketchHashes(key)
+	for i, row := range s.counts {
+		if cell := row[(h1+uint32(i)*h2)%s.width]; cell < estimate {
+			estimate = cell
+		}
+	}
+	return estimate
+}
+
+// sketchHashes returns two hashes of a key, which are combined into one hash for every row of the sketch.
+// They are the halves of the 64-bit FNV-1a hash of the key, computed without allocating
+func sketchHashes(key string) (uint32, uint32) {
+	sum := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		sum ^= uint64(key[i])
+		sum *= 1099511628211
+	}
+	return uint32(sum), uint32(sum>>32) | 1
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchmarkKeys are distinct keys generated once for the benchmarks, so that generating them is not measured
+var benchmarkKeys []string
+
+func distinctKeys(n int) []string {
+	if len(benchmarkKeys) < n {
+		benchmarkKeys = make([]string, n)
+		for i := range benchmarkKeys {
+			benchmarkKeys[i] = "/probe/" + strconv.Itoa(i) + ".php"
+		}
+	}
+	return benchmarkKeys[:n]
+}
+
+func TestHeavyHittersExact(t *testing.T) {
+	hitters := newHeavyHitters(HeavyHittersConfig{Capacity: 10})
+	for _, key := range strings.Split("/a /b /a /c /a /b /d", " ") {
+		hitters.add(key, 1)
+	}
+	hitters.add("/c", 2)
+
+	expected := []HeavyHitter{{Key: "/a", Count: 3}, {Key: "/c", Count: 3}, {Key: "/b", Count: 2}}
+	top := hitters.top(3)
+	if len(top) != len(expected) {
+		t.Fatalf("expected %d heavy hitters, got %+v", len(expected), top)
+	}
+	for i := range expected {
+		if top[i].Key != expected[i].Key || top[i].Count != expected[i].Count || top[i].Error != 0 {
+			t.Errorf("expected heavy hitter #%d to be %+v, got %+v", i+1, expected[i], top[i])
+		}
+	}
+
+	if count := hitters.count("/d"); count != 1 {
+		t.Errorf("expected /d to be counted once, got %d", count)
+	}
+	if count := hitters.count("/e"); count != 0 {
+		t.Errorf("expected /e not to be counted, got %d", count)
+	}
+}
+
+// This test ensures that the memory of the heavy hitters stays bounded by their capacity when a scanner probes
+// a lot of distinct paths, and that the frequent keys are still tracked with a bounded error. Unlike the
+// benchmarks, which only report the allocations, it checks the number of tracked keys and the size of the heap
+// and of the sketch all along
+func TestHeavyHittersBounded(t *testing.T) {
+	tests := map[string]HeavyHittersConfig{
+		"space-saving":     {Capacity: 100},
+		"count-min sketch": {Capacity: 100, Epsilon: 0.001, Delta: 0.01},
+	}
+
+	for name, config := range tests {
+		hitters := newHeavyHitters(config)
+		var sketchWidth uint32
+		if hitters.sketch != nil {
+			sketchWidth = hitters.sketch.width
+		}
+
+		expected := map[string]uint64{"/api": 0, "/static": 0}
+		for i, probe := range distinctKeys(100000) {
+			if i%10000 == 0 && (len(hitters.keys) > config.Capacity || cap(hitters.heap) != config.Capacity ||
+				(hitters.sketch != nil && (hitters.sketch.width != sketchWidth || len(hitters.sketch.counts[0]) != int(sketchWidth)))) {
+				t.Fatalf("%s: expected the memory to stay bounded after %d keys, got %d keys and a heap of capacity %d",
+					name, i, len(hitters.keys), cap(hitters.heap))
+			}
+			hitters.add(probe, 1)
+			if i%20 == 0 {
+				hitters.add("/api", 1)
+				expected["/api"]++
+			}
+			if i%30 == 0 {
+				hitters.add("/static", 1)
+				expected["/static"]++
+			}
+		}
+
+		if len(hitters.keys) != config.Capacity || len(hitters.heap) != config.Capacity {
+			t.Errorf("%s: expected %d keys to be tracked, got %d keys and %d in the heap", name, config.Capacity, len(hitters.keys), len(hitters.heap))
+		}
+
+		top := hitters.top(2)
+		if len(top) != 2 || top[0].Key != "/api" || top[1].Key != "/static" {
+			t.Fatalf("%s: expected /api and /static to be the heavy hitters, got %+v", name, top)
+		}
+		for _, hitter := range top {
+			if hitter.Count < expected[hitter.Key] || hitter.Count-hitter.Error > expected[hitter.Key] {
+				t.Errorf("%s: expected %s to be counted %d times within the error, got %+v", name, hitter.Key, expected[hitter.Key], hitter)
+			}
+		}
+	}
+}
+
+// This test ensures that the heavy hitters of the log processor stay bounded by their capacity in every dimension
+// when it receives a lot of distinct paths, clients and user agents
+func TestLogProcessorHeavyHittersBounded(t *testing.T) {
+	config := DefaultConfig()
+	config.HeavyHitters = HeavyHittersConfig{Capacity: 50, Epsilon: 0.001, Delta: 0.01}
+	log := NewZeroLog(ioutil.Discard, JSON)
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	lp := NewLogProcessor(log, log, config, nil, nil, nil, nil, func() time.Time { return baseTime })
+
+	keys := distinctKeys(20000)
+	for batch := 0; batch < len(keys); batch += 1000 {
+		entries := make([]*HTTPEntry, 0, 1000)
+		for i, key := range keys[batch : batch+1000] {
+			entries = append(entries, &HTTPEntry{
+				Section:       "/section" + strconv.Itoa((batch+i)%500),
+				Path:          key,
+				ClientAddress: "10.0." + strconv.Itoa((batch+i)/256%256) + "." + strconv.Itoa((batch+i)%256),
+				UserAgent:     "scanner/" + strconv.Itoa(batch+i),
+				Status:        404,
+				Time:          baseTime,
+			})
+		}
+		lp.Add(entries)
+	}
+
+	for _, name := range []string{"sections", "paths", "clients", "user_agents"} {
+		hitters, err := lp.hits.dimension(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(hitters.keys) != 50 || len(hitters.heap) != 50 {
+			t.Errorf("expected 50 %s to be tracked, got %d keys and %d in the heap", name, len(hitters.keys), len(hitters.heap))
+		}
+	}
+}
+
+// This test ensures that the count-min sketch never underestimates a count, and overestimates it by at most
+// epsilon times the total of the counts
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(0.01, 0.01)
+	if sketch.width != 272 || len(sketch.counts) != 5 {
+		t.Errorf("expected a sketch of 272 counters by 5 rows, got %d by %d", sketch.width, len(sketch.counts))
+	}
+
+	bounded := newCountMinSketch(1e-9, 1e-300)
+	if bounded.width != maxSketchWidth || len(bounded.counts) != maxSketchDepth {
+		t.Errorf("expected a sketch of %d counters by %d rows at most, got %d by %d", maxSketchWidth, maxSketchDepth, bounded.width, len(bounded.counts))
+	}
+
+	keys := distinctKeys(10000)
+	for i, key := range keys {
+		sketch.add(key, uint64(i%3+1))
+	}
+
+	total := uint64(0)
+	for i := range keys {
+		total += uint64(i%3 + 1)
+	}
+	for i, key := range keys {
+		estimate := sketch.estimate(key)
+		if estimate < uint64(i%3+1) || estimate > uint64(i%3+1)+total/100 {
+			t.Errorf("expected the estimate of %s to be within the error of %d, got %d", key, i%3+1, estimate)
+		}
+	}
+}
+
+func TestHeavyHittersRestore(t *testing.T) {
+	hitters := newHeavyHitters(HeavyHittersConfig{Capacity: 2})
+	hitters.add("/old", 1)
+
+	hitters.restore([]HeavyHitter{{Key: "/a", Count: 5}, {Key: "/b", Count: 1, Error: 1}, {Key: "/c", Count: 7}})
+	if top := hitters.top(10); len(top) != 2 || top[0].Key != "/c" || top[1].Key != "/a" {
+		t.Fatalf("expected the most frequent keys to be restored, got %+v", top)
+	}
+
+	// the restored keys keep being counted
+	hitters.add("/a", 3)
+	hitters.add("/d", 1)
+	if top := hitters.top(10); top[0].Key != "/a" || top[0].Count != 8 || top[1].Key != "/d" || top[1].Count != 8 || top[1].Error != 7 {
+		t.Errorf("expected /d to replace /c, got %+v", top)
+	}
+}
+
+// This test ensures that the sketch is rebuilt from the restored counts, so that a restored key which is not
+// tracked anymore can replace a tracked one once it was seen more often in total
+func TestHeavyHittersRestoreSketch(t *testing.T) {
+	hitters := newHeavyHitters(HeavyHittersConfig{Capacity: 2, Epsilon: 0.001, Delta: 0.01})
+	hitters.restore([]HeavyHitter{{Key: "/a", Count: 100}, {Key: "/b", Count: 50}, {Key: "/c", Count: 12, Error: 2}})
+	if hitters.count("/c") != 10 {
+		t.Errorf("expected the sketch to estimate the restored count of /c, got %d", hitters.count("/c"))
+	}
+
+	hitters.add("/c", 45)
+	if top := hitters.top(10); len(top) != 2 || top[1].Key != "/c" || top[1].Count != 55 {
+		t.Errorf("expected /c to replace /b, got %+v", top)
+	}
+}
+
+// The benchmarks count a flow of distinct keys, such as the paths probed by a scanner. The heavy hitters do not
+// allocate once they are full, while an unbounded map keeps growing with the number of keys
+func BenchmarkHeavyHitters(b *testing.B) {
+	benchmarkHeavyHitters(b, HeavyHittersConfig{Capacity: defaultHeavyHittersCapacity})
+}
+
+func BenchmarkHeavyHittersSketch(b *testing.B) {
+	benchmarkHeavyHitters(b, HeavyHittersConfig{Capacity: defaultHeavyHittersCapacity, Epsilon: 0.001, Delta: 0.01})
+}
+
+func benchmarkHeavyHitters(b *testing.B, config HeavyHittersConfig) {
+	keys := distinctKeys(1 << 20)
+	hitters := newHeavyHitters(config)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hitters.add(keys[i%len(keys)], 1)
+	}
+}
+
+func BenchmarkUnboundedHits(b *testing.B) {
+	keys := distinctKeys(1 << 20)
+	hits := make(map[string]int)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hits[keys[i%len(keys)]]++
+	}
+}
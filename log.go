@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/rs/zerolog"
@@ -47,3 +50,48 @@ func parseLevel(level string) zerolog.Level {
 		return zerolog.DebugLevel
 	}
 }
+
+// parseLogMode parses the format of an output, "console" for human-readable lines or "json" for JSON lines
+func parseLogMode(format string) (LogMode, error) {
+	switch strings.ToLower(format) {
+	case "console", "pretty":
+		return Pretty, nil
+	case "json":
+		return JSON, nil
+	default:
+		return Pretty, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// openOutput opens the destination of an output and creates a logger writing to it in its format. JSON
+// lines are timestamped, as console lines are. The returned closer closes the destination when it is a file
+func openOutput(config OutputConfig) (*zerolog.Logger, io.Closer, error) {
+	mode, err := parseLogMode(config.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var writer io.Writer
+	var closer io.Closer = ioutil.NopCloser(nil)
+	switch config.Destination {
+	case "", "stdout":
+		writer = os.Stdout
+	case "stderr":
+		writer = os.Stderr
+	case "discard":
+		writer = ioutil.Discard
+	default:
+		file, err := os.OpenFile(config.Destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		writer, closer = file, file
+	}
+
+	log := NewZeroLog(writer, mode)
+	if mode == JSON {
+		timestamped := log.With().Timestamp().Logger()
+		log = &timestamped
+	}
+	return log, closer, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLogMode(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected LogMode
+		valid    bool
+	}{
+		{"console", Pretty, true},
+		{"Pretty", Pretty, true},
+		{"json", JSON, true},
+		{"JSON", JSON, true},
+		{"xml", Pretty, false},
+		{"", Pretty, false},
+	}
+
+	for _, test := range tests {
+		mode, err := parseLogMode(test.format)
+		if test.valid && (err != nil || mode != test.expected) {
+			t.Errorf("expected format %q to be parsed as %d, got %d and error %v", test.format, test.expected, mode, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("expected format %q to be invalid", test.format)
+		}
+	}
+}
+
+// This test ensures that outputs can be written to files as timestamped JSON lines, and that invalid
+// outputs are refused
+func TestOpenOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.jsonl")
+	log, closer, err := openOutput(OutputConfig{Destination: path, Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	log.Info().Int("hits", 3).Msg("Statistics")
+	closer.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read output: %v", err)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(data, &line); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %v", data, err)
+	}
+	if line["message"] != "Statistics" || line["hits"] != 3.0 || line["time"] == nil {
+		t.Errorf("unexpected line %v", line)
+	}
+
+	if _, _, err := openOutput(OutputConfig{Destination: "stdout", Format: "xml"}); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+	if _, _, err := openOutput(OutputConfig{Destination: filepath.Join(dir, "missing", "report.log"), Format: "console"}); err == nil {
+		t.Error("expected a destination in a missing directory to be refused")
+	}
+
+	_, closer, err = openOutput(OutputConfig{Destination: "discard", Format: "console"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if err := closer.Close(); err != nil {
+		t.Errorf("unexpected error closing a discarded output: %v", err)
+	}
+}
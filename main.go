@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,63 +11,245 @@ import (
 	"github.com/ullaakut/gonx"
 )
 
+// shutdownTimeout is the time given to the notifiers and metrics sinks to send what they queued when the agent
+// stops
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	// instantiate structured logger
 	log := NewZeroLog(os.Stderr, Pretty)
 
-	config := DefaultConfig()
-	config.Print(log)
+	if len(os.Args) > 1 && os.Args[1] == "alerts" {
+		err := alertsCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not run alerts command")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		err := analyzeCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not run analyze command")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rollups" {
+		err := rollupsCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not run rollups command")
+		}
+		return
+	}
 
-	zerolog.SetGlobalLevel(parseLevel(config.LogLevel))
+	configPath := flag.String("config", "", "path to a JSON configuration file overriding the default values")
+	dashboardFlag := flag.Bool("dashboard", false, "display a full-screen terminal dashboard instead of the log lines")
+	replayFlag := flag.Bool("replay", false, "replay the log file from its beginning, with a clock following the timestamps of its entries")
+	speedFlag := flag.Float64("replay-speed", 1, "number of times faster than real time the log file is replayed, 0 for as fast as possible")
+	flag.Parse()
+
+	config, err := loadConfigFlag(*configPath)
+	if err != nil {
+		log.Fatal().Err(err).Str("config_path", *configPath).Msg("Could not load configuration")
+	}
+	if _, ok := logFormats[config.LogFormat]; !ok {
+		log.Fatal().Str("log_format", config.LogFormat).Msg("Unknown log format")
+	}
+	config.Dashboard.Enabled = config.Dashboard.Enabled || *dashboardFlag
+	config.Replay.Enabled = config.Replay.Enabled || *replayFlag
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "replay-speed" {
+			config.Replay.Speed = *speedFlag
+		}
+	})
+
+	// the dashboard takes over the terminal, so the outputs written to it are redirected
+	if config.Dashboard.Enabled {
+		config.Diagnostics = config.Dashboard.redirect(config.Diagnostics)
+		config.Report = config.Dashboard.redirect(config.Report)
+	}
+
+	// the diagnostics of the agent and the reports are written to their own outputs
+	diagnostics, diagnosticsFile, err := openOutput(config.Diagnostics)
+	if err != nil {
+		log.Fatal().Err(err).Str("destination", config.Diagnostics.Destination).Msg("Could not open diagnostics output")
+	}
+	defer diagnosticsFile.Close()
+	leveled := diagnostics.Level(parseLevel(config.LogLevel))
+	log = &leveled
+
+	// replayed alerts are old, so they are only notified and recorded when asked to
+	if config.Replay.Enabled {
+		config = config.Replay.isolate(log, config)
+	}
+
+	report, reportFile, err := openOutput(config.Report)
+	if err != nil {
+		log.Fatal().Err(err).Str("destination", config.Report.Destination).Msg("Could not open report output")
+	}
+	defer reportFile.Close()
+
+	config.Print(log)
 
 	// Catch signals
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
+	// load silences, which are shared between the log processor and the API
+	silences, err := newSilenceStore(log, config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not load silences")
+	}
+
+	// open alert history, in which all alert state changes are recorded
+	var history AlertRecorder
+	if config.AlertHistoryPath != "" {
+		alertHistory, err := openAlertHistory(config.AlertHistoryPath)
+		if err != nil {
+			log.Error().Err(err).Str("alert_history_path", config.AlertHistoryPath).Msg("Could not open alert history")
+		} else {
+			defer alertHistory.Close()
+			history = alertHistory
+		}
+	}
+
+	notifiers := newNotifiers(log, config)
+	sinks := newMetricsSinks(log, config)
+
+	// the dashboard is refreshed by the log processor and displays its alerts
+	var board *dashboard
+	if config.Dashboard.Enabled {
+		board = newDashboard(os.Stdout, config)
+		notifiers = append(notifiers, board)
+		sinks = append(sinks, board)
+	}
+
+	// a single OTLP exporter sends both the alerts and the metrics, over one queue and one connection
+	if config.OTLP.Endpoint != "" {
+		otlp, err := newOTLPExporter(log, config.OTLP, config.LogFilePath, config.MetricsMaxSections)
+		if err != nil {
+			log.Error().Err(err).Str("otlp_endpoint", config.OTLP.Endpoint).Msg("Could not create OTLP exporter")
+		} else {
+			notifiers = append(notifiers, otlp)
+			if config.Replay.exportsMetrics() {
+				sinks = append(sinks, otlp)
+			}
+		}
+	}
+
+	// the web UI is updated at every refresh of the log processor and displays its alerts
+	var web *webUI
+	if config.WebUIAddress != "" {
+		web = newWebUI(log, config)
+		notifiers = append(notifiers, web)
+		sinks = append(sinks, web)
+	}
+
+	// when replaying a log file, the time of the agent is the time of the replayed entries
+	now := time.Now
+	var clock *replayClock
+	if config.Replay.Enabled {
+		clock = &replayClock{}
+		now = clock.Now
+	}
+
+	// instantiate log processor
+	logProcessor := NewLogProcessor(log, report, config, history, notifiers, sinks, silences, now)
+
+	// the state of a previous run is restored, unless old logs are replayed
+	saveStates := config.StatePath != "" && !config.Replay.Enabled
+	if saveStates {
+		restoreState(log, config.StatePath, logProcessor)
+		if config.StateSnapshotInterval.Duration > 0 {
+			go snapshotState(log, config.StatePath, config.StateSnapshotInterval.Duration, logProcessor)
+		}
+	}
+
+	if config.APIAddress != "" {
+		go serveAPI(log, config.APIAddress, newAPI(log, logProcessor, silences, config.AlertHistoryPath, config.Rollups, now).Handler())
+	}
+
+	if config.MetricsAddress != "" {
+		go serveMetrics(log, config.MetricsAddress, metricsHandler(log, logProcessor))
+	}
+
+	if web != nil {
+		web.processor = logProcessor
+		go web.Run()
+		go serveWebUI(log, config.WebUIAddress, web.Handler())
+	}
+
 	// read logs in a separate routin
-	go readLogs(log, config)
+	if clock != nil {
+		go replayLogs(log, config, logProcessor, clock)
+	} else {
+		go readLogs(log, config, logProcessor)
+	}
 
-	// Wait for agent to be stopped
-	<-sig
+	// Wait for agent to be stopped, or for the user to quit the dashboard
+	var quit <-chan struct{}
+	if board != nil {
+		board.processor = logProcessor
+		go board.Run(os.Stdin)
+		quit = board.Done()
+	}
+	select {
+	case <-sig:
+	case <-quit:
+	}
 	signal.Stop(sig)
 	close(sig)
-	os.Exit(0)
+
+	// the queued notifications and metrics are sent before the state is saved, as entries read in the meantime
+	// are no longer notified
+	logProcessor.Close(shutdownTimeout)
+	if saveStates {
+		err := saveState(config.StatePath, logProcessor.Snapshot())
+		if err != nil {
+			log.Error().Err(err).Str("state_path", config.StatePath).Msg("Could not save state")
+		}
+	}
+	if board != nil {
+		board.Close(os.Stdin)
+	}
+}
+
+// loadConfigFlag loads the configuration file given with the config flag, or the default configuration
+// if no configuration file was given
+func loadConfigFlag(path string) (Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	return LoadConfig(path)
 }
 
 // Reads the logs from the file specified in the configuration
 // and process the entries using the configured values
-func readLogs(log *zerolog.Logger, config Config) {
-	// instanciate parser for Common Log Format
-	parser := gonx.NewParser(`$client_address $identifier $user_id [$time] "$request" $status $size`)
+func readLogs(log *zerolog.Logger, config Config, logProcessor *LogProcessor) {
+	// instanciate parser for the configured log format
+	parser := gonx.NewParser(logFormats[config.LogFormat])
 
-	// instantiate log processor
-	logProcessor := NewLogProcessor(
-		log,
-		config.TopHitsNumber,
-		config.TrafficThreshold,
-		config.RefreshPeriod,
-		time.Now,
-	)
-
-	// open log file
-	file, err := os.Open(config.LogFilePath)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not open logfile")
-	}
+	// the log file is read from where it was read before the agent restarted, if its state was restored
+	file := newLogFile(log, config.LogFilePath)
+	file.Resume(logProcessor.LogFilePosition())
 	defer file.Close()
 
 	for {
-		timeEnd := time.Now().Add(config.RefreshPeriod)
+		timeEnd := time.Now().Add(config.RefreshPeriod.Duration)
+
+		lines, err := file.ReadLines()
+		logProcessor.SetLogFileStatus(config.LogFilePath, err)
 
-		// Recreate scanner at every iteration to ensure that it gets the new data
-		scanner := bufio.NewScanner(file)
 		entries := []*HTTPEntry{}
-		for scanner.Scan() {
+		read, failures := 0, 0
+		for _, line := range lines {
 			// parse every line of the log file into an HTTP entry
-			line := scanner.Text()
 			if line != "" {
+				read++
 				entry, err := parser.ParseString(line)
 				if err != nil {
+					failures++
 					log.Error().Err(err).Msg("Could not parse string")
 				} else {
 					// convert parsed entry into our own HTTPEntry strucutre
@@ -77,7 +259,8 @@ func readLogs(log *zerolog.Logger, config Config) {
 		}
 
 		// add all parsed entries to logProcessor
-		go logProcessor.Add(entries)
+		logProcessor.RecordLines(read, failures)
+		logProcessor.AddRead(entries, file.Position())
 
 		// Sleep for 10 seconds minus the time that this loop took to complete
 		// If this loop took more than 10s to complete, sleep will return immediately
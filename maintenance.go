@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximumMaintenanceDuration is the longest duration supported for maintenance windows
+const maximumMaintenanceDuration = 7 * 24 * time.Hour
+
+// maintenanceWindow is a recurring silence, which starts according to a cron-like schedule and lasts
+// for a fixed duration
+type maintenanceWindow struct {
+	Matcher
+
+	schedule cronSchedule
+	duration time.Duration
+}
+
+func newMaintenanceWindow(config MaintenanceWindowConfig) (maintenanceWindow, error) {
+	schedule, err := parseCronSchedule(config.Schedule)
+	if err != nil {
+		return maintenanceWindow{}, fmt.Errorf("invalid maintenance window schedule %q: %v", config.Schedule, err)
+	}
+
+	if config.Duration.Duration <= 0 || config.Duration.Duration > maximumMaintenanceDuration {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window duration must be between 0 and %s", maximumMaintenanceDuration)
+	}
+
+	return maintenanceWindow{
+		Matcher:  config.Matcher,
+		schedule: schedule,
+		duration: config.Duration.Duration,
+	}, nil
+}
+
+// Active returns whether the maintenance window is active at the given time, which is the case when its
+// schedule last matched a minute during the last duration of the window
+func (mw maintenanceWindow) Active(now time.Time) bool {
+	start, ok := mw.schedule.Previous(now, now.Add(-mw.duration))
+	return ok && now.Sub(start) < mw.duration
+}
+
+// cronSchedule is a schedule in the format of cron, with five fields: minute, hour, day of month, month and
+// day of week. Fields can be "*", values, ranges such as "1-5", lists such as "1,3,5" and steps such as "*/15".
+// As with cron, when both the day of month and the day of week are restricted, a day matches if either of them
+// does: "0 2 1 * 0" matches the first day of every month and every Sunday.
+type cronSchedule struct {
+	expression string
+
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+
+	// whether the day fields are restricted, which is the case when they don't start with "*"
+	daysOfMonthRestricted bool
+	daysOfWeekRestricted  bool
+}
+
+func parseCronSchedule(expression string) (cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	schedule := cronSchedule{
+		expression:            expression,
+		daysOfMonthRestricted: !strings.HasPrefix(fields[2], "*"),
+		daysOfWeekRestricted:  !strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+
+	limits := []struct {
+		values   *map[int]bool
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.daysOfMonth, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.daysOfWeek, 0, 6},
+	}
+	for i, limit := range limits {
+		*limit.values, err = parseCronField(fields[i], limit.min, limit.max)
+		if err != nil {
+			return cronSchedule{}, err
+		}
+	}
+
+	return schedule, nil
+}
+
+// parseCronField parses a field of a cron schedule into the set of values it matches
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx != -1 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+// Matches returns whether the schedule matches the minute of the given time
+func (cs cronSchedule) Matches(t time.Time) bool {
+	return cs.minutes[t.Minute()] && cs.hours[t.Hour()] && cs.matchesDay(t)
+}
+
+// matchesDay returns whether the schedule matches the day of the given time
+func (cs cronSchedule) matchesDay(t time.Time) bool {
+	if !cs.months[int(t.Month())] {
+		return false
+	}
+
+	dayOfMonth, dayOfWeek := cs.daysOfMonth[t.Day()], cs.daysOfWeek[int(t.Weekday())]
+	if cs.daysOfMonthRestricted && cs.daysOfWeekRestricted {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// Previous returns the last minute matched by the schedule at or before the given time, and not before the
+// given limit. It looks for the matching days, then for their last matching hour and minute, so that it does
+// not need to check every minute since the limit.
+func (cs cronSchedule) Previous(t, limit time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	for ; day.AddDate(0, 0, 1).After(limit); day = day.AddDate(0, 0, -1) {
+		if !cs.matchesDay(day) {
+			continue
+		}
+
+		// only the hours and minutes up to the given time can match on its day
+		today := day.Year() == t.Year() && day.YearDay() == t.YearDay()
+		lastHour := 23
+		if today {
+			lastHour = t.Hour()
+		}
+		for hour := lastHour; hour >= 0; hour-- {
+			if !cs.hours[hour] {
+				continue
+			}
+			lastMinute := 59
+			if today && hour == t.Hour() {
+				lastMinute = t.Minute()
+			}
+			for minute := lastMinute; minute >= 0; minute-- {
+				if !cs.minutes[minute] {
+					continue
+				}
+				match := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+				if match.Before(limit) {
+					return time.Time{}, false
+				}
+				return match, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// otherSection is the label of the sections that are not tracked individually in metrics, once the maximum
+// number of sections is reached
+const otherSection = "other"
+
+// processorMetrics holds the cumulative counters of the log processor, which are exported as Prometheus metrics
+type processorMetrics struct {
+	// maximum number of sections that have their own counters, to bound the cardinality of the metrics
+	maxSections int
+	sections    map[string]*sectionCounters
+
+	linesRead     uint64
+	parseFailures uint64
+
+	// entries dropped because they arrived after their window, and entries clamped because they were dated in
+	// the future
+	lateEntries   uint64
+	futureEntries uint64
+
+	// number of times entries were processed, and the total and last duration of their processing
+	processingCount    uint64
+	processingDuration time.Duration
+	lastProcessing     time.Duration
+}
+
+// sectionCounters counts the hits, bytes and statuses of a section since the agent started
+type sectionCounters struct {
+	hits     uint64
+	bytes    uint64
+	statuses statusCounts
+}
+
+func newProcessorMetrics(maxSections int) processorMetrics {
+	return processorMetrics{
+		maxSections: maxSections,
+		sections:    make(map[string]*sectionCounters),
+	}
+}
+
+// count adds an entry to the counters of its section, or to the counters of other sections when too many
+// sections are already tracked
+func (pm *processorMetrics) count(entry *HTTPEntry) {
+	if pm.sections == nil {
+		pm.sections = make(map[string]*sectionCounters)
+	}
+
+	counters, ok := pm.sections[entry.Section]
+	if !ok {
+		section := entry.Section
+		if pm.maxSections > 0 && len(pm.sections) >= pm.maxSections {
+			section = otherSection
+		}
+
+		counters, ok = pm.sections[section]
+		if !ok {
+			counters = &sectionCounters{}
+			pm.sections[section] = counters
+		}
+	}
+
+	counters.hits++
+	counters.bytes += entry.Size
+	counters.statuses.add(entry.Status)
+}
+
+// RecordLines counts the lines read from the log file, and the ones that could not be parsed
+func (lp *LogProcessor) RecordLines(lines, failures int) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.metrics.linesRead += uint64(lines)
+	lp.metrics.parseFailures += uint64(failures)
+}
+
+// WriteMetrics writes the metrics of the log processor in the Prometheus text format
+func (lp *LogProcessor) WriteMetrics(writer io.Writer) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	w := bufio.NewWriter(writer)
+
+	sections := make([]string, 0, len(lp.metrics.sections))
+	for section := range lp.metrics.sections {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	writeMetricHeader(w, "hk_agent_hits_total", "counter", "Number of HTTP entries received, by section.")
+	for _, section := range sections {
+		fmt.Fprintf(w, "hk_agent_hits_total{section=%s} %d\n", quoteLabel(section), lp.metrics.sections[section].hits)
+	}
+
+	writeMetricHeader(w, "hk_agent_bytes_total", "counter", "Number of bytes sent in responses, by section.")
+	for _, section := range sections {
+		fmt.Fprintf(w, "hk_agent_bytes_total{section=%s} %d\n", quoteLabel(section), lp.metrics.sections[section].bytes)
+	}
+
+	writeMetricHeader(w, "hk_agent_responses_total", "counter", "Number of HTTP entries received, by section and status class.")
+	for _, section := range sections {
+		statuses := lp.metrics.sections[section].statuses
+		for class := 1; class < len(statuses); class++ {
+			fmt.Fprintf(w, "hk_agent_responses_total{section=%s,class=%q} %d\n", quoteLabel(section), statusClasses[class], statuses[class])
+		}
+	}
+
+	writeMetricHeader(w, "hk_agent_window_hits", "gauge", "Number of HTTP entries received over the last 2 minutes.")
+	fmt.Fprintf(w, "hk_agent_window_hits %d\n", lp.recentEntries)
+	writeMetricHeader(w, "hk_agent_window_bytes", "gauge", "Number of bytes sent in responses over the last 2 minutes.")
+	fmt.Fprintf(w, "hk_agent_window_bytes %d\n", lp.windowBytes())
+
+	writeMetricHeader(w, "hk_agent_alert", "gauge", "Alerts that are currently pending or firing.")
+	for _, alert := range lp.activeAlerts() {
+		fmt.Fprintf(w, "hk_agent_alert{rule=%s,subject=%s,name=%s,state=%s,severity=%s} 1\n",
+			quoteLabel(alert.Rule),
+			quoteLabel(alert.Subject),
+			quoteLabel(alert.Name),
+			quoteLabel(string(alert.State)),
+			quoteLabel(string(alert.Severity)),
+		)
+	}
+
+	writeMetricHeader(w, "hk_agent_lines_read_total", "counter", "Number of lines read from the log file.")
+	fmt.Fprintf(w, "hk_agent_lines_read_total %d\n", lp.metrics.linesRead)
+	writeMetricHeader(w, "hk_agent_parse_failures_total", "counter", "Number of lines of the log file that could not be parsed.")
+	fmt.Fprintf(w, "hk_agent_parse_failures_total %d\n", lp.metrics.parseFailures)
+	writeMetricHeader(w, "hk_agent_entries_total", "counter", "Number of HTTP entries processed.")
+	fmt.Fprintf(w, "hk_agent_entries_total %d\n", lp.totalEntries)
+	writeMetricHeader(w, "hk_agent_late_entries_dropped_total", "counter", "Number of HTTP entries received too late to be counted in the recent traffic.")
+	fmt.Fprintf(w, "hk_agent_late_entries_dropped_total %d\n", lp.metrics.lateEntries)
+	writeMetricHeader(w, "hk_agent_future_entries_clamped_total", "counter", "Number of HTTP entries dated in the future, counted at the time of the refresh.")
+	fmt.Fprintf(w, "hk_agent_future_entries_clamped_total %d\n", lp.metrics.futureEntries)
+
+	writeMetricHeader(w, "hk_agent_processing_duration_seconds", "summary", "Time spent processing the entries read at every refresh.")
+	fmt.Fprintf(w, "hk_agent_processing_duration_seconds_sum %g\n", lp.metrics.processingDuration.Seconds())
+	fmt.Fprintf(w, "hk_agent_processing_duration_seconds_count %d\n", lp.metrics.processingCount)
+	writeMetricHeader(w, "hk_agent_last_processing_duration_seconds", "gauge", "Time spent processing the entries read at the last refresh.")
+	fmt.Fprintf(w, "hk_agent_last_processing_duration_seconds %g\n", lp.metrics.lastProcessing.Seconds())
+
+	if !lp.lastEntryAt.IsZero() {
+		writeMetricHeader(w, "hk_agent_last_entry_timestamp_seconds", "gauge", "Time at which HTTP entries were last received.")
+		fmt.Fprintf(w, "hk_agent_last_entry_timestamp_seconds %d\n", lp.lastEntryAt.Unix())
+	}
+
+	return w.Flush()
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelEscaper escapes label values as required by the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// metricsHandler serves the metrics of the log processor to Prometheus
+func metricsHandler(log *zerolog.Logger, lp *LogProcessor) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		err := lp.WriteMetrics(w)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not write metrics")
+		}
+	})
+	return mux
+}
+
+// serveMetrics serves the Prometheus metrics on the given address
+func serveMetrics(log *zerolog.Logger, address string, handler http.Handler) {
+	log.Info().Str("metrics_address", address).Msg("Serving Prometheus metrics")
+
+	err := http.ListenAndServe(address, handler)
+	if err != nil {
+		log.Error().Err(err).Str("metrics_address", address).Msg("Prometheus metrics stopped")
+	}
+}
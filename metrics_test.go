@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test ensures that the metrics of the log processor are exported in the Prometheus text format, and
+// that sections beyond the configured maximum are aggregated under the "other" label
+func TestWriteMetrics(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 1
+	config.MetricsMaxSections = 2
+	lp := NewLogProcessor(log, log, config, nil, nil, nil, nil, func() time.Time { return baseTime })
+
+	lp.RecordLines(5, 1)
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 2 * 1024 * 1024, Time: baseTime},
+		{Section: "/api", Status: 503, Size: 100, Time: baseTime},
+		{Section: "/static", Status: 304, Size: 0, Time: baseTime},
+		{Section: "/img", Status: 404, Size: 10, Time: baseTime},
+		{Section: `/"quoted"`, Status: 200, Size: 10, Time: baseTime},
+	})
+
+	output := &bytes.Buffer{}
+	err := lp.WriteMetrics(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedLines := []string{
+		"# TYPE hk_agent_hits_total counter",
+		`hk_agent_hits_total{section="/api"} 2`,
+		`hk_agent_hits_total{section="/static"} 1`,
+		`hk_agent_hits_total{section="other"} 2`,
+		`hk_agent_bytes_total{section="/api"} 2097252`,
+		`hk_agent_responses_total{section="/api",class="5xx"} 1`,
+		`hk_agent_responses_total{section="other",class="4xx"} 1`,
+		"hk_agent_window_hits 5",
+		"hk_agent_window_bytes 2097272",
+		`hk_agent_alert{rule="traffic",subject="total",name="",state="firing",severity="warning"} 1`,
+		"hk_agent_lines_read_total 5",
+		"hk_agent_parse_failures_total 1",
+		"hk_agent_entries_total 5",
+		"hk_agent_processing_duration_seconds_count 1",
+		"hk_agent_last_entry_timestamp_seconds 1525773600",
+	}
+	for _, expected := range expectedLines {
+		if !strings.Contains(output.String(), expected+"\n") {
+			t.Errorf("expected metrics to contain %s, got:\n%s", expected, output.String())
+		}
+	}
+
+	if strings.Contains(output.String(), `section="/img"`) {
+		t.Error("expected sections beyond the maximum not to have their own metrics")
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "/api", expected: `"/api"`},
+		{value: `/"quoted"`, expected: `"/\"quoted\""`},
+		{value: `C:\logs` + "\n", expected: `"C:\\logs\n"`},
+	}
+
+	for _, testCase := range testCases {
+		if quoted := quoteLabel(testCase.value); quoted != testCase.expected {
+			t.Errorf("expected %q to be quoted as %s, got %s", testCase.value, testCase.expected, quoted)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	log := NewZeroLog(ioutil.Discard, JSON)
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil, nil, nil, nil, time.Now)
+
+	server := httptest.NewServer(metricsHandler(log, lp))
+	defer server.Close()
+
+	// metrics are read while entries are being processed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			lp.Add([]*HTTPEntry{{Section: "/", Status: 200, Size: 10, Time: time.Now()}})
+		}
+	}()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	<-done
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "# TYPE hk_agent_entries_total counter") {
+		t.Errorf("expected metrics in response, got:\n%s", body)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog"
+)
+
+// Notifier is notified of every alert state change, for example to send it to an external service.
+// Notify should never block the log processor for long.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// errNotificationQueueFull is returned by notifiers that send notifications asynchronously when
+// too many notifications are waiting to be sent
+var errNotificationQueueFull = errors.New("notification queue is full")
+
+// newNotifiers creates the notifiers described in the configuration. Notifiers that can't be created are
+// logged and ignored, so that a misconfigured notifier does not prevent the agent from running
+func newNotifiers(log *zerolog.Logger, config Config) []Notifier {
+	var notifiers []Notifier
+
+	for _, webhookConfig := range config.Webhooks {
+		webhook, err := newWebhookNotifier(log, webhookConfig)
+		if err != nil {
+			log.Error().Err(err).Str("webhook_url", webhookConfig.URL).Msg("Could not create webhook notifier")
+			continue
+		}
+		notifiers = append(notifiers, routeSeverities(webhook, webhookConfig.Severities))
+	}
+
+	for _, emailConfig := range config.Emails {
+		email, err := newEmailNotifier(log, emailConfig)
+		if err != nil {
+			log.Error().Err(err).Str("smtp_host", emailConfig.Host).Msg("Could not create email notifier")
+			continue
+		}
+		notifiers = append(notifiers, routeSeverities(email, emailConfig.Severities))
+	}
+
+	for _, commandConfig := range config.Commands {
+		command, err := newCommandNotifier(log, commandConfig)
+		if err != nil {
+			log.Error().Err(err).Str("command", commandConfig.Command).Msg("Could not create command notifier")
+			continue
+		}
+		notifiers = append(notifiers, routeSeverities(command, commandConfig.Severities))
+	}
+
+	return notifiers
+}
+
+// notify notifies all notifiers of an alert state change
+func (lp *LogProcessor) notify(alert Alert) {
+	for _, notifier := range lp.notifiers {
+		err := notifier.Notify(alert)
+		if err != nil {
+			lp.log.Error().Err(err).Str("rule", alert.Rule).Str("state", string(alert.State)).Msg("Could not notify alert")
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// OTLP protocols
+const (
+	otlpHTTPProtobuf = "http/protobuf"
+	otlpGRPC         = "grpc"
+)
+
+// otlpSignal describes where a kind of telemetry is exported, with both protocols
+type otlpSignal struct {
+	name     string
+	httpPath string
+	grpcPath string
+}
+
+// Signals exported by the agent: the statistics of every refresh as metrics, and alert state changes as logs
+var (
+	otlpMetrics = otlpSignal{
+		name:     "metrics",
+		httpPath: "/v1/metrics",
+		grpcPath: "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export",
+	}
+	otlpLogs = otlpSignal{
+		name:     "logs",
+		httpPath: "/v1/logs",
+		grpcPath: "/opentelemetry.proto.collector.logs.v1.LogsService/Export",
+	}
+)
+
+// OTLP aggregation temporality of sums: the agent sends the entries received since the last refresh
+const otlpDeltaTemporality = 1
+
+// otlpSeverityNumbers maps alert severities to OTLP log severity numbers
+var otlpSeverityNumbers = map[Severity]uint64{
+	SeverityInfo:     9,
+	SeverityWarning:  13,
+	SeverityCritical: 17,
+}
+
+// otlpRequest is an export request waiting to be sent
+type otlpRequest struct {
+	signal otlpSignal
+	body   []byte
+}
+
+// otlpExporter exports the statistics of every refresh as metrics and alert state changes as log records
+// to an OpenTelemetry collector, with the OTLP protocol over HTTP/protobuf or gRPC. Requests are queued and
+// sent asynchronously, so that a slow collector never blocks the log processor
+type otlpExporter struct {
+	log    *zerolog.Logger
+	config OTLPConfig
+	client *http.Client
+
+	// attributes describing the agent, sent with every request
+	resource [][2]string
+	// time of the previous refresh, which is the start of the sums sent at the next one
+	lastFlush time.Time
+
+	// sections that have their own metrics, at most maxSections of them. The traffic of the other sections
+	// is exported with the "other" section, so that the number of metrics stays bounded
+	maxSections int
+	sections    map[string]bool
+
+	queue chan otlpRequest
+	done  sync.WaitGroup
+}
+
+// newOTLPExporter creates an OTLP exporter for the entries read from the given log file, with metrics for at
+// most maxSections sections, 0 meaning no limit, and starts sending its queued requests
+func newOTLPExporter(log *zerolog.Logger, config OTLPConfig, source string, maxSections int) (*otlpExporter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	attributes := map[string]string{
+		"service.name":  "hk-agent",
+		"log.file.path": source,
+	}
+	if host, err := os.Hostname(); err == nil {
+		attributes["host.name"] = host
+	}
+	for key, value := range config.ResourceAttributes {
+		attributes[key] = value
+	}
+
+	o := &otlpExporter{
+		log:    log,
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout.Duration,
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+				ForceAttemptHTTP2: true,
+			},
+		},
+		resource:    sortedAttributes(attributes),
+		maxSections: maxSections,
+		sections:    make(map[string]bool),
+		queue:       make(chan otlpRequest, config.QueueSize),
+	}
+
+	o.done.Add(1)
+	go o.run()
+
+	return o, nil
+}
+
+// Flush queues the statistics of a refresh to be exported as metrics
+func (o *otlpExporter) Flush(stats RefreshStats) error {
+	start := o.lastFlush
+	if start.IsZero() {
+		start = stats.Time
+	}
+	o.lastFlush = stats.Time
+
+	// sections are tracked in alphabetical order when too many of them are received at once
+	received := make([]string, 0, len(stats.Sections))
+	for section := range stats.Sections {
+		received = append(received, section)
+	}
+	sort.Strings(received)
+
+	bySection := make(map[string]SectionRefreshStats, len(received))
+	for _, section := range received {
+		name := o.trackSection(section)
+		sectionStats := bySection[name]
+		sectionStats.Hits += stats.Sections[section].Hits
+		sectionStats.Bytes += stats.Sections[section].Bytes
+		bySection[name] = sectionStats
+	}
+	stats.Sections = bySection
+
+	return o.enqueue(otlpRequest{signal: otlpMetrics, body: o.encodeMetrics(stats, start)})
+}
+
+// trackSection returns the section under which the metrics of a section are exported: the section itself if it
+// already has its own metrics or if there is room for it, and the "other" section otherwise
+func (o *otlpExporter) trackSection(section string) string {
+	if o.sections[section] {
+		return section
+	}
+	if o.maxSections > 0 && len(o.sections) >= o.maxSections {
+		return otherSection
+	}
+	o.sections[section] = true
+	return section
+}
+
+// Notify queues an alert state change to be exported as a log record
+func (o *otlpExporter) Notify(alert Alert) error {
+	return o.enqueue(otlpRequest{signal: otlpLogs, body: o.encodeAlert(alert)})
+}
+
+func (o *otlpExporter) enqueue(request otlpRequest) error {
+	select {
+	case o.queue <- request:
+		return nil
+	default:
+		return errNotificationQueueFull
+	}
+}
+
+// Close stops accepting requests and waits for the queued ones to be sent
+func (o *otlpExporter) Close() error {
+	close(o.queue)
+	o.done.Wait()
+	return nil
+}
+
+func (o *otlpExporter) run() {
+	defer o.done.Done()
+
+	for request := range o.queue {
+		err := o.send(request)
+		if err != nil {
+			o.log.Error().
+				Err(err).
+				Str("otlp_endpoint", o.config.Endpoint).
+				Str("signal", request.signal.name).
+				Msg("Could not export to OpenTelemetry collector")
+			continue
+		}
+
+		o.log.Debug().Str("otlp_endpoint", o.config.Endpoint).Str("signal", request.signal.name).Msg("Exported to OpenTelemetry collector")
+	}
+}
+
+// send sends an export request to the collector with the configured protocol
+func (o *otlpExporter) send(request otlpRequest) error {
+	if o.config.Protocol == otlpGRPC {
+		return o.sendGRPC(request)
+	}
+	return o.sendHTTP(request)
+}
+
+func (o *otlpExporter) sendHTTP(request otlpRequest) error {
+	req, err := http.NewRequest(http.MethodPost, o.config.Endpoint+request.signal.httpPath, bytes.NewReader(request.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range o.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendGRPC calls the export method of the collector's gRPC service, framing the request as a single
+// uncompressed message and reading the gRPC status from the response trailers
+func (o *otlpExporter) sendGRPC(request otlpRequest) error {
+	frame := make([]byte, 5, 5+len(request.body))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(request.body)))
+	frame = append(frame, request.body...)
+
+	req, err := http.NewRequest(http.MethodPost, o.config.Endpoint+request.signal.grpcPath, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for name, value := range o.config.Headers {
+		req.Header.Set(strings.ToLower(name), value)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// trailers are only available once the body was read
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned HTTP status %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("collector does not support HTTP/2")
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// trailers-only responses carry the status in the headers
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(status); err != nil || code != 0 {
+		return fmt.Errorf("collector returned gRPC status %q: %s", status, message)
+	}
+	return nil
+}
+
+// encodeMetrics encodes an ExportMetricsServiceRequest with the statistics of a refresh. Sums are deltas
+// since the previous refresh
+func (o *otlpExporter) encodeMetrics(stats RefreshStats, start time.Time) []byte {
+	sections := make([]string, 0, len(stats.Sections))
+	for section := range stats.Sections {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	startNano, timeNano := uint64(start.UnixNano()), uint64(stats.Time.UnixNano())
+	point := func(e *protoEncoder, value int64, attributes ...string) {
+		e.Message(1, func(p *protoEncoder) {
+			p.Fixed64(2, startNano)
+			p.Fixed64(3, timeNano)
+			p.Fixed64(6, uint64(value))
+			for i := 0; i+1 < len(attributes); i += 2 {
+				p.Message(7, func(kv *protoEncoder) { encodeAttribute(kv, attributes[i], attributes[i+1]) })
+			}
+		})
+	}
+	sum := func(e *protoEncoder, name, description, unit string, points func(*protoEncoder)) {
+		e.Message(2, func(m *protoEncoder) {
+			m.String(1, name)
+			m.String(2, description)
+			m.String(3, unit)
+			m.Message(7, func(s *protoEncoder) {
+				points(s)
+				s.Varint(2, otlpDeltaTemporality)
+				s.Varint(3, 1)
+			})
+		})
+	}
+	gauge := func(e *protoEncoder, name, description, unit string, points func(*protoEncoder)) {
+		e.Message(2, func(m *protoEncoder) {
+			m.String(1, name)
+			m.String(2, description)
+			m.String(3, unit)
+			m.Message(5, points)
+		})
+	}
+
+	request := &protoEncoder{}
+	request.Message(1, func(rm *protoEncoder) {
+		rm.Message(1, o.encodeResource)
+		rm.Message(2, func(sm *protoEncoder) {
+			sm.Message(1, encodeScope)
+
+			sum(sm, "hk_agent.hits", "Number of HTTP entries received, by section.", "{request}", func(s *protoEncoder) {
+				for _, section := range sections {
+					point(s, int64(stats.Sections[section].Hits), "section", section)
+				}
+			})
+			sum(sm, "hk_agent.bytes", "Number of bytes sent in responses, by section.", "By", func(s *protoEncoder) {
+				for _, section := range sections {
+					point(s, int64(stats.Sections[section].Bytes), "section", section)
+				}
+			})
+			sum(sm, "hk_agent.responses", "Number of HTTP entries received, by status class.", "{request}", func(s *protoEncoder) {
+				for class := 1; class < len(stats.Statuses); class++ {
+					point(s, int64(stats.Statuses[class]), "status_class", statusClasses[class])
+				}
+			})
+			gauge(sm, "hk_agent.window.hits", "Number of HTTP entries received over the last 2 minutes.", "{request}", func(g *protoEncoder) {
+				point(g, int64(stats.WindowHits))
+			})
+			gauge(sm, "hk_agent.window.bytes", "Number of bytes sent in responses over the last 2 minutes.", "By", func(g *protoEncoder) {
+				point(g, int64(stats.WindowBytes))
+			})
+			gauge(sm, "hk_agent.processing.duration", "Time spent processing the entries of the refresh.", "s", func(g *protoEncoder) {
+				g.Message(1, func(p *protoEncoder) {
+					p.Fixed64(2, startNano)
+					p.Fixed64(3, timeNano)
+					p.Double(4, stats.ProcessingDuration.Seconds())
+				})
+			})
+		})
+	})
+	return request.Bytes()
+}
+
+// encodeAlert encodes an ExportLogsServiceRequest with a log record describing an alert state change
+func (o *otlpExporter) encodeAlert(alert Alert) []byte {
+	attributes := [][2]string{
+		{"alert.rule", alert.Rule},
+		{"alert.state", string(alert.State)},
+		{"alert.severity", string(alert.Severity)},
+		{"alert.subject", alert.Subject},
+		{"alert.name", alert.Name},
+	}
+
+	request := &protoEncoder{}
+	request.Message(1, func(rl *protoEncoder) {
+		rl.Message(1, o.encodeResource)
+		rl.Message(2, func(sl *protoEncoder) {
+			sl.Message(1, encodeScope)
+			sl.Message(2, func(record *protoEncoder) {
+				record.Fixed64(1, uint64(alert.Time.UnixNano()))
+				record.Varint(2, otlpSeverityNumbers[alert.Severity])
+				record.String(3, strings.ToUpper(string(alert.Severity)))
+				record.Message(5, func(body *protoEncoder) { body.String(1, alert.Summary()) })
+				for _, attribute := range attributes {
+					record.Message(6, func(kv *protoEncoder) { encodeAttribute(kv, attribute[0], attribute[1]) })
+				}
+				record.Message(6, func(kv *protoEncoder) { encodeDoubleAttribute(kv, "alert.value", alert.Value) })
+				record.Message(6, func(kv *protoEncoder) { encodeDoubleAttribute(kv, "alert.threshold", alert.Threshold) })
+				record.Message(6, func(kv *protoEncoder) { encodeDoubleAttribute(kv, "alert.peak", alert.Peak) })
+				record.Fixed64(11, uint64(alert.Time.UnixNano()))
+			})
+		})
+	})
+	return request.Bytes()
+}
+
+// encodeResource encodes the Resource describing the agent
+func (o *otlpExporter) encodeResource(resource *protoEncoder) {
+	for _, attribute := range o.resource {
+		resource.Message(1, func(kv *protoEncoder) { encodeAttribute(kv, attribute[0], attribute[1]) })
+	}
+}
+
+// encodeScope encodes the InstrumentationScope of the agent
+func encodeScope(scope *protoEncoder) {
+	scope.String(1, "hk-agent")
+}
+
+// encodeAttribute encodes a KeyValue with a string value
+func encodeAttribute(kv *protoEncoder, key, value string) {
+	kv.String(1, key)
+	kv.Message(2, func(v *protoEncoder) { v.String(1, value) })
+}
+
+// encodeDoubleAttribute encodes a KeyValue with a double value
+func encodeDoubleAttribute(kv *protoEncoder, key string, value float64) {
+	kv.String(1, key)
+	kv.Message(2, func(v *protoEncoder) { v.Double(4, value) })
+}
+
+// sortedAttributes returns attributes as key-value pairs sorted by key
+func sortedAttributes(attributes map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(attributes))
+	for key, value := range attributes {
+		pairs = append(pairs, [2]string{key, value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	return pairs
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protoField is a field decoded from a protocol buffers message
+type protoField struct {
+	number int
+	varint uint64
+	data   []byte
+}
+
+// decodeProto decodes the fields of a protocol buffers message
+func decodeProto(t *testing.T, data []byte) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("invalid field tag")
+		}
+		data = data[n:]
+
+		field := protoField{number: int(tag >> 3)}
+		switch tag & 7 {
+		case protoVarint:
+			field.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("invalid varint in field %d", field.number)
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				t.Fatalf("truncated fixed64 in field %d", field.number)
+			}
+			field.varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoLengthDelimited:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatalf("invalid length in field %d", field.number)
+			}
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoPath returns the embedded messages found by following the given field numbers
+func protoPath(t *testing.T, data []byte, numbers ...int) [][]byte {
+	messages := [][]byte{data}
+	for _, number := range numbers {
+		var next [][]byte
+		for _, message := range messages {
+			for _, field := range decodeProto(t, message) {
+				if field.number == number {
+					next = append(next, field.data)
+				}
+			}
+		}
+		messages = next
+	}
+	return messages
+}
+
+// protoScalar returns the first scalar value of a field of a message
+func protoScalar(t *testing.T, message []byte, number int) (uint64, bool) {
+	for _, field := range decodeProto(t, message) {
+		if field.number == number {
+			return field.varint, true
+		}
+	}
+	return 0, false
+}
+
+// protoAttributes decodes KeyValue messages with string values
+func protoAttributes(t *testing.T, keyValues [][]byte) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range keyValues {
+		key := string(protoPath(t, kv, 1)[0])
+		values := protoPath(t, kv, 2, 1)
+		if len(values) > 0 {
+			attributes[key] = string(values[0])
+		}
+	}
+	return attributes
+}
+
+// fakeCollector records the requests it receives
+type fakeCollector struct {
+	mu       sync.Mutex
+	requests map[string][][]byte
+	headers  []http.Header
+}
+
+func (c *fakeCollector) record(path string, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.requests == nil {
+		c.requests = make(map[string][][]byte)
+	}
+	c.requests[path] = append(c.requests[path], body)
+	c.headers = append(c.headers, header)
+}
+
+func testRefreshStats(now time.Time) RefreshStats {
+	stats := RefreshStats{
+		Time:  now,
+		Hits:  3,
+		Bytes: 1500,
+		Sections: map[string]SectionRefreshStats{
+			"/api":  {Hits: 2, Bytes: 1000},
+			"/user": {Hits: 1, Bytes: 500},
+		},
+		WindowHits:         10,
+		WindowBytes:        4200,
+		ProcessingDuration: 1500 * time.Microsecond,
+	}
+	stats.Statuses.add(200)
+	stats.Statuses.add(200)
+	stats.Statuses.add(503)
+	return stats
+}
+
+// checkMetricsRequest checks the content of an ExportMetricsServiceRequest built from testRefreshStats
+func checkMetricsRequest(t *testing.T, body []byte) {
+	resource := protoAttributes(t, protoPath(t, body, 1, 1, 1))
+	if resource["log.file.path"] != "/var/log/access.log" || resource["host.name"] == "" || resource["deployment.environment"] != "test" {
+		t.Errorf("unexpected resource attributes %v", resource)
+	}
+
+	metrics := make(map[string][]byte)
+	for _, metric := range protoPath(t, body, 1, 2, 2) {
+		metrics[string(protoPath(t, metric, 1)[0])] = metric
+	}
+	for _, name := range []string{"hk_agent.hits", "hk_agent.bytes", "hk_agent.responses", "hk_agent.window.hits", "hk_agent.window.bytes", "hk_agent.processing.duration"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("expected metric %s, got %v", name, metrics)
+		}
+	}
+
+	hits := make(map[string]uint64)
+	for _, point := range protoPath(t, metrics["hk_agent.hits"], 7, 1) {
+		value, _ := protoScalar(t, point, 6)
+		hits[protoAttributes(t, protoPath(t, point, 7))["section"]] = value
+	}
+	if hits["/api"] != 2 || hits["/user"] != 1 {
+		t.Errorf("unexpected hits data points %v", hits)
+	}
+	if temporality, _ := protoScalar(t, protoPath(t, metrics["hk_agent.hits"], 7)[0], 2); temporality != otlpDeltaTemporality {
+		t.Errorf("expected delta temporality, got %d", temporality)
+	}
+
+	windowPoints := protoPath(t, metrics["hk_agent.window.hits"], 5, 1)
+	if value, _ := protoScalar(t, windowPoints[0], 6); len(windowPoints) != 1 || value != 10 {
+		t.Errorf("unexpected window hits data points %v", windowPoints)
+	}
+
+	durationPoints := protoPath(t, metrics["hk_agent.processing.duration"], 5, 1)
+	if value, _ := protoScalar(t, durationPoints[0], 4); math.Float64frombits(value) != 0.0015 {
+		t.Errorf("unexpected processing duration %g", math.Float64frombits(value))
+	}
+}
+
+// This test ensures that metrics and alerts are exported to a collector with OTLP over HTTP/protobuf
+func TestOTLPExporterHTTP(t *testing.T) {
+	log := NewZeroLog(ioutil.Discard, JSON)
+	collector := &fakeCollector{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		collector.record(r.URL.Path, r.Header, body)
+	}))
+	defer server.Close()
+
+	exporter, err := newOTLPExporter(log, OTLPConfig{
+		Endpoint:           server.URL + "/",
+		Protocol:           otlpHTTPProtobuf,
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+		Timeout:            Duration{time.Second},
+		QueueSize:          10,
+	}, "/var/log/access.log", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	alert := Alert{
+		Time:      now,
+		State:     AlertFiring,
+		Rule:      trafficRule,
+		Severity:  SeverityCritical,
+		Subject:   sectionSubject,
+		Name:      "/api",
+		Value:     3,
+		Peak:      3,
+		Threshold: 2,
+	}
+
+	if err := exporter.Flush(testRefreshStats(now)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := exporter.Notify(alert); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exporter.Close()
+
+	if len(collector.requests["/v1/metrics"]) != 1 || len(collector.requests["/v1/logs"]) != 1 {
+		t.Fatalf("expected one metrics and one logs request, got %v", collector.requests)
+	}
+	for _, header := range collector.headers {
+		if header.Get("Content-Type") != "application/x-protobuf" || header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected request headers %v", header)
+		}
+	}
+
+	checkMetricsRequest(t, collector.requests["/v1/metrics"][0])
+
+	logs := collector.requests["/v1/logs"][0]
+	records := protoPath(t, logs, 1, 2, 2)
+	if len(records) != 1 {
+		t.Fatalf("expected one log record, got %d", len(records))
+	}
+	if severity, _ := protoScalar(t, records[0], 2); severity != 17 {
+		t.Errorf("expected error severity number for critical alert, got %d", severity)
+	}
+	if body := string(protoPath(t, records[0], 5, 1)[0]); body != alert.Summary() {
+		t.Errorf("expected log record body %q, got %q", alert.Summary(), body)
+	}
+	attributes := protoAttributes(t, protoPath(t, records[0], 6))
+	if attributes["alert.rule"] != trafficRule || attributes["alert.state"] != "firing" || attributes["alert.name"] != "/api" {
+		t.Errorf("unexpected log record attributes %v", attributes)
+	}
+	if timestamp, _ := protoScalar(t, records[0], 1); timestamp != uint64(now.UnixNano()) {
+		t.Errorf("expected log record timestamp %d, got %d", now.UnixNano(), timestamp)
+	}
+}
+
+// This test ensures that only the first sections get their own metrics, and that the traffic of the others is
+// exported with the "other" section
+func TestOTLPExporterMaxSections(t *testing.T) {
+	log := NewZeroLog(ioutil.Discard, JSON)
+	collector := &fakeCollector{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		collector.record(r.URL.Path, r.Header, body)
+	}))
+	defer server.Close()
+
+	exporter, err := newOTLPExporter(log, OTLPConfig{
+		Endpoint:  server.URL,
+		Protocol:  otlpHTTPProtobuf,
+		Timeout:   Duration{time.Second},
+		QueueSize: 10,
+	}, "/var/log/access.log", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	stats := testRefreshStats(now)
+	stats.Sections["/static"] = SectionRefreshStats{Hits: 4, Bytes: 100}
+	exporter.Flush(stats)
+	exporter.Flush(RefreshStats{Time: now.Add(10 * time.Second), Sections: map[string]SectionRefreshStats{"/new": {Hits: 1}, "/user": {Hits: 3}}})
+	exporter.Close()
+
+	requests := collector.requests["/v1/metrics"]
+	if len(requests) != 2 {
+		t.Fatalf("expected two metrics requests, got %d", len(requests))
+	}
+
+	for i, expected := range []map[string]uint64{
+		{"/api": 2, otherSection: 5},
+		{otherSection: 4},
+	} {
+		hits := make(map[string]uint64)
+		for _, metric := range protoPath(t, requests[i], 1, 2, 2) {
+			if string(protoPath(t, metric, 1)[0]) != "hk_agent.hits" {
+				continue
+			}
+			for _, point := range protoPath(t, metric, 7, 1) {
+				value, _ := protoScalar(t, point, 6)
+				hits[protoAttributes(t, protoPath(t, point, 7))["section"]] = value
+			}
+		}
+		if !reflect.DeepEqual(hits, expected) {
+			t.Errorf("expected hits %v at refresh %d, got %v", expected, i, hits)
+		}
+	}
+}
+
+// This test ensures that metrics are exported to a collector with OTLP over gRPC, and that gRPC errors
+// are reported
+func TestOTLPExporterGRPC(t *testing.T) {
+	log := NewZeroLog(ioutil.Discard, JSON)
+	collector := &fakeCollector{}
+	status := "0"
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		frame, _ := ioutil.ReadAll(r.Body)
+		if len(frame) < 5 || int(binary.BigEndian.Uint32(frame[1:5])) != len(frame)-5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.record(r.URL.Path, r.Header, frame[5:])
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", status)
+		if status != "0" {
+			w.Header().Set("Grpc-Message", "invalid token")
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	exporter, err := newOTLPExporter(log, OTLPConfig{
+		Endpoint:           server.URL,
+		Protocol:           otlpGRPC,
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+		InsecureSkipVerify: true,
+		Timeout:            Duration{time.Second},
+		QueueSize:          10,
+	}, "/var/log/access.log", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer exporter.Close()
+
+	now := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	request := otlpRequest{signal: otlpMetrics, body: exporter.encodeMetrics(testRefreshStats(now), now.Add(-10*time.Second))}
+
+	err = exporter.send(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bodies := collector.requests[otlpMetrics.grpcPath]
+	if len(bodies) != 1 {
+		t.Fatalf("expected one export request, got %v", collector.requests)
+	}
+	checkMetricsRequest(t, bodies[0])
+
+	status = "16"
+	err = exporter.send(request)
+	if err == nil {
+		t.Error("expected error when the collector returns a gRPC error")
+	}
+}
+
+func TestOTLPExporterConfig(t *testing.T) {
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	testCases := []struct {
+		config OTLPConfig
+
+		expectedErr bool
+	}{
+		{config: OTLPConfig{Endpoint: "http://localhost:4318", Protocol: otlpHTTPProtobuf}, expectedErr: false},
+		{config: OTLPConfig{Endpoint: "https://collector:4317", Protocol: otlpGRPC}, expectedErr: false},
+		{config: OTLPConfig{Endpoint: "http://localhost:4317", Protocol: otlpGRPC}, expectedErr: true},
+		{config: OTLPConfig{Endpoint: "http://localhost:4318", Protocol: "http/json"}, expectedErr: true},
+	}
+
+	for _, testCase := range testCases {
+		exporter, err := newOTLPExporter(log, testCase.config, "access.log", 0)
+		if testCase.expectedErr != (err != nil) {
+			t.Errorf("unexpected error for %+v: %v", testCase.config, err)
+		}
+		if exporter != nil {
+			exporter.Close()
+		}
+	}
+}
+
+func TestLoadConfigRejectsPlaintextGRPC(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`{"otlp": {"endpoint": "http://localhost:4317", "protocol": "grpc"}}`)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(file.Name())
+	if err != errOTLPPlaintextGRPC {
+		t.Errorf("expected plaintext gRPC to be rejected, got %v", err)
+	}
+}
@@ -2,173 +2,474 @@ package main
 
 import (
 	"fmt"
-	"sort"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 )
 
-type hit struct {
-	key   string
-	value int
+// SectionStats contains the number of hits and the traffic of a section
+type SectionStats struct {
+	Section string `json:"section"`
+	Hits    int    `json:"hits"`
+	Bytes   uint64 `json:"bytes"`
+	// score of the section in the decayed ranking
+	Score float64 `json:"score,omitempty"`
 }
 
 // LogProcessor is a  structure that contains all previous HTTP logs and processes
 // them to detect high traffic and rank top hits for example
 type LogProcessor struct {
-	// logger
+	// logger of the agent diagnostics
 	log *zerolog.Logger
+	// writer of the reports, which are the statistics of every refresh and the alerts
+	report *zerolog.Logger
+
+	// protects the state of the log processor, which is read by the HTTP endpoints while entries are processed
+	mu sync.Mutex
 
 	// time.Now() function
 	now func() time.Time
 
 	// Configuration
-	trafficThreshold uint64
-	topHitsNumber    int
-	refreshPeriod    time.Duration
+	trafficThreshold         uint64
+	sectionTrafficThresholds map[string]uint64
+	clientTrafficThresholds  clientThresholds
+	serverErrorRateThreshold float64
+	clientErrorRateThreshold float64
+	errorRateMinRequests     int
+	hitsDetector             *ewmaDetector
+	bytesDetector            *ewmaDetector
+	noDataTimeout            time.Duration
+	alertPendingPeriod       time.Duration
+	severities               map[string]RuleSeverityConfig
+	renotifyIntervals        map[Severity]time.Duration
+	topHitsNumber            int
+	refreshPeriod            time.Duration
+	allowedLateness          time.Duration
 
-	// entries from the last 1mn50s, used for calculating the recent traffic
+	// entries of the current window and the ones newer than the watermark, used for calculating the recent traffic
 	recent []*HTTPEntry
-	// previous state of the hits (avoid recalculating everything at every iteration)
-	hits map[string]int
-	// current state of the traffic alert
-	trafficAlert bool
+	// end of the current window, before which entries are expected to have been received
+	watermark time.Time
+	// most frequent sections, paths, clients and user agents since the agent started, counted in bounded memory
+	hits *topKeys
+	// top sections over sliding windows and by decayed score
+	ranking *sectionRanking
+	// alerts that are currently pending or firing
+	alerts map[alertKey]*Alert
+	// history into which alert state changes are recorded
+	history AlertRecorder
+	// notifiers that are notified of alert state changes
+	notifiers []Notifier
+	// sinks to which the statistics of every refresh are sent
+	sinks []MetricsSink
+	// silences and maintenance windows suppressing notifications
+	silences *silenceStore
+	// log file from which entries are read, and position up to which they were read
+	source   string
+	position logPosition
+	// time at which entries were last received
+	lastEntryAt time.Time
+	// time at which entries were last processed
+	refreshedAt time.Time
 	// total number of HTTP entries
 	totalEntries int
 	// entries in the last 2mn
 	recentEntries int
+	// hits and traffic of each section in the last 2mn
+	recentSections map[string]SectionStats
+	// status classes of the entries in the last 2mn, in total and for each section
+	recentStatuses        statusCounts
+	recentSectionStatuses map[string]statusCounts
+	// cumulative counters exported as metrics
+	metrics processorMetrics
 }
 
 // NewLogProcessor returns an instance of LogProcessor using the given configuration values
 func NewLogProcessor(
 	log *zerolog.Logger,
-	topHitsNumber int,
-	trafficThreshold uint64,
-	refreshPeriod time.Duration,
+	report *zerolog.Logger,
+	config Config,
+	history AlertRecorder,
+	notifiers []Notifier,
+	sinks []MetricsSink,
+	silences *silenceStore,
 	now func() time.Time,
 ) *LogProcessor {
-	return &LogProcessor{
-		log:              log,
-		topHitsNumber:    topHitsNumber,
-		trafficThreshold: trafficThreshold,
-		refreshPeriod:    refreshPeriod,
-		hits:             make(map[string]int),
-		now:              now,
+	lp := &LogProcessor{
+		log:                      log,
+		report:                   report,
+		topHitsNumber:            config.TopHitsNumber,
+		trafficThreshold:         config.TrafficThreshold,
+		sectionTrafficThresholds: config.SectionTrafficThresholds,
+		clientTrafficThresholds:  newClientThresholds(log, config.ClientTrafficThresholds),
+		serverErrorRateThreshold: config.ServerErrorRateThreshold,
+		clientErrorRateThreshold: config.ClientErrorRateThreshold,
+		errorRateMinRequests:     config.ErrorRateMinRequests,
+		noDataTimeout:            config.NoDataTimeout.Duration,
+		alertPendingPeriod:       config.AlertPendingPeriod.Duration,
+		severities:               config.Severities,
+		renotifyIntervals:        make(map[Severity]time.Duration),
+		refreshPeriod:            config.RefreshPeriod.Duration,
+		allowedLateness:          config.AllowedLateness.Duration,
+		hits:                     newTopKeys(config.HeavyHitters),
+		ranking:                  newSectionRanking(config.TopWindows, config.TopDecayHalfLife.Duration),
+		alerts:                   make(map[alertKey]*Alert),
+		history:                  history,
+		notifiers:                notifiers,
+		sinks:                    sinks,
+		silences:                 silences,
+		source:                   config.LogFilePath,
+		metrics:                  newProcessorMetrics(config.MetricsMaxSections),
+		now:                      now,
+	}
+
+	for severity, interval := range config.RenotifyIntervals {
+		lp.renotifyIntervals[severity] = interval.Duration
 	}
+
+	if config.Anomaly.Enabled {
+		lp.hitsDetector = newEWMADetector(config.Anomaly.Smoothing, config.Anomaly.Sensitivity, config.Anomaly.Warmup)
+		lp.bytesDetector = newEWMADetector(config.Anomaly.Smoothing, config.Anomaly.Sensitivity, config.Anomaly.Warmup)
+	}
+
+	return lp
 }
 
-// Add adds a new set of entries to the log processor and outputs metrics and alerts on the logger
+// Add adds a new set of entries to the log processor and writes the statistics and alerts to the report
 func (lp *LogProcessor) Add(entries []*HTTPEntry) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.add(entries)
+}
+
+// AddRead adds the entries read from the log file up to the given position. The position is saved with the
+// state, so that the entries are not read again when the agent restarts
+func (lp *LogProcessor) AddRead(entries []*HTTPEntry, position logPosition) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.position = position
+	lp.add(entries)
+}
+
+// LogFilePosition returns the position up to which the entries of the log file were added
+func (lp *LogProcessor) LogFilePosition() logPosition {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	return lp.position
+}
+
+func (lp *LogProcessor) add(entries []*HTTPEntry) {
+	start := time.Now()
 	sortedData := make(map[string][]*HTTPEntry)
 
 	// sort hits by section
 	for _, entry := range entries {
 		sortedData[entry.Section] = append(sortedData[entry.Section], entry)
+		lp.metrics.count(entry)
 	}
 
 	lp.totalEntries += len(entries)
 
-	lp.checkRecentTraffic(entries)
+	window := lp.updateRecent(entries)
+	lp.checkRecentTraffic(window)
+	lp.checkErrorRates(window)
+	lp.checkAnomalies(entries)
+	lp.checkNoData(entries)
 	lp.processMetrics(sortedData)
+
+	lp.metrics.lastProcessing = time.Since(start)
+	lp.metrics.processingDuration += lp.metrics.lastProcessing
+	lp.metrics.processingCount++
+
+	lp.flush(lp.refreshStats(sortedData, lp.metrics.lastProcessing))
 }
 
-// Processes the metrics from the current state of the log processor and the new entries
-func (lp *LogProcessor) processMetrics(sortedData map[string][]*HTTPEntry) {
-	var newHits []hit
-	var topHits []hit
+// Close closes the notifiers and metrics sinks of the log processor, so that the notifications and statistics
+// they queued are sent before the agent stops. Closing gives up after the timeout, so that an unreachable
+// service does not prevent the agent from stopping. Entries added after it is closed are no longer notified
+// nor sent to the sinks
+func (lp *LogProcessor) Close(timeout time.Duration) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
 
-	// create hit structures for newly received data
-	for key, value := range sortedData {
-		newHits = append(newHits, hit{key: key, value: len(value)})
+	// notifiers that are also metrics sinks are only closed once
+	var closers []io.Closer
+	closed := make(map[io.Closer]bool)
+	for _, notifier := range lp.notifiers {
+		if closer, ok := notifier.(io.Closer); ok && !closed[closer] {
+			closers = append(closers, closer)
+			closed[closer] = true
+		}
 	}
-
-	// Add new hits to previous hit state
-	for _, section := range newHits {
-		lp.hits[section.key] += section.value
+	for _, sink := range lp.sinks {
+		if closer, ok := sink.(io.Closer); ok && !closed[closer] {
+			closers = append(closers, closer)
+			closed[closer] = true
+		}
 	}
+	lp.notifiers = nil
+	lp.sinks = nil
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 
-	// calculate top hits for
-	for key, value := range lp.hits {
-		topHits = append(topHits, hit{key: key, value: value})
+		var wg sync.WaitGroup
+		for _, closer := range closers {
+			wg.Add(1)
+			go func(closer io.Closer) {
+				defer wg.Done()
+				if err := closer.Close(); err != nil {
+					lp.log.Error().Err(err).Msg("Could not close notifier or metrics sink")
+				}
+			}(closer)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		lp.log.Warn().Str("timeout", timeout.String()).Msg("Stopped waiting for queued notifications and metrics to be sent")
 	}
+}
 
-	// sort sections by number of hits
-	sort.Slice(topHits, func(i, j int) bool {
-		return topHits[i].value > topHits[j].value
-	})
+// Returns the entries of the 2 minutes before the watermark, which is the time of the refresh minus the allowed
+// lateness. Entries are windowed by their own time rather than by the refresh at which they are read, so entries
+// received out of order are counted in the window they belong to. Entries that are too old to be in the window
+// are dropped, and entries dated after the time of the refresh are clamped to it.
+func (lp *LogProcessor) updateRecent(entries []*HTTPEntry) []*HTTPEntry {
+	lp.refreshedAt = lp.now()
+	lp.watermark = lp.refreshedAt.Add(-lp.allowedLateness)
+	windowStart := lp.watermark.Add(-120 * time.Second)
+
+	dropped, clamped := 0, 0
+	for _, entry := range entries {
+		if entry.Time.After(lp.refreshedAt) {
+			entry.Time = lp.refreshedAt
+			clamped++
+		}
+		if !entry.Time.After(windowStart) {
+			dropped++
+			continue
+		}
+		lp.recent = append(lp.recent, entry)
+	}
+	lp.reportDisorder(dropped, clamped, windowStart)
 
-	for idx, section := range topHits {
-		if idx == lp.topHitsNumber {
-			break
+	// entries newer than the watermark are kept for the next refreshes, until their window is evaluated
+	var window, recent []*HTTPEntry
+	for _, entry := range lp.recent {
+		if !entry.Time.After(windowStart) {
+			continue
+		}
+		recent = append(recent, entry)
+		if !entry.Time.After(lp.watermark) {
+			window = append(window, entry)
 		}
-		// print number of hits and position for each section until
-		// topHitsNumber is reached
-		lp.log.Info().
-			Str("section", section.key).
-			Int("hits", section.value).
+	}
+	lp.recent = recent
+
+	lp.recentEntries = len(window)
+	lp.recentSections = make(map[string]SectionStats)
+	for _, entry := range window {
+		stats := lp.recentSections[entry.Section]
+		stats.Section = entry.Section
+		stats.Hits++
+		stats.Bytes += entry.Size
+		lp.recentSections[entry.Section] = stats
+	}
+
+	return window
+}
+
+// Counts and logs the entries that were dropped because they arrived too late to be in the window, and the
+// entries that were dated in the future, which usually comes from the clock skew of the servers writing logs
+func (lp *LogProcessor) reportDisorder(dropped, clamped int, windowStart time.Time) {
+	lp.metrics.lateEntries += uint64(dropped)
+	lp.metrics.futureEntries += uint64(clamped)
+
+	if dropped > 0 {
+		lp.log.Warn().
+			Int("dropped_entries", dropped).
+			Time("window_start", windowStart).
+			Msg("Dropped entries received too late to be counted in the recent traffic")
+	}
+	if clamped > 0 {
+		lp.log.Warn().
+			Int("clamped_entries", clamped).
+			Time("refreshed_at", lp.refreshedAt).
+			Msg("Clamped entries dated in the future to the time of the refresh")
+	}
+}
+
+// Returns the sections with the most hits over the last 2 minutes
+func (lp *LogProcessor) topRecentSections(n int) []SectionStats {
+	return rankSections(lp.recentSections, n)
+}
+
+// TopSections returns the n sections with the most hits over the last 2 minutes
+func (lp *LogProcessor) TopSections(n int) []SectionStats {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	sections := lp.topRecentSections(n)
+	if sections == nil {
+		sections = []SectionStats{}
+	}
+	return sections
+}
+
+// WindowStats summarizes the traffic over the last 2 minutes
+type WindowStats struct {
+	// time of the last refresh, and end of the window, which is earlier when late entries are allowed
+	Time      time.Time `json:"time"`
+	Watermark time.Time `json:"watermark"`
+	Window    Duration  `json:"window"`
+
+	// entries received over the window, their traffic, and the number of sections they belong to
+	Entries  int    `json:"entries"`
+	Bytes    uint64 `json:"bytes"`
+	Sections int    `json:"sections"`
+
+	// entries received since the agent started, and time at which entries were last received
+	TotalEntries int       `json:"total_entries"`
+	LastEntryAt  time.Time `json:"last_entry_at"`
+
+	// number of alerts that are currently pending or firing
+	ActiveAlerts int `json:"active_alerts"`
+}
+
+// WindowStats returns statistics about the traffic over the last 2 minutes
+func (lp *LogProcessor) WindowStats() WindowStats {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	return WindowStats{
+		Time:         lp.refreshedAt,
+		Watermark:    lp.watermark,
+		Window:       Duration{2 * time.Minute},
+		Entries:      lp.recentEntries,
+		Bytes:        lp.windowBytes(),
+		Sections:     len(lp.recentSections),
+		TotalEntries: lp.totalEntries,
+		LastEntryAt:  lp.lastEntryAt,
+		ActiveAlerts: len(lp.alerts),
+	}
+}
+
+// windowBytes returns the traffic over the last 2 minutes
+func (lp *LogProcessor) windowBytes() uint64 {
+	var bytes uint64
+	for _, stats := range lp.recentSections {
+		bytes += stats.Bytes
+	}
+	return bytes
+}
+
+// Processes the metrics from the current state of the log processor and the new entries
+func (lp *LogProcessor) processMetrics(sortedData map[string][]*HTTPEntry) {
+	if lp.hits == nil {
+		lp.hits = newTopKeys(HeavyHittersConfig{})
+	}
+	lp.hits.add(sortedData)
+
+	// print number of hits and position for each section until topHitsNumber is reached
+	for idx, section := range lp.hits.sections.top(lp.topHitsNumber) {
+		lp.report.Info().
+			Str("section", section.Key).
+			Int("hits", int(section.Count)).
 			Msgf("Top section #%d", idx+1)
+
+		if statuses, ok := lp.recentSectionStatuses[section.Key]; ok {
+			statuses.log(lp.report.Info().Str("section", section.Key)).
+				Msg("Section status codes over the last 2 minutes")
+		}
+	}
+	if lp.ranking != nil {
+		lp.ranking.add(lp.refreshedAt, sortedData)
+		lp.reportRanking()
 	}
-	lp.log.Info().
+
+	lp.report.Info().
 		Int("total_entries", lp.totalEntries).
 		Int("recent_entries", lp.recentEntries).
 		Msg("Statistics")
+	lp.recentStatuses.log(lp.report.Info()).
+		Msg("Status codes over the last 2 minutes")
 }
 
-// Prints a warning if the recent traffic is above the configured threshold, and as long as it is the case
-// Prints an information message when the traffic goes back below the threshold.
-func (lp *LogProcessor) checkRecentTraffic(entries []*HTTPEntry) {
-	lp.recentEntries = 0
+// Prints a warning if the recent traffic is above the configured thresholds, and as long as it is the case
+// Prints an information message when the traffic goes back below the thresholds.
+// The total traffic is checked against the global threshold, while sections and clients are checked against
+// their own thresholds when they have one. The traffic of the clients of a CIDR range is added up and checked
+// against the threshold of the range.
+func (lp *LogProcessor) checkRecentTraffic(window []*HTTPEntry) {
 	recentTraffic := uint64(0)
-
-	// Process data previously set as recent entries
-	for _, entry := range lp.recent {
-		lp.recentEntries++
+	recentClientTraffic := make(map[string]uint64)
+	for _, entry := range window {
 		recentTraffic += entry.Size
+		if client, _, ok := lp.clientTrafficThresholds.lookup(entry.ClientAddress); ok {
+			recentClientTraffic[client] += entry.Size
+		}
 	}
 
-	// A recent entry is younger than 2mn minus the refresh period
-	recentLimit := lp.now().Add(-120*time.Second + lp.refreshPeriod)
+	lp.checkTrafficThreshold(alertSubject{kind: totalSubject}, recentTraffic, lp.trafficThreshold)
 
-	// Process new entries (last refresh)
-	// and store new entries that are within last 1mn50 into recent entries
-	for _, entry := range entries {
-		if entry.Time.After(recentLimit) {
-			lp.recentEntries++
-			recentTraffic += entry.Size
-			lp.recent = append(lp.recent, entry)
+	for section, threshold := range lp.sectionTrafficThresholds {
+		lp.checkTrafficThreshold(alertSubject{kind: sectionSubject, name: section}, lp.recentSections[section].Bytes, threshold)
+	}
+
+	// clients that are currently alerting need to be checked even if they are no longer in the window
+	// so that their alert can be resolved
+	for _, client := range lp.alertingSubjects(trafficRule, clientSubject) {
+		if _, ok := recentClientTraffic[client]; !ok {
+			recentClientTraffic[client] = 0
 		}
 	}
 
-	// Remove outdated entries
-	for i, entry := range lp.recent {
-		if entry.Time.Before(recentLimit) {
-			// this entry is no longer recent enough, remove it
-			lp.recent = append(lp.recent[:i], lp.recent[i+1:]...)
+	for client, traffic := range recentClientTraffic {
+		threshold, ok := lp.clientTrafficThresholds.threshold(client)
+		if !ok {
+			continue
 		}
+		lp.checkTrafficThreshold(alertSubject{kind: clientSubject, name: client}, traffic, threshold)
 	}
+}
 
+// Compares the recent traffic of a subject to its threshold and updates the state of its alert
+func (lp *LogProcessor) checkTrafficThreshold(subject alertSubject, traffic, threshold uint64) {
 	// convert bytes to MB
-	recentTrafficMB := recentTraffic / (1024 * 1024)
-	if recentTrafficMB < lp.trafficThreshold {
-		if lp.trafficAlert {
-			lp.log.Info().
-				Str("recent_traffic", fmt.Sprint(recentTrafficMB, "MB")).
-				Str("threshold", fmt.Sprint(lp.trafficThreshold, "MB")).
-				Msg("Total traffic over the last 2 minutes is back to normal")
-			lp.trafficAlert = false
-		}
-	} else {
-		if lp.trafficAlert {
-			lp.log.Warn().
-				Str("recent_traffic", fmt.Sprint(recentTrafficMB, "MB")).
-				Str("threshold", fmt.Sprint(lp.trafficThreshold, "MB")).
-				Msg("Total traffic over the last 2 minutes still exceeds the configured threshold")
-		} else {
-			lp.log.Warn().
-				Str("recent_traffic", fmt.Sprint(recentTrafficMB, "MB")).
-				Str("threshold", fmt.Sprint(lp.trafficThreshold, "MB")).
-				Msg("Total traffic over the last 2 minutes exceeds the configured threshold")
-			lp.trafficAlert = true
-		}
+	recentTrafficMB := traffic / (1024 * 1024)
+
+	var event *zerolog.Event
+	var message string
+	key := alertKey{rule: trafficRule, subject: subject}
+	switch lp.updateAlert(key, float64(recentTrafficMB), float64(threshold), recentTrafficMB >= threshold) {
+	case alertRaised:
+		event = lp.firingEvent(key)
+		message = "traffic over the last 2 minutes exceeds the configured threshold"
+	case alertOngoing:
+		event = lp.firingEvent(key)
+		message = "traffic over the last 2 minutes still exceeds the configured threshold"
+	case alertResolved:
+		event = lp.report.Info()
+		message = "traffic over the last 2 minutes is back to normal"
+	default:
+		return
+	}
+
+	if subject.kind != totalSubject {
+		event = event.Str(subject.kind, subject.name)
 	}
+	event.
+		Str("recent_traffic", fmt.Sprint(recentTrafficMB, "MB")).
+		Str("threshold", fmt.Sprint(threshold, "MB")).
+		Msgf("%s %s", alertSubjectTitles[subject.kind], message)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -9,7 +10,15 @@ import (
 
 func TestNewLogProessor(t *testing.T) {
 	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
-	lp := NewLogProcessor(log, 3, 1024, time.Second, time.Now)
+	report := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	config := Config{
+		TopHitsNumber:            3,
+		TrafficThreshold:         1024,
+		SectionTrafficThresholds: map[string]uint64{"/downloads": 4096},
+		ClientTrafficThresholds:  map[string]uint64{"10.0.0.0/8": 10},
+		RefreshPeriod:            Duration{time.Second},
+	}
+	lp := NewLogProcessor(log, report, config, nil, nil, nil, nil, time.Now)
 
 	if lp.topHitsNumber != 3 {
 		t.Error("NewLogProcessor doesn't set top hits number properly")
@@ -20,9 +29,18 @@ func TestNewLogProessor(t *testing.T) {
 	if lp.log != log {
 		t.Error("NewLogProcessor doesn't set logger properly")
 	}
+	if lp.report != report {
+		t.Error("NewLogProcessor doesn't set report writer properly")
+	}
 	if lp.refreshPeriod != time.Second {
 		t.Error("NewLogProcessor doesn't set refresh period properly")
 	}
+	if lp.sectionTrafficThresholds["/downloads"] != 4096 {
+		t.Error("NewLogProcessor doesn't set section traffic thresholds properly")
+	}
+	if client, threshold, ok := lp.clientTrafficThresholds.lookup("10.1.2.3"); !ok || client != "10.0.0.0/8" || threshold != 10 {
+		t.Error("NewLogProcessor doesn't set client traffic thresholds properly")
+	}
 }
 
 func TestAddEntries(t *testing.T) {
@@ -81,15 +99,17 @@ func TestAddEntries(t *testing.T) {
 
 	b := []byte{}
 	buffer := bytes.NewBuffer(b)
-	log := NewZeroLog(buffer, JSON)
+	diagnostics := &bytes.Buffer{}
 
 	lp := &LogProcessor{
-		log:              log,
+		log:              NewZeroLog(diagnostics, JSON),
+		report:           NewZeroLog(buffer, JSON),
 		topHitsNumber:    3,
 		trafficThreshold: 1024,
-		hits:             make(map[string]int),
 		refreshPeriod:    10 * time.Second,
-		now:              time.Now,
+		now: func() time.Time {
+			return time.Date(2054, time.May, 17, 18, 54, 40, 0, time.UTC)
+		},
 	}
 
 	entries := []*HTTPEntry{
@@ -113,11 +133,16 @@ func TestAddEntries(t *testing.T) {
 	if !strings.Contains(buffer.String(), `{"level":"info","total_entries":13,"recent_entries":13,"message":"Statistics"}`) {
 		t.Error(`expected log {"level":"info","total_entries":13,"recent_entries":13,"message":"Statistics"}`)
 	}
+
+	// statistics are only written to the report, not to the diagnostics
+	if diagnostics.Len() != 0 {
+		t.Errorf("expected no diagnostics, got %s", diagnostics.String())
+	}
 }
 
 // This test ensures that when the traffic reaches the threshold a message is outputed, and that when it is still the
-// case messages are outputed at every iteration of the refresh period. It also makes sure that when the traffic goes
-// back below the threshold in the last 2 minutes, the alert stops and a message is outputed to indicate that as well
+// case messages are outputed again once the re-notification interval elapsed. It also makes sure that when the traffic
+// goes back below the threshold in the last 2 minutes, the alert stops and a message is outputed to indicate that as well
 func TestAlerting(t *testing.T) {
 	// December 11, 1241 - look it up
 	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
@@ -139,18 +164,16 @@ func TestAlerting(t *testing.T) {
 	buffer := bytes.NewBuffer(b)
 	log := NewZeroLog(buffer, JSON)
 
+	now := baseTime
 	lp := &LogProcessor{
-		log:              log,
-		topHitsNumber:    3,
-		trafficThreshold: 1,
-		refreshPeriod:    10 * time.Millisecond,
-		hits:             make(map[string]int),
+		log:               log,
+		report:            log,
+		topHitsNumber:     3,
+		trafficThreshold:  1,
+		refreshPeriod:     10 * time.Millisecond,
+		renotifyIntervals: map[Severity]time.Duration{SeverityWarning: time.Minute},
 		now: func() time.Time {
-			// first call: entry is 0s old - alert
-			// second call: entry is 1mn30 old - still alert
-			// third call: entry is 3mn old - outdated
-			baseTime = baseTime.Add(90 * time.Second)
-			return baseTime
+			return now
 		},
 	}
 
@@ -158,8 +181,13 @@ func TestAlerting(t *testing.T) {
 		entry1,
 	}
 
+	// first refresh: entry is 0s old - alert
 	lp.Add(entries)
+	// second refresh: entry is 1mn30 old - still alert
+	now = now.Add(90 * time.Second)
 	lp.Add(nil)
+	// third refresh: entry is 3mn old - outdated
+	now = now.Add(90 * time.Second)
 	lp.Add(nil)
 
 	if !strings.Contains(buffer.String(), `{"level":"warn","recent_traffic":"953MB","threshold":"1MB","message":"Total traffic over the last 2 minutes exceeds the configured threshold"}`) {
@@ -174,3 +202,346 @@ func TestAlerting(t *testing.T) {
 		t.Error(`expected log {"level":"warn","recent_traffic":"0MB","threshold":"1MB","message":"Total traffic over the last 2 minutes is back to normal"}`)
 	}
 }
+
+// This test ensures that entries are windowed by their own time: entries newer than the watermark wait for the
+// next refreshes, late entries are counted in the window they belong to or dropped when they are too old, and
+// entries dated in the future are clamped to the time of the refresh
+func TestOutOfOrderEntries(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+
+	diagnostics := &bytes.Buffer{}
+	log := NewZeroLog(diagnostics, JSON)
+	config := DefaultConfig()
+	config.AllowedLateness = Duration{30 * time.Second}
+	config.NoDataTimeout = Duration{}
+	lp := NewLogProcessor(log, NewZeroLog(&bytes.Buffer{}, JSON), config, nil, nil, nil, nil, func() time.Time { return now })
+
+	lp.Add([]*HTTPEntry{
+		{Section: "/pending", Status: 200, Time: baseTime.Add(-10 * time.Second)},
+		{Section: "/window", Status: 200, Time: baseTime.Add(-60 * time.Second)},
+		{Section: "/dropped", Status: 200, Time: baseTime.Add(-200 * time.Second)},
+		{Section: "/future", Status: 200, Time: baseTime.Add(time.Hour)},
+	})
+
+	stats := lp.WindowStats()
+	if stats.Entries != 1 || !stats.Watermark.Equal(baseTime.Add(-30*time.Second)) {
+		t.Errorf("expected only the entry before the watermark to be in the window, got %+v", stats)
+	}
+	for _, expected := range []string{
+		`{"level":"warn","dropped_entries":1,"window_start":"2018-05-08T09:57:30Z","message":"Dropped entries received too late to be counted in the recent traffic"}`,
+		`{"level":"warn","clamped_entries":1,"refreshed_at":"2018-05-08T10:00:00Z","message":"Clamped entries dated in the future to the time of the refresh"}`,
+	} {
+		if !strings.Contains(diagnostics.String(), expected) {
+			t.Errorf("expected log %s, got %s", expected, diagnostics.String())
+		}
+	}
+
+	// the entry received late is still in the window, so it is counted with the ones waiting for the watermark
+	now = now.Add(40 * time.Second)
+	lp.Add([]*HTTPEntry{{Section: "/late", Status: 200, Time: baseTime.Add(-100 * time.Second)}})
+
+	sections := lp.TopSections(10)
+	if len(sections) != 4 {
+		t.Fatalf("expected 4 sections in the window, got %+v", sections)
+	}
+	for _, section := range sections {
+		if section.Section == "/dropped" {
+			t.Errorf("expected the dropped entry not to be in the window, got %+v", sections)
+		}
+	}
+
+	metrics := &bytes.Buffer{}
+	if err := lp.WriteMetrics(metrics); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{"hk_agent_late_entries_dropped_total 1", "hk_agent_future_entries_clamped_total 1", "hk_agent_entries_total 5"} {
+		if !strings.Contains(metrics.String(), expected) {
+			t.Errorf("expected metric %q, got %s", expected, metrics.String())
+		}
+	}
+}
+
+// This test ensures that sections and clients with their own thresholds raise alerts naming them, independently
+// from the total traffic threshold, and that those alerts are resolved once the traffic goes back to normal
+func TestSectionAndClientAlerting(t *testing.T) {
+	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
+	downloadEntry := &HTTPEntry{
+		ClientAddress: "10.0.0.12",
+		Request:       "GET /downloads/big.iso HTTP/1.1",
+		Section:       "/downloads",
+		Status:        200,
+		Size:          3 * 1024 * 1024,
+		Time:          baseTime,
+	}
+	// the clients of a CIDR range exceed its threshold together, while none of them does on its own
+	otherDownloadEntry := &HTTPEntry{
+		ClientAddress: "10.0.0.13",
+		Request:       "GET /downloads/small.iso HTTP/1.1",
+		Section:       "/downloads",
+		Status:        200,
+		Size:          2 * 1024 * 1024,
+		Time:          baseTime,
+	}
+	apiEntry := &HTTPEntry{
+		ClientAddress: "192.168.1.1",
+		Request:       "GET /api/users HTTP/1.1",
+		Section:       "/api",
+		Status:        200,
+		Size:          3 * 1024 * 1024,
+		Time:          baseTime,
+	}
+
+	b := []byte{}
+	buffer := bytes.NewBuffer(b)
+	log := NewZeroLog(buffer, JSON)
+
+	now := baseTime
+	lp := &LogProcessor{
+		log:                      log,
+		report:                   log,
+		topHitsNumber:            3,
+		trafficThreshold:         100,
+		sectionTrafficThresholds: map[string]uint64{"/api": 2, "/downloads": 50},
+		clientTrafficThresholds: newClientThresholds(log, map[string]uint64{
+			"10.0.0.0/8":  100,
+			"10.0.0.0/24": 4,
+		}),
+		refreshPeriod: 10 * time.Millisecond,
+		now:           func() time.Time { return now },
+	}
+
+	// every refresh happens 90 seconds after the previous one
+	refresh := func(entries []*HTTPEntry) {
+		now = now.Add(90 * time.Second)
+		lp.Add(entries)
+	}
+
+	refresh([]*HTTPEntry{downloadEntry, otherDownloadEntry, apiEntry})
+	refresh(nil)
+	refresh(nil)
+
+	expectedLogs := []string{
+		`{"level":"warn","section":"/api","recent_traffic":"3MB","threshold":"2MB","message":"Section traffic over the last 2 minutes exceeds the configured threshold"}`,
+		`{"level":"warn","client":"10.0.0.0/24","recent_traffic":"5MB","threshold":"4MB","message":"Client traffic over the last 2 minutes exceeds the configured threshold"}`,
+		`{"level":"info","section":"/api","recent_traffic":"0MB","threshold":"2MB","message":"Section traffic over the last 2 minutes is back to normal"}`,
+		`{"level":"info","client":"10.0.0.0/24","recent_traffic":"0MB","threshold":"4MB","message":"Client traffic over the last 2 minutes is back to normal"}`,
+	}
+	for _, expected := range expectedLogs {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected log %s", expected)
+		}
+	}
+
+	unexpectedLogs := []string{
+		`"section":"/downloads","recent_traffic"`,
+		`"client":"192.168.1.1","recent_traffic"`,
+		`"client":"10.0.0.12","recent_traffic"`,
+		`"message":"Total traffic over the last 2 minutes exceeds the configured threshold"`,
+		// firing alerts are not reported at every refresh without a re-notification interval
+		`still exceeds`,
+	}
+	for _, unexpected := range unexpectedLogs {
+		if strings.Contains(buffer.String(), unexpected) {
+			t.Errorf("unexpected log containing %s", unexpected)
+		}
+	}
+}
+
+// This test ensures that status classes are counted over the last 2 minutes, and that error rate alerts
+// are raised for the total traffic and for sections once there are enough requests, then resolved
+func TestErrorRateAlerting(t *testing.T) {
+	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
+	newEntry := func(section string, status uint64) *HTTPEntry {
+		return &HTTPEntry{
+			ClientAddress: "::1",
+			Request:       "GET " + section + "/page HTTP/1.1",
+			Section:       section,
+			Status:        status,
+			Size:          1345,
+			Time:          baseTime,
+		}
+	}
+
+	b := []byte{}
+	buffer := bytes.NewBuffer(b)
+	log := NewZeroLog(buffer, JSON)
+
+	now := baseTime
+	lp := &LogProcessor{
+		log:                      log,
+		report:                   log,
+		topHitsNumber:            3,
+		trafficThreshold:         1024,
+		serverErrorRateThreshold: 10,
+		clientErrorRateThreshold: 50,
+		errorRateMinRequests:     4,
+		refreshPeriod:            10 * time.Millisecond,
+		now:                      func() time.Time { return now },
+	}
+
+	// every refresh happens 90 seconds after the previous one
+	refresh := func(entries []*HTTPEntry) {
+		now = now.Add(90 * time.Second)
+		lp.Add(entries)
+	}
+
+	entries := []*HTTPEntry{
+		newEntry("/api", 500), newEntry("/api", 503), newEntry("/api", 200), newEntry("/api", 200),
+		newEntry("/static", 200), newEntry("/static", 304), newEntry("/static", 404),
+		newEntry("/rare", 500),
+	}
+
+	refresh(entries)
+	refresh(nil)
+	refresh(nil)
+
+	expectedLogs := []string{
+		`{"level":"info","1xx":0,"2xx":3,"3xx":1,"4xx":1,"5xx":3,"message":"Status codes over the last 2 minutes"}`,
+		`{"level":"info","section":"/api","1xx":0,"2xx":2,"3xx":0,"4xx":0,"5xx":2,"message":"Section status codes over the last 2 minutes"}`,
+		`{"level":"warn","error_rate":"37.5%","threshold":"10.0%","requests":8,"message":"Total server error rate over the last 2 minutes exceeds the configured threshold"}`,
+		`{"level":"warn","section":"/api","error_rate":"50.0%","threshold":"10.0%","requests":4,"message":"Section server error rate over the last 2 minutes exceeds the configured threshold"}`,
+		`{"level":"info","section":"/api","error_rate":"0.0%","threshold":"10.0%","requests":0,"message":"Section server error rate over the last 2 minutes is back to normal"}`,
+		`{"level":"info","error_rate":"0.0%","threshold":"10.0%","requests":0,"message":"Total server error rate over the last 2 minutes is back to normal"}`,
+	}
+	for _, expected := range expectedLogs {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected log %s", expected)
+		}
+	}
+
+	unexpectedLogs := []string{
+		// not enough requests to consider the error rate of this section
+		`"section":"/rare","error_rate"`,
+		// not enough client errors
+		`client error rate`,
+		// firing alerts are not reported at every refresh without a re-notification interval
+		`still exceeds`,
+	}
+	for _, unexpected := range unexpectedLogs {
+		if strings.Contains(buffer.String(), unexpected) {
+			t.Errorf("unexpected log containing %s", unexpected)
+		}
+	}
+}
+
+// This test ensures that alerts are raised when no entries are received for too long and when the log file
+// can't be read, and that both are resolved automatically
+func TestSourceAlerting(t *testing.T) {
+	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
+
+	b := []byte{}
+	buffer := bytes.NewBuffer(b)
+	log := NewZeroLog(buffer, JSON)
+
+	lp := &LogProcessor{
+		log:              log,
+		report:           log,
+		topHitsNumber:    3,
+		trafficThreshold: 1024,
+		noDataTimeout:    time.Minute,
+		refreshPeriod:    30 * time.Second,
+		severities: map[string]RuleSeverityConfig{
+			logFileRule: {Severity: SeverityCritical},
+		},
+		renotifyIntervals: map[Severity]time.Duration{SeverityCritical: time.Minute},
+		now: func() time.Time {
+			return baseTime
+		},
+	}
+
+	entry := &HTTPEntry{Section: "/", Status: 200, Size: 1345, Time: baseTime}
+
+	lp.Add([]*HTTPEntry{entry})
+	for i := 0; i < 3; i++ {
+		baseTime = baseTime.Add(30 * time.Second)
+		lp.SetLogFileStatus("access.log", os.ErrNotExist)
+		lp.Add(nil)
+	}
+	baseTime = baseTime.Add(30 * time.Second)
+	lp.SetLogFileStatus("access.log", nil)
+	lp.Add([]*HTTPEntry{entry})
+
+	expectedLogs := []string{
+		`{"level":"error","error":"file does not exist","log_file_path":"access.log","message":"Log file is missing or unreadable"}`,
+		`{"level":"error","error":"file does not exist","log_file_path":"access.log","message":"Log file is still missing or unreadable"}`,
+		`{"level":"info","log_file_path":"access.log","message":"Log file is readable again"}`,
+		`{"level":"warn","last_entry_at":"1241-12-11T08:42:24Z","timeout":"1m0s","message":"No new log entries were received for longer than the configured timeout"}`,
+		`{"level":"info","last_entry_at":"1241-12-11T08:44:24Z","timeout":"1m0s","message":"New log entries are received again"}`,
+	}
+	for _, expected := range expectedLogs {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected log %s", expected)
+		}
+	}
+
+	// warnings have no re-notification interval, unlike critical alerts
+	if strings.Contains(buffer.String(), "Still no new log entries received") {
+		t.Error("unexpected log Still no new log entries received")
+	}
+	if strings.Count(buffer.String(), "Log file is still missing or unreadable") != 1 {
+		t.Error("expected log file alert to be reported again once per re-notification interval")
+	}
+}
+
+// closerMock is a notifier and metrics sink recording whether it was closed, and which can block when closed
+type closerMock struct {
+	notifierMock
+	closed  chan struct{}
+	release chan struct{}
+}
+
+func newCloserMock(block bool) *closerMock {
+	m := &closerMock{closed: make(chan struct{})}
+	if block {
+		m.release = make(chan struct{})
+	}
+	return m
+}
+
+func (m *closerMock) Flush(stats RefreshStats) error {
+	return nil
+}
+
+func (m *closerMock) Close() error {
+	if m.release != nil {
+		<-m.release
+	}
+	close(m.closed)
+	return nil
+}
+
+// This test ensures that closing the log processor closes its notifiers and sinks once, routed or not, and
+// that it stops waiting for the ones that block for longer than the timeout
+func TestLogProcessorClose(t *testing.T) {
+	diagnostics := &bytes.Buffer{}
+	log := NewZeroLog(diagnostics, JSON)
+
+	shared := newCloserMock(false)
+	routed := newCloserMock(false)
+	blocked := newCloserMock(true)
+	defer close(blocked.release)
+
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil,
+		[]Notifier{shared, routeSeverities(routed, []Severity{SeverityCritical}), blocked},
+		[]MetricsSink{shared}, nil, time.Now)
+	lp.Close(10 * time.Millisecond)
+
+	// closing a notifier twice would panic
+	for name, closer := range map[string]*closerMock{"shared": shared, "routed": routed} {
+		select {
+		case <-closer.closed:
+		case <-time.After(time.Second):
+			t.Errorf("expected the %s notifier to be closed", name)
+		}
+	}
+	if !strings.Contains(diagnostics.String(), "Stopped waiting for queued notifications and metrics to be sent") {
+		t.Errorf("expected the blocked notifier to be given up on, got %s", diagnostics.String())
+	}
+
+	// entries added while the agent stops are no longer sent to the closed notifiers and sinks
+	lp.Add(nil)
+	if len(lp.notifiers) != 0 || len(lp.sinks) != 0 {
+		t.Errorf("expected the notifiers and sinks to be released, got %d and %d", len(lp.notifiers), len(lp.sinks))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol buffers wire types
+const (
+	protoVarint          = 0
+	protoFixed64         = 1
+	protoLengthDelimited = 2
+)
+
+// protoEncoder encodes protocol buffers messages field by field, which is enough for the few messages
+// sent by the agent without generating code from their definitions
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.buf = appendUvarint(e.buf, uint64(field<<3|wireType))
+}
+
+// Varint encodes an integer, boolean or enum field
+func (e *protoEncoder) Varint(field int, value uint64) {
+	e.tag(field, protoVarint)
+	e.buf = appendUvarint(e.buf, value)
+}
+
+// Fixed64 encodes a fixed64 or sfixed64 field
+func (e *protoEncoder) Fixed64(field int, value uint64) {
+	e.tag(field, protoFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], value)
+	e.buf = append(e.buf, buf[:]...)
+}
+
+// Double encodes a double field
+func (e *protoEncoder) Double(field int, value float64) {
+	e.Fixed64(field, math.Float64bits(value))
+}
+
+// String encodes a string field
+func (e *protoEncoder) String(field int, value string) {
+	e.tag(field, protoLengthDelimited)
+	e.buf = appendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+// Message encodes an embedded message, which is written by the given function
+func (e *protoEncoder) Message(field int, write func(*protoEncoder)) {
+	message := &protoEncoder{}
+	write(message)
+
+	e.tag(field, protoLengthDelimited)
+	e.buf = appendUvarint(e.buf, uint64(len(message.buf)))
+	e.buf = append(e.buf, message.buf...)
+}
+
+// Bytes returns the encoded message
+func (e *protoEncoder) Bytes() []byte {
+	return e.buf
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(buf, varint[:n]...)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastRefreshWindow is the duration of the top window that only covers the entries read at the last refresh
+const lastRefreshWindow = 0
+
+// minDecayedScore is the score below which a section is forgotten by the decayed ranking, so that the number of
+// sections it tracks stays bounded by the sections that were recently hit
+const minDecayedScore = 0.01
+
+// refreshSections is the traffic of every section read at a refresh
+type refreshSections struct {
+	time     time.Time
+	sections map[string]SectionStats
+}
+
+// topWindow counts the traffic of every section over a sliding window of refreshes
+type topWindow struct {
+	duration time.Duration
+	sections map[string]SectionStats
+	// index of the oldest refresh counted in the window
+	start int
+}
+
+// sectionRanking ranks the sections over sliding windows of time, and by a score decaying exponentially with the
+// age of their hits, so that new hot spots are visible next to the all-time ranking
+type sectionRanking struct {
+	windows []*topWindow
+	// refreshes that are still counted in at least one window, from the oldest to the latest
+	refreshes []refreshSections
+
+	// duration after which the weight of a hit in the decayed score is halved. 0 disables the decayed ranking
+	halfLife  time.Duration
+	decayed   map[string]float64
+	decayedAt time.Time
+}
+
+func newSectionRanking(windows []Duration, halfLife time.Duration) *sectionRanking {
+	ranking := &sectionRanking{
+		halfLife: halfLife,
+		decayed:  make(map[string]float64),
+	}
+	for _, window := range windows {
+		ranking.windows = append(ranking.windows, &topWindow{
+			duration: window.Duration,
+			sections: make(map[string]SectionStats),
+		})
+	}
+	return ranking
+}
+
+// add counts the entries read at a refresh, sorted by section
+func (r *sectionRanking) add(now time.Time, sortedData map[string][]*HTTPEntry) {
+	current := make(map[string]SectionStats, len(sortedData))
+	for section, entries := range sortedData {
+		stats := SectionStats{Section: section, Hits: len(entries)}
+		for _, entry := range entries {
+			stats.Bytes += entry.Size
+		}
+		current[section] = stats
+	}
+
+	r.refreshes = append(r.refreshes, refreshSections{time: now, sections: current})
+	last := len(r.refreshes) - 1
+
+	oldest := last
+	for _, window := range r.windows {
+		addSections(window.sections, current, 1)
+
+		// refreshes that are older than the window are no longer counted in it
+		for window.start < last && (window.duration == lastRefreshWindow || !r.refreshes[window.start].time.After(now.Add(-window.duration))) {
+			addSections(window.sections, r.refreshes[window.start].sections, -1)
+			window.start++
+		}
+
+		if window.start < oldest {
+			oldest = window.start
+		}
+	}
+
+	// refreshes that are no longer counted in any window are forgotten
+	if oldest > 0 {
+		r.refreshes = append(r.refreshes[:0], r.refreshes[oldest:]...)
+		for _, window := range r.windows {
+			window.start -= oldest
+		}
+	}
+
+	r.decay(now, current)
+}
+
+// decay decays the scores of the sections by the time elapsed since the last refresh, and adds the hits of the
+// current refresh to them
+func (r *sectionRanking) decay(now time.Time, current map[string]SectionStats) {
+	if r.halfLife <= 0 {
+		return
+	}
+
+	if !r.decayedAt.IsZero() {
+		factor := math.Pow(0.5, now.Sub(r.decayedAt).Seconds()/r.halfLife.Seconds())
+		for section, score := range r.decayed {
+			score *= factor
+			if score < minDecayedScore {
+				delete(r.decayed, section)
+				continue
+			}
+			r.decayed[section] = score
+		}
+	}
+	r.decayedAt = now
+
+	for section, stats := range current {
+		r.decayed[section] += float64(stats.Hits)
+	}
+}
+
+// top returns the n sections with the most hits over a window, and whether this window is ranked
+func (r *sectionRanking) top(window time.Duration, n int) ([]SectionStats, bool) {
+	for _, w := range r.windows {
+		if w.duration == window {
+			return rankSections(w.sections, n), true
+		}
+	}
+	return nil, false
+}
+
+// topDecayed returns the n sections with the highest decayed scores
+func (r *sectionRanking) topDecayed(n int) []SectionStats {
+	var sections []SectionStats
+	for section, score := range r.decayed {
+		sections = append(sections, SectionStats{Section: section, Score: score})
+	}
+
+	sort.Slice(sections, func(i, j int) bool {
+		if sections[i].Score == sections[j].Score {
+			return sections[i].Section < sections[j].Section
+		}
+		return sections[i].Score > sections[j].Score
+	})
+
+	if len(sections) > n {
+		sections = sections[:n]
+	}
+	return sections
+}
+
+// addSections adds or, with a sign of -1, subtracts the traffic of sections from a set of sections. Sections
+// without any hit left are removed
+func addSections(sections, other map[string]SectionStats, sign int) {
+	for section, stats := range other {
+		total := sections[section]
+		total.Section = section
+		total.Hits += sign * stats.Hits
+		if sign > 0 {
+			total.Bytes += stats.Bytes
+		} else {
+			total.Bytes -= stats.Bytes
+		}
+
+		if total.Hits <= 0 {
+			delete(sections, section)
+			continue
+		}
+		sections[section] = total
+	}
+}
+
+// rankSections returns the n sections with the most hits, sorted by name when they have as many hits
+func rankSections(stats map[string]SectionStats, n int) []SectionStats {
+	var sections []SectionStats
+	for _, s := range stats {
+		sections = append(sections, s)
+	}
+
+	sort.Slice(sections, func(i, j int) bool {
+		if sections[i].Hits == sections[j].Hits {
+			return sections[i].Section < sections[j].Section
+		}
+		return sections[i].Hits > sections[j].Hits
+	})
+
+	if len(sections) > n {
+		sections = sections[:n]
+	}
+	return sections
+}
+
+// windowName returns the name of a top window, such as "last refresh" or "last 5m"
+func windowName(window time.Duration) string {
+	if window == lastRefreshWindow {
+		return "last refresh"
+	}
+
+	name := window.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return "last " + name
+}
+
+// reportRanking writes the top sections of every window, and the top decayed sections
+func (lp *LogProcessor) reportRanking() {
+	for _, window := range lp.ranking.windows {
+		name := windowName(window.duration)
+		for idx, section := range rankSections(window.sections, lp.topHitsNumber) {
+			lp.report.Info().
+				Str("window", name).
+				Str("section", section.Section).
+				Int("hits", section.Hits).
+				Msgf("Top section #%d over the %s", idx+1, name)
+		}
+	}
+
+	if lp.ranking.halfLife > 0 {
+		for idx, section := range lp.ranking.topDecayed(lp.topHitsNumber) {
+			lp.report.Info().
+				Str("section", section.Section).
+				Str("score", fmt.Sprintf("%.2f", section.Score)).
+				Msgf("Top decayed section #%d", idx+1)
+		}
+	}
+}
+
+// RankedSections returns the n sections with the most hits over a window, which is "all" for the hits since the
+// agent started, "decayed" for the decayed scores, "refresh" for the last refresh, or the duration of one of the
+// configured top windows
+func (lp *LogProcessor) RankedSections(window string, n int) ([]SectionStats, error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	var sections []SectionStats
+	switch window {
+	case "all":
+		if lp.hits != nil {
+			for _, hitter := range lp.hits.sections.top(n) {
+				sections = append(sections, SectionStats{Section: hitter.Key, Hits: int(hitter.Count)})
+			}
+		}
+	case "decayed":
+		if lp.ranking == nil || lp.ranking.halfLife <= 0 {
+			return nil, fmt.Errorf("decayed ranking is disabled")
+		}
+		sections = lp.ranking.topDecayed(n)
+	default:
+		duration := time.Duration(lastRefreshWindow)
+		if window != "refresh" {
+			var err error
+			duration, err = time.ParseDuration(window)
+			if err != nil {
+				return nil, fmt.Errorf("invalid window %q", window)
+			}
+		}
+
+		var ok bool
+		if lp.ranking != nil {
+			sections, ok = lp.ranking.top(duration, n)
+		}
+		if !ok {
+			return nil, fmt.Errorf("window %q is not ranked", window)
+		}
+	}
+
+	if sections == nil {
+		sections = []SectionStats{}
+	}
+	return sections, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowName(t *testing.T) {
+	tests := map[time.Duration]string{
+		lastRefreshWindow: "last refresh",
+		30 * time.Second:  "last 30s",
+		5 * time.Minute:   "last 5m",
+		time.Hour:         "last 1h",
+		90 * time.Minute:  "last 1h30m",
+		24 * time.Hour:    "last 24h",
+	}
+
+	for window, expected := range tests {
+		if name := windowName(window); name != expected {
+			t.Errorf("expected window %v to be named %q, got %q", window, expected, name)
+		}
+	}
+}
+
+// This test ensures that the sections are ranked over sliding windows and by decayed score, so that recent hot
+// spots show up while the all-time ranking is still dominated by older traffic
+func TestSectionRanking(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+
+	report := &bytes.Buffer{}
+	config := DefaultConfig()
+	config.TopHitsNumber = 2
+	config.TopWindows = []Duration{{lastRefreshWindow}, {time.Minute}}
+	config.TopDecayHalfLife = Duration{10 * time.Second}
+	config.NoDataTimeout = Duration{}
+	lp := NewLogProcessor(NewZeroLog(&bytes.Buffer{}, JSON), NewZeroLog(report, JSON), config, nil, nil, nil, nil, func() time.Time { return now })
+
+	entries := func(section string, n int) []*HTTPEntry {
+		var entries []*HTTPEntry
+		for i := 0; i < n; i++ {
+			entries = append(entries, &HTTPEntry{Section: section, Status: 200, Size: 100, Time: now})
+		}
+		return entries
+	}
+
+	lp.Add(entries("/a", 5))
+	now = baseTime.Add(30 * time.Second)
+	lp.Add(entries("/b", 2))
+	now = baseTime.Add(70 * time.Second)
+	report.Reset()
+	lp.Add(entries("/c", 1))
+
+	tests := []struct {
+		window   string
+		expected []string
+	}{
+		{"all", []string{"/a", "/b"}},
+		{"refresh", []string{"/c"}},
+		{"1m", []string{"/b", "/c"}},
+		{"decayed", []string{"/c", "/b"}},
+	}
+	for _, test := range tests {
+		sections, err := lp.RankedSections(test.window, 2)
+		if err != nil {
+			t.Errorf("unexpected error for window %s: %v", test.window, err)
+			continue
+		}
+
+		var names []string
+		for _, section := range sections {
+			names = append(names, section.Section)
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("expected top sections %v over window %s, got %+v", test.expected, test.window, sections)
+		}
+	}
+
+	if sections, _ := lp.RankedSections("1m", 1); sections[0].Hits != 2 || sections[0].Bytes != 200 {
+		t.Errorf("expected the traffic of the window to be counted, got %+v", sections)
+	}
+
+	for _, window := range []string{"5m", "forever"} {
+		if _, err := lp.RankedSections(window, 2); err == nil {
+			t.Errorf("expected window %s to be refused", window)
+		}
+	}
+
+	for _, expected := range []string{
+		`{"level":"info","section":"/a","hits":5,"message":"Top section #1"}`,
+		`{"level":"info","window":"last refresh","section":"/c","hits":1,"message":"Top section #1 over the last refresh"}`,
+		`{"level":"info","window":"last 1m","section":"/b","hits":2,"message":"Top section #1 over the last 1m"}`,
+		`{"level":"info","section":"/c","score":"1.00","message":"Top decayed section #1"}`,
+		`{"level":"info","section":"/b","score":"0.12","message":"Top decayed section #2"}`,
+	} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("expected log %s, got %s", expected, report.String())
+		}
+	}
+
+	// the first refresh is no longer counted in any window
+	if len(lp.ranking.refreshes) != 2 {
+		t.Errorf("expected only the refreshes of the longest window to be kept, got %d", len(lp.ranking.refreshes))
+	}
+}
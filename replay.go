@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ullaakut/gonx"
+)
+
+// replayClock is the clock of the log processor when archived logs are replayed. It follows the timestamps
+// of the replayed entries instead of the current time
+type replayClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the current time of the replay
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Set sets the current time of the replay
+func (c *replayClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// replayer feeds entries to a log processor at every refresh period, as if they were read from the log file
+// at the time they were written. The clock starts at the time of the first entry, and is moved forward by
+// a refresh period at every refresh, so that the alerts raised by the live agent are reproduced exactly
+type replayer struct {
+	processor *LogProcessor
+	clock     *replayClock
+	period    time.Duration
+
+	// number of times faster than real time the refreshes happen. 0 replays the entries as fast as possible
+	speed float64
+	sleep func(time.Duration)
+}
+
+// Run replays the entries received until the channel is closed. Entries are expected to be in chronological
+// order; entries older than the clock are added at the next refresh
+func (r *replayer) Run(entries <-chan *HTTPEntry) {
+	next, ok := <-entries
+	if !ok {
+		return
+	}
+	r.clock.Set(next.Time)
+
+	for {
+		// entries are read at the first refresh following them
+		now := r.clock.Now()
+		batch := []*HTTPEntry{}
+		for ok && !next.Time.After(now) {
+			batch = append(batch, next)
+			next, ok = <-entries
+		}
+
+		r.processor.Add(batch)
+		if !ok {
+			return
+		}
+
+		if r.speed > 0 {
+			r.sleep(time.Duration(float64(r.period) / r.speed))
+		}
+		r.clock.Set(now.Add(r.period))
+	}
+}
+
+// isolate disables the notifiers, the alert history and the metrics sinks of a configuration when old logs are
+// replayed, unless the replay is configured to use them, so that past alerts do not page anyone nor end up in
+// the live history, and old traffic does not end up in the live metrics. What is disabled is logged
+func (rc ReplayConfig) isolate(log *zerolog.Logger, config Config) Config {
+	if !rc.Notify && (len(config.Webhooks) > 0 || len(config.Emails) > 0 || len(config.Commands) > 0 || config.OTLP.Endpoint != "") {
+		log.Warn().
+			Int("webhooks", len(config.Webhooks)).
+			Int("emails", len(config.Emails)).
+			Int("commands", len(config.Commands)).
+			Str("otlp_endpoint", config.OTLP.Endpoint).
+			Msg("Alerts of the replay are not notified, set replay.notify to send them")
+		config.Webhooks = nil
+		config.Emails = nil
+		config.Commands = nil
+		config.OTLP.Endpoint = ""
+	}
+
+	if !rc.RecordHistory && config.AlertHistoryPath != "" {
+		log.Warn().
+			Str("alert_history_path", config.AlertHistoryPath).
+			Msg("Alerts of the replay are not recorded into the alert history, set replay.record_history to record them")
+		config.AlertHistoryPath = ""
+	}
+
+	if !rc.RecordMetrics && (config.Rollups.Path != "" || config.Export.Path != "" || config.StatsD.Address != "" || config.MetricsAddress != "" || config.OTLP.Endpoint != "") {
+		log.Warn().
+			Str("rollups_path", config.Rollups.Path).
+			Str("export_path", config.Export.Path).
+			Str("statsd_address", config.StatsD.Address).
+			Str("metrics_address", config.MetricsAddress).
+			Str("otlp_endpoint", config.OTLP.Endpoint).
+			Msg("Metrics of the replay are not exported, set replay.record_metrics to export them")
+		config.Rollups.Path = ""
+		config.Export.Path = ""
+		config.StatsD.Address = ""
+		config.MetricsAddress = ""
+	}
+
+	return config
+}
+
+// exportsMetrics returns whether the metrics of the agent are exported, which they are not when old logs are
+// replayed unless the replay is configured to. The OpenTelemetry collector can still receive the alerts of the
+// replay without its metrics
+func (rc ReplayConfig) exportsMetrics() bool {
+	return !rc.Enabled || rc.RecordMetrics
+}
+
+// replayLogs replays the log file specified in the configuration, with a log processor using the clock
+// of the replay
+func replayLogs(log *zerolog.Logger, config Config, logProcessor *LogProcessor, clock *replayClock) {
+	parser := gonx.NewParser(logFormats[config.LogFormat])
+
+	entries := make(chan *HTTPEntry, 1024)
+	go func() {
+		defer close(entries)
+
+		err := readLogFile(config.LogFilePath, func(line string) {
+			if line == "" {
+				return
+			}
+
+			entry, err := parser.ParseString(line)
+			if err != nil {
+				logProcessor.RecordLines(1, 1)
+				log.Error().Err(err).Msg("Could not parse string")
+				return
+			}
+			logProcessor.RecordLines(1, 0)
+			entries <- NewHTTPEntry(log, entry)
+		})
+		logProcessor.SetLogFileStatus(config.LogFilePath, err)
+		if err != nil {
+			log.Error().Err(err).Str("log_file_path", config.LogFilePath).Msg("Could not read log file")
+		}
+	}()
+
+	replay := &replayer{
+		processor: logProcessor,
+		clock:     clock,
+		period:    config.RefreshPeriod.Duration,
+		speed:     config.Replay.Speed,
+		sleep:     time.Sleep,
+	}
+	replay.Run(entries)
+
+	log.Info().Time("replay_time", clock.Now()).Msg("Replay finished")
+}
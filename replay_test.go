@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test ensures that replayed entries are processed at the refreshes following their timestamps, and
+// that the refreshes are accelerated by the replay speed
+func TestReplayer(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 2
+	config.NoDataTimeout = Duration{}
+
+	collector := &alertCollector{}
+	clock := &replayClock{}
+	lp := NewLogProcessor(log, log, config, collector, nil, nil, nil, clock.Now)
+
+	var refreshes []time.Time
+	var sleeps []time.Duration
+	replay := &replayer{
+		processor: lp,
+		clock:     clock,
+		period:    10 * time.Second,
+		speed:     4,
+		sleep: func(d time.Duration) {
+			refreshes = append(refreshes, clock.Now())
+			sleeps = append(sleeps, d)
+		},
+	}
+
+	// 2MB are received in 10s, and the last entry is older than the one before it
+	entries := make(chan *HTTPEntry, 4)
+	entries <- &HTTPEntry{Section: "/a", Size: 1024 * 1024, Status: 200, Time: baseTime}
+	entries <- &HTTPEntry{Section: "/a", Size: 1024 * 1024, Status: 200, Time: baseTime.Add(5 * time.Second)}
+	entries <- &HTTPEntry{Section: "/a", Size: 10, Status: 200, Time: baseTime.Add(25 * time.Second)}
+	entries <- &HTTPEntry{Section: "/b", Size: 10, Status: 200, Time: baseTime.Add(15 * time.Second)}
+	close(entries)
+
+	replay.Run(entries)
+
+	expected := []time.Time{baseTime, baseTime.Add(10 * time.Second), baseTime.Add(20 * time.Second)}
+	if len(refreshes) != len(expected) {
+		t.Fatalf("expected refreshes at %v, got %v", expected, refreshes)
+	}
+	for i := range expected {
+		if !refreshes[i].Equal(expected[i]) {
+			t.Errorf("expected refresh %d at %v, got %v", i, expected[i], refreshes[i])
+		}
+		if sleeps[i] != 2500*time.Millisecond {
+			t.Errorf("expected refresh %d to wait 2.5s, got %v", i, sleeps[i])
+		}
+	}
+	if !clock.Now().Equal(baseTime.Add(30 * time.Second)) {
+		t.Errorf("expected the replay to end at the refresh following the last entry, got %v", clock.Now())
+	}
+
+	if len(collector.alerts) != 1 || collector.alerts[0].State != AlertFiring || !collector.alerts[0].Time.Equal(baseTime.Add(10*time.Second)) {
+		t.Errorf("expected the traffic alert to fire at the time of the replay, got %+v", collector.alerts)
+	}
+
+	lp.mu.Lock()
+	total := lp.totalEntries
+	lp.mu.Unlock()
+	if total != 4 {
+		t.Errorf("expected all entries to be processed, got %d", total)
+	}
+}
+
+// This test ensures that replaying old logs does not notify anyone nor record into the alert history, unless
+// the replay is configured to
+func TestReplayIsolate(t *testing.T) {
+	config := DefaultConfig()
+	config.Webhooks = []WebhookConfig{{URL: "http://localhost/hook"}}
+	config.Commands = []CommandConfig{{Command: "page"}}
+	config.OTLP.Endpoint = "http://localhost:4318"
+	config.AlertHistoryPath = "alert_history.jsonl"
+
+	buffer := &bytes.Buffer{}
+	isolated := ReplayConfig{Enabled: true}.isolate(NewZeroLog(buffer, JSON), config)
+	if len(isolated.Webhooks) != 0 || len(isolated.Commands) != 0 || isolated.OTLP.Endpoint != "" || isolated.AlertHistoryPath != "" {
+		t.Errorf("expected the notifiers and the alert history to be disabled, got %+v", isolated)
+	}
+	for _, expected := range []string{
+		`{"level":"warn","webhooks":1,"emails":0,"commands":1,"otlp_endpoint":"http://localhost:4318","message":"Alerts of the replay are not notified, set replay.notify to send them"}`,
+		`{"level":"warn","alert_history_path":"alert_history.jsonl","message":"Alerts of the replay are not recorded into the alert history, set replay.record_history to record them"}`,
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected log %s, got %s", expected, buffer.String())
+		}
+	}
+
+	kept := ReplayConfig{Enabled: true, Notify: true, RecordHistory: true}.isolate(NewZeroLog(ioutil.Discard, JSON), config)
+	if len(kept.Webhooks) != 1 || len(kept.Commands) != 1 || kept.OTLP.Endpoint == "" || kept.AlertHistoryPath == "" {
+		t.Errorf("expected the notifiers and the alert history to be kept when asked to, got %+v", kept)
+	}
+}
+
+// This test ensures that the metrics of a replay are not exported into the rollups, the export files, StatsD,
+// Prometheus and the OpenTelemetry collector, unless the replay is configured to export them
+func TestReplayIsolateMetrics(t *testing.T) {
+	config := DefaultConfig()
+	config.Rollups.Path = "rollups"
+	config.Export.Path = "export.jsonl"
+	config.StatsD.Address = "localhost:8125"
+	config.MetricsAddress = ":9102"
+	config.OTLP.Endpoint = "http://localhost:4318"
+
+	buffer := &bytes.Buffer{}
+	replay := ReplayConfig{Enabled: true, Notify: true}
+	isolated := replay.isolate(NewZeroLog(buffer, JSON), config)
+	if isolated.Rollups.Path != "" || isolated.Export.Path != "" || isolated.StatsD.Address != "" || isolated.MetricsAddress != "" {
+		t.Errorf("expected the metrics sinks to be disabled, got %+v", isolated)
+	}
+	if isolated.OTLP.Endpoint == "" || replay.exportsMetrics() {
+		t.Errorf("expected the OTLP exporter to only send the alerts, got %+v", isolated.OTLP)
+	}
+	expected := `{"level":"warn","rollups_path":"rollups","export_path":"export.jsonl","statsd_address":"localhost:8125","metrics_address":":9102","otlp_endpoint":"http://localhost:4318","message":"Metrics of the replay are not exported, set replay.record_metrics to export them"}`
+	if !strings.Contains(buffer.String(), expected) {
+		t.Errorf("expected log %s, got %s", expected, buffer.String())
+	}
+
+	replay.RecordMetrics = true
+	kept := replay.isolate(NewZeroLog(ioutil.Discard, JSON), config)
+	if kept.Rollups.Path == "" || kept.Export.Path == "" || kept.StatsD.Address == "" || kept.MetricsAddress == "" || !replay.exportsMetrics() {
+		t.Errorf("expected the metrics sinks to be kept when asked to, got %+v", kept)
+	}
+	if !(ReplayConfig{}).exportsMetrics() {
+		t.Error("expected the metrics to be exported when no log is replayed")
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// rollupResolution is a resolution at which the traffic is rolled up. The rollups of a resolution are stored
+// in files covering a fixed period, such as a day for the minute rollups
+type rollupResolution struct {
+	name     string
+	duration time.Duration
+	// layout of the date in the names of the files, and number of years, months and days covered by a file
+	layout              string
+	years, months, days int
+}
+
+// rollupResolutions are the resolutions of the rollups, from the finest to the coarsest. Every resolution is
+// downsampled from the previous one
+var rollupResolutions = []rollupResolution{
+	{name: "minute", duration: time.Minute, layout: "2006-01-02", days: 1},
+	{name: "hour", duration: time.Hour, layout: "2006-01", months: 1},
+	{name: "day", duration: 24 * time.Hour, layout: "2006", years: 1},
+}
+
+// path returns the path to the file containing the rollup starting at the given time
+func (res rollupResolution) path(dir string, t time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", res.name, t.Format(res.layout)))
+}
+
+// files returns the paths to the files of the resolution in a directory, along with the start and the end
+// of the period they cover
+func (res rollupResolution) files(dir string) (map[string][2]time.Time, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, res.name+"-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][2]time.Time)
+	for _, path := range paths {
+		date := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), res.name+"-"), ".jsonl")
+		start, err := time.Parse(res.layout, date)
+		if err != nil {
+			continue
+		}
+		files[path] = [2]time.Time{start, start.AddDate(res.years, res.months, res.days)}
+	}
+	return files, nil
+}
+
+// rollup aggregates the traffic received during a minute, an hour or a day, in total and for each section
+type rollup struct {
+	Time     time.Time                `json:"time"`
+	Hits     int                      `json:"hits"`
+	Bytes    uint64                   `json:"bytes"`
+	Statuses statusCounts             `json:"statuses"`
+	Sections map[string]*rollupCounts `json:"sections"`
+}
+
+// rollupCounts aggregates the traffic of a section
+type rollupCounts struct {
+	Hits     int          `json:"hits"`
+	Bytes    uint64       `json:"bytes"`
+	Statuses statusCounts `json:"statuses"`
+}
+
+func newRollup(t time.Time) *rollup {
+	return &rollup{Time: t, Sections: make(map[string]*rollupCounts)}
+}
+
+// add adds the traffic of a section to the rollup
+func (r *rollup) add(section string, hits int, bytes uint64, statuses statusCounts) {
+	counts, ok := r.Sections[section]
+	if !ok {
+		counts = &rollupCounts{}
+		r.Sections[section] = counts
+	}
+
+	r.Hits += hits
+	r.Bytes += bytes
+	counts.Hits += hits
+	counts.Bytes += bytes
+	for class := range statuses {
+		r.Statuses[class] += statuses[class]
+		counts.Statuses[class] += statuses[class]
+	}
+}
+
+// merge adds the traffic of another rollup to the rollup
+func (r *rollup) merge(other *rollup) {
+	for section, counts := range other.Sections {
+		r.add(section, counts.Hits, counts.Bytes, counts.Statuses)
+	}
+}
+
+// rollupStore rolls up the traffic by the minute of the entries into files of a directory. A minute is written
+// once the watermark of a refresh is past it, so that the entries received out of order within the allowed
+// lateness are counted in their own minute. Once an hour or a day is over, its minute or hourly rollups are
+// downsampled into an hourly or daily rollup, and the files that are older than the retention of their
+// resolution are removed. Rollups are aligned on UTC.
+type rollupStore struct {
+	config RollupConfig
+	// rollups of the minutes that are not over yet
+	pending map[time.Time]*rollup
+	// time before which the minutes were written
+	completed time.Time
+	// start of the hours and days that were rolled up at a finer resolution, and still need to be downsampled
+	// once they are over, by index in the resolutions
+	downsample []map[time.Time]bool
+}
+
+// newRollupStore creates a rollup store writing to the configured directory. The hours and days whose finer
+// rollups were written but not downsampled, for example because the agent stopped before they were over, are
+// downsampled at the first refresh after which they are over
+func newRollupStore(config RollupConfig) (*rollupStore, error) {
+	err := os.MkdirAll(config.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &rollupStore{
+		config:     config,
+		pending:    make(map[time.Time]*rollup),
+		downsample: make([]map[time.Time]bool, len(rollupResolutions)),
+	}
+	for i := 1; i < len(rollupResolutions); i++ {
+		store.downsample[i] = make(map[time.Time]bool)
+
+		finer, err := readRollups(config.Path, rollupResolutions[i-1], time.Time{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		coarser, err := readRollups(config.Path, rollupResolutions[i], time.Time{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range finer {
+			store.downsample[i][r.Time.Truncate(rollupResolutions[i].duration)] = true
+		}
+		for _, r := range coarser {
+			delete(store.downsample[i], r.Time)
+		}
+	}
+	return store, nil
+}
+
+// Flush adds the entries received at a refresh to the rollups of their minutes, and writes the minutes that
+// are over
+func (s *rollupStore) Flush(stats RefreshStats) error {
+	for minute, sections := range stats.Minutes {
+		r, ok := s.pending[minute]
+		if !ok {
+			r = newRollup(minute)
+			s.pending[minute] = r
+		}
+		for section, sectionStats := range sections {
+			r.add(section, sectionStats.Hits, sectionStats.Bytes, sectionStats.Statuses)
+		}
+	}
+
+	watermark := stats.Watermark
+	if watermark.IsZero() {
+		watermark = stats.Time
+	}
+	return s.complete(watermark.UTC().Truncate(time.Minute))
+}
+
+// Close writes the rollups of the minutes that are not over yet, so that their traffic is not lost when the
+// agent stops. Entries of the same minute received after a restart are written as another rollup of the
+// minute, which is merged with it when reading
+func (s *rollupStore) Close() error {
+	return s.writeMinutes(time.Time{})
+}
+
+// complete writes the minutes before the given time, downsamples the hours and the days that are over, and
+// removes the files that are past their retention at the start of every day
+func (s *rollupStore) complete(end time.Time) error {
+	if !end.After(s.completed) {
+		return nil
+	}
+	err := s.writeMinutes(end)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i < len(rollupResolutions); i++ {
+		res := rollupResolutions[i]
+		var starts []time.Time
+		for start := range s.downsample[i] {
+			if !start.Add(res.duration).After(end) {
+				starts = append(starts, start)
+			}
+		}
+		sort.Slice(starts, func(a, b int) bool {
+			return starts[a].Before(starts[b])
+		})
+
+		for _, start := range starts {
+			// a period that was over before the last refresh was downsampled already, unless it had no traffic
+			// then, and entries received after it are only kept at the finer resolution
+			if !start.Add(res.duration).After(s.completed) && !s.completed.IsZero() {
+				existing, err := readRollups(s.config.Path, res, start, start.Add(res.duration))
+				if err != nil {
+					return err
+				}
+				if len(existing) > 0 {
+					delete(s.downsample[i], start)
+					continue
+				}
+			}
+
+			finer, err := readRollups(s.config.Path, rollupResolutions[i-1], start, start.Add(res.duration))
+			if err != nil {
+				return err
+			}
+
+			downsampled := newRollup(start)
+			for _, r := range finer {
+				downsampled.merge(r)
+			}
+			err = s.write(res, downsampled)
+			if err != nil {
+				return err
+			}
+			delete(s.downsample[i], start)
+			if i+1 < len(rollupResolutions) {
+				s.downsample[i+1][start.Truncate(rollupResolutions[i+1].duration)] = true
+			}
+		}
+	}
+
+	previous := s.completed
+	s.completed = end
+	if previous.IsZero() || end.Truncate(24*time.Hour).After(previous) {
+		return s.prune(end)
+	}
+	return nil
+}
+
+// writeMinutes writes the rollups of the pending minutes before the given time, or of all of them if it is zero,
+// sorted by time, and marks their hours to be downsampled
+func (s *rollupStore) writeMinutes(end time.Time) error {
+	var minutes []time.Time
+	for minute := range s.pending {
+		if end.IsZero() || minute.Before(end) {
+			minutes = append(minutes, minute)
+		}
+	}
+	sort.Slice(minutes, func(i, j int) bool {
+		return minutes[i].Before(minutes[j])
+	})
+
+	for _, minute := range minutes {
+		err := s.write(rollupResolutions[0], s.pending[minute])
+		if err != nil {
+			return err
+		}
+		delete(s.pending, minute)
+		s.downsample[1][minute.Truncate(time.Hour)] = true
+	}
+	return nil
+}
+
+// write appends a rollup to the file of its resolution
+func (s *rollupStore) write(res rollupResolution, r *rollup) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(res.path(s.config.Path, r.Time), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// prune removes the files that only contain rollups older than the retention of their resolution
+func (s *rollupStore) prune(now time.Time) error {
+	for _, res := range rollupResolutions {
+		retention := s.config.retention(res.name)
+		if retention <= 0 {
+			continue
+		}
+
+		files, err := res.files(s.config.Path)
+		if err != nil {
+			return err
+		}
+		for path, period := range files {
+			if !period[1].After(now.Add(-retention)) {
+				err := os.Remove(path)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// retention returns the duration for which the rollups of a resolution are kept, 0 meaning forever
+func (rc RollupConfig) retention(resolution string) time.Duration {
+	switch resolution {
+	case "minute":
+		return rc.MinuteRetention.Duration
+	case "hour":
+		return rc.HourRetention.Duration
+	default:
+		return rc.DayRetention.Duration
+	}
+}
+
+// readRollups reads the rollups of a resolution starting within a time range, sorted by time. A zero time
+// does not bound the range
+func readRollups(dir string, res rollupResolution, from, to time.Time) ([]*rollup, error) {
+	files, err := res.files(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollups []*rollup
+	for path, period := range files {
+		if (!to.IsZero() && !period[0].Before(to)) || (!from.IsZero() && !period[1].After(from)) {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			r := newRollup(time.Time{})
+			err = json.Unmarshal(scanner.Bytes(), r)
+			if err != nil {
+				break
+			}
+			if (from.IsZero() || !r.Time.Before(from)) && (to.IsZero() || r.Time.Before(to)) {
+				rollups = append(rollups, r)
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", path, err)
+		}
+	}
+
+	sort.SliceStable(rollups, func(i, j int) bool {
+		return rollups[i].Time.Before(rollups[j].Time)
+	})
+	return rollups, nil
+}
+
+// RollupQuery is the traffic of a time range, read from the rollups
+type RollupQuery struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Resolution string    `json:"resolution"`
+
+	Hits     int          `json:"hits"`
+	Bytes    uint64       `json:"bytes"`
+	Statuses statusCounts `json:"statuses"`
+
+	// sections with the most hits over the time range
+	Sections []RollupSection `json:"sections"`
+	// traffic of every rollup of the time range
+	Points []RollupPoint `json:"points"`
+}
+
+// RollupSection is the traffic of a section over a time range
+type RollupSection struct {
+	Section  string       `json:"section"`
+	Hits     int          `json:"hits"`
+	Bytes    uint64       `json:"bytes"`
+	Statuses statusCounts `json:"statuses"`
+}
+
+// RollupPoint is the traffic of a rollup
+type RollupPoint struct {
+	Time  time.Time `json:"time"`
+	Hits  int       `json:"hits"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// queryRollups returns the traffic of a time range and its top sections. The resolution is "minute", "hour",
+// "day", or "auto" to use the finest resolution whose retention covers the start of the time range
+func queryRollups(config RollupConfig, from, to time.Time, resolution string, top int, now time.Time) (RollupQuery, error) {
+	if to.IsZero() {
+		to = now
+	}
+	query := RollupQuery{From: from, To: to, Sections: []RollupSection{}, Points: []RollupPoint{}}
+
+	var res *rollupResolution
+	for i := range rollupResolutions {
+		candidate := &rollupResolutions[i]
+		if resolution == candidate.name {
+			res = candidate
+			break
+		}
+		if resolution == "" || resolution == "auto" {
+			res = candidate
+			retention := config.retention(candidate.name)
+			if retention <= 0 || (!from.IsZero() && !from.Before(now.Add(-retention))) {
+				break
+			}
+		}
+	}
+	if res == nil {
+		return query, fmt.Errorf("unknown resolution %q", resolution)
+	}
+	query.Resolution = res.name
+
+	rollups, err := readRollups(config.Path, *res, from, to)
+	if err != nil {
+		return query, err
+	}
+
+	total := newRollup(from)
+	for _, r := range rollups {
+		total.merge(r)
+		// a minute can be written several times, when its entries are received after it was written
+		if last := len(query.Points) - 1; last >= 0 && query.Points[last].Time.Equal(r.Time) {
+			query.Points[last].Hits += r.Hits
+			query.Points[last].Bytes += r.Bytes
+			continue
+		}
+		query.Points = append(query.Points, RollupPoint{Time: r.Time, Hits: r.Hits, Bytes: r.Bytes})
+	}
+	query.Hits = total.Hits
+	query.Bytes = total.Bytes
+	query.Statuses = total.Statuses
+
+	for section, counts := range total.Sections {
+		query.Sections = append(query.Sections, RollupSection{
+			Section:  section,
+			Hits:     counts.Hits,
+			Bytes:    counts.Bytes,
+			Statuses: counts.Statuses,
+		})
+	}
+	sort.Slice(query.Sections, func(i, j int) bool {
+		if query.Sections[i].Hits == query.Sections[j].Hits {
+			return query.Sections[i].Section < query.Sections[j].Section
+		}
+		return query.Sections[i].Hits > query.Sections[j].Hits
+	})
+	if top > 0 && len(query.Sections) > top {
+		query.Sections = query.Sections[:top]
+	}
+
+	return query, nil
+}
+
+// rollupsCommand prints the traffic and the top sections of a time range, read from the rollups
+func rollupsCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("rollups", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON configuration file overriding the default values")
+	fromStr := flags.String("from", "", "start of the time range (date, RFC3339 time or duration such as 24h)")
+	toStr := flags.String("to", "", "end of the time range (date, RFC3339 time or duration such as 1h), now by default")
+	resolution := flags.String("resolution", "auto", "resolution of the rollups: minute, hour, day or auto")
+	top := flags.Int("top", 10, "number of top sections")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfigFlag(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.Rollups.Path == "" {
+		return errors.New("rollups are disabled, set rollups.path in the configuration")
+	}
+
+	now := time.Now()
+	from, err := parseTimeFilter(*fromStr, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFilter(*toStr, now)
+	if err != nil {
+		return err
+	}
+
+	query, err := queryRollups(config.Rollups, from, to, *resolution, *top, now)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(query)
+	}
+
+	fmt.Fprintf(out, "%s to %s, by %s: %d hits, %s\n\n", formatRollupTime(query.From), formatRollupTime(query.To),
+		query.Resolution, query.Hits, formatBytes(query.Bytes))
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tSECTION\tHITS\tBYTES\t2XX\t3XX\t4XX\t5XX")
+	for i, section := range query.Sections {
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\t%d\t%d\t%d\t%d\n", i+1, section.Section, section.Hits, formatBytes(section.Bytes),
+			section.Statuses[2], section.Statuses[3], section.Statuses[4], section.Statuses[5])
+	}
+	return writer.Flush()
+}
+
+func formatRollupTime(t time.Time) string {
+	if t.IsZero() {
+		return "the beginning"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test ensures that the traffic is rolled up by the minute of the entries, downsampled by hour and by day once
+// they are over, that the rollups past their retention are removed, and that the minute in progress is written
+// when the store is closed and downsampled after a restart
+func TestRollupStore(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 23, 58, 30, 0, time.UTC)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := RollupConfig{Path: dir, MinuteRetention: Duration{24 * time.Hour}}
+	store, err := newRollupStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a minute file that is past its retention
+	if err := ioutil.WriteFile(filepath.Join(dir, "minute-2018-05-06.jsonl"), nil, 0644); err != nil {
+		t.Fatalf("could not write rollup file: %v", err)
+	}
+
+	// entries are refreshed along with the offset of their own time
+	type entry struct {
+		offset  time.Duration
+		section string
+		status  uint64
+	}
+	refresh := func(store *rollupStore, offset time.Duration, entries ...entry) {
+		stats := RefreshStats{Time: baseTime.Add(offset), Minutes: make(map[time.Time]map[string]SectionRefreshStats)}
+		stats.Watermark = stats.Time
+		for _, e := range entries {
+			minute := baseTime.Add(e.offset).Truncate(time.Minute)
+			if stats.Minutes[minute] == nil {
+				stats.Minutes[minute] = make(map[string]SectionRefreshStats)
+			}
+			sectionStats := stats.Minutes[minute][e.section]
+			sectionStats.Hits++
+			sectionStats.Bytes += 100
+			sectionStats.Statuses.add(e.status)
+			stats.Minutes[minute][e.section] = sectionStats
+		}
+		if err := store.Flush(stats); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// two refreshes in the same minute, then one in each of the following minutes, the last one being in the
+	// first minute of the next day. The refresh of the second minute receives an entry of the first one
+	refresh(store, 0, entry{0, "/api", 200}, entry{0, "/api", 200})
+	refresh(store, 20*time.Second, entry{10 * time.Second, "/static", 404})
+	refresh(store, time.Minute, entry{20 * time.Second, "/static", 404}, entry{time.Minute, "/api", 500},
+		entry{time.Minute, "/api", 500}, entry{time.Minute, "/api", 500})
+	refresh(store, 2*time.Minute, entry{2 * time.Minute, "/api", 200})
+
+	minutes, err := readRollups(dir, rollupResolutions[0], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(minutes) != 2 || minutes[0].Hits != 4 || minutes[0].Sections["/static"].Statuses[4] != 2 || minutes[1].Hits != 3 {
+		t.Fatalf("expected 2 minute rollups, got %+v", minutes)
+	}
+
+	hours, err := readRollups(dir, rollupResolutions[1], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hours) != 1 || !hours[0].Time.Equal(time.Date(2018, time.May, 8, 23, 0, 0, 0, time.UTC)) || hours[0].Hits != 7 {
+		t.Fatalf("expected the hour to be downsampled, got %+v", hours)
+	}
+
+	days, err := readRollups(dir, rollupResolutions[2], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(days) != 1 || days[0].Hits != 7 || days[0].Sections["/api"].Hits != 5 || days[0].Sections["/api"].Statuses[5] != 3 {
+		t.Fatalf("expected the day to be downsampled, got %+v", days)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "minute-2018-05-06.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("expected the minute rollups past their retention to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "minute-2018-05-08.jsonl")); err != nil {
+		t.Errorf("expected the recent minute rollups to be kept, got %v", err)
+	}
+
+	// the minute in progress is written when the store is closed
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minutes, err = readRollups(dir, rollupResolutions[0], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(minutes) != 3 || !minutes[2].Time.Equal(time.Date(2018, time.May, 9, 0, 0, 0, 0, time.UTC)) || minutes[2].Hits != 1 {
+		t.Fatalf("expected the minute in progress to be written, got %+v", minutes)
+	}
+
+	// after a restart, its hour is downsampled once it is over
+	store, err = newRollupStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	refresh(store, 62*time.Minute)
+
+	hours, err = readRollups(dir, rollupResolutions[1], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hours) != 2 || !hours[1].Time.Equal(time.Date(2018, time.May, 9, 0, 0, 0, 0, time.UTC)) || hours[1].Hits != 1 {
+		t.Fatalf("expected the missing hour to be downsampled, got %+v", hours)
+	}
+	days, err = readRollups(dir, rollupResolutions[2], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(days) != 1 {
+		t.Errorf("expected the day in progress not to be downsampled, got %+v", days)
+	}
+}
+
+// This test ensures that rollups can be queried over a time range from the command line and the API, using the
+// finest resolution that is still retained for the time range
+func TestQueryRollups(t *testing.T) {
+	now := time.Date(2018, time.May, 10, 12, 0, 0, 0, time.UTC)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := RollupConfig{Path: dir, MinuteRetention: Duration{48 * time.Hour}}
+	store, err := newRollupStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, section := range []string{"/api", "/api", "/static", "/api"} {
+		r := newRollup(time.Date(2018, time.May, 9, 14, i*20, 0, 0, time.UTC))
+		r.add(section, 10, 1000, statusCounts{2: 10})
+		if err := store.write(rollupResolutions[0], r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	hour := newRollup(time.Date(2018, time.May, 1, 14, 0, 0, 0, time.UTC))
+	hour.add("/old", 5, 500, statusCounts{5: 5})
+	if err := store.write(rollupResolutions[1], hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	from := time.Date(2018, time.May, 9, 14, 0, 0, 0, time.UTC)
+	query, err := queryRollups(config, from, from.Add(time.Hour), "auto", 1, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if query.Resolution != "minute" || query.Hits != 30 || len(query.Points) != 3 {
+		t.Errorf("unexpected query result %+v", query)
+	}
+	if len(query.Sections) != 1 || query.Sections[0].Section != "/api" || query.Sections[0].Hits != 20 {
+		t.Errorf("expected /api to be the top section, got %+v", query.Sections)
+	}
+
+	// the minute rollups of a week ago are no longer retained
+	query, err = queryRollups(config, now.Add(-10*24*time.Hour), time.Time{}, "", 10, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if query.Resolution != "hour" || query.Hits != 5 || query.Sections[0].Section != "/old" {
+		t.Errorf("expected the hourly rollups to be used, got %+v", query)
+	}
+
+	if _, err := queryRollups(config, from, now, "week", 10, now); err == nil {
+		t.Error("expected an unknown resolution to be refused")
+	}
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"rollups": {"path": "`+dir+`"}}`), 0644); err != nil {
+		t.Fatalf("could not write configuration: %v", err)
+	}
+	out := &bytes.Buffer{}
+	err = rollupsCommand([]string{"-config", configPath, "-from", "2018-05-09T14:00:00Z", "-to", "2018-05-09T15:00:00Z", "-resolution", "minute"}, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{"2018-05-09T14:00:00Z to 2018-05-09T15:00:00Z, by minute: 30 hits, 2.9KB", "1  /api     20    2.0KB"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+	if err := rollupsCommand(nil, out); err == nil {
+		t.Error("expected an error when rollups are disabled")
+	}
+
+	log := NewZeroLog(ioutil.Discard, JSON)
+	server := httptest.NewServer(newAPI(log, nil, nil, "", config, func() time.Time { return now }).Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/rollups?from=2018-05-09T14:00:00Z&to=2018-05-09T14:30:00Z&n=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var result RollupQuery
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil || result.Hits != 20 || len(result.Sections) != 1 || result.Statuses[2] != 20 {
+		t.Errorf("unexpected API result %+v, error %v", result, err)
+	}
+
+	resp, err = http.Get(server.URL + "/api/rollups?resolution=week")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown resolution to be refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog"
+)
+
+// Severity is the severity of an alert, which decides at which level it is logged and to which notifiers
+// it is sent
+type Severity string
+
+// Alert severities, from the least to the most severe
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// severityRanks orders the severities
+var severityRanks = map[Severity]int{
+	SeverityInfo:     1,
+	SeverityWarning:  2,
+	SeverityCritical: 3,
+}
+
+// UnmarshalText reads a severity, rejecting unknown ones. It is also used for severities used as map keys
+func (s *Severity) UnmarshalText(text []byte) error {
+	severity := Severity(text)
+	if _, ok := severityRanks[severity]; !ok {
+		return fmt.Errorf("unknown severity %q: expected info, warning or critical", text)
+	}
+
+	*s = severity
+	return nil
+}
+
+// RuleSeverityConfig configures the severity of the alerts raised by a rule
+type RuleSeverityConfig struct {
+	// severity of the alerts when the threshold of the rule is exceeded, warning by default
+	Severity Severity `json:"severity"`
+
+	// higher severities given to the alerts when the value of the rule exceeds its threshold by a factor
+	Escalations []SeverityEscalation `json:"escalations"`
+}
+
+// SeverityEscalation raises the severity of an alert once the value of its rule reaches its threshold
+// multiplied by a factor. For example, a factor of 2 escalates traffic alerts when the traffic is
+// twice the configured threshold
+type SeverityEscalation struct {
+	Severity Severity `json:"severity"`
+	Factor   float64  `json:"factor"`
+}
+
+// alertSeverity returns the severity of an alert raised by a rule, depending on how much its value exceeds
+// its threshold
+func (lp *LogProcessor) alertSeverity(rule string, value, threshold float64) Severity {
+	config := lp.severities[rule]
+
+	severity := config.Severity
+	if severity == "" {
+		severity = SeverityWarning
+	}
+
+	for _, escalation := range config.Escalations {
+		if value >= threshold*escalation.Factor && severityRanks[escalation.Severity] > severityRanks[severity] {
+			severity = escalation.Severity
+		}
+	}
+
+	return severity
+}
+
+// firingEvent starts the report event of an alert that is firing, at the level matching its severity
+func (lp *LogProcessor) firingEvent(key alertKey) *zerolog.Event {
+	alert, ok := lp.alerts[key]
+	if !ok {
+		return lp.report.Warn()
+	}
+
+	switch alert.Severity {
+	case SeverityInfo:
+		return lp.report.Info()
+	case SeverityCritical:
+		return lp.report.Error()
+	default:
+		return lp.report.Warn()
+	}
+}
+
+// severityRoute only forwards to a notifier the alerts of some severities. Resolved alerts are forwarded
+// when the alert was notified with one of these severities at any point of its lifetime, so that a notifier
+// which was told an alert fired is also told when it is resolved, even after it escalated or de-escalated
+type severityRoute struct {
+	Notifier
+
+	severities map[Severity]bool
+}
+
+// routeSeverities restricts a notifier to the alerts of the given severities. No severities means all of them
+func routeSeverities(notifier Notifier, severities []Severity) Notifier {
+	if len(severities) == 0 {
+		return notifier
+	}
+
+	route := &severityRoute{Notifier: notifier, severities: make(map[Severity]bool)}
+	for _, severity := range severities {
+		route.severities[severity] = true
+	}
+	return route
+}
+
+// Notify forwards an alert to the notifier if it has one of the routed severities
+func (r *severityRoute) Notify(alert Alert) error {
+	if alert.State != AlertResolved {
+		if !r.severities[alert.Severity] {
+			return nil
+		}
+		return r.Notifier.Notify(alert)
+	}
+
+	// alerts that were not tracked while they were notified, such as the ones restored from an older state,
+	// are routed by the highest severity they reached
+	notified := alert.NotifiedSeverities
+	if len(notified) == 0 {
+		notified = []Severity{alert.PeakSeverity}
+	}
+	for _, severity := range notified {
+		if r.severities[severity] {
+			return r.Notifier.Notify(alert)
+		}
+	}
+	return nil
+}
+
+// Close closes the notifier, if it needs to be closed
+func (r *severityRoute) Close() error {
+	if closer, ok := r.Notifier.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
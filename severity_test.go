@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertSeverity(t *testing.T) {
+	lp := &LogProcessor{
+		severities: map[string]RuleSeverityConfig{
+			trafficRule: {
+				Escalations: []SeverityEscalation{
+					{Severity: SeverityCritical, Factor: 4},
+					{Severity: SeverityInfo, Factor: 10},
+				},
+			},
+			noDataRule: {Severity: SeverityCritical},
+		},
+	}
+
+	testCases := []struct {
+		rule      string
+		value     float64
+		threshold float64
+
+		expectedSeverity Severity
+	}{
+		{rule: trafficRule, value: 2, threshold: 2, expectedSeverity: SeverityWarning},
+		{rule: trafficRule, value: 7, threshold: 2, expectedSeverity: SeverityWarning},
+		{rule: trafficRule, value: 8, threshold: 2, expectedSeverity: SeverityCritical},
+		// escalations never lower the severity
+		{rule: trafficRule, value: 20, threshold: 2, expectedSeverity: SeverityCritical},
+		{rule: noDataRule, value: 300, threshold: 60, expectedSeverity: SeverityCritical},
+		{rule: serverErrorRateRule, value: 50, threshold: 10, expectedSeverity: SeverityWarning},
+	}
+
+	for _, testCase := range testCases {
+		severity := lp.alertSeverity(testCase.rule, testCase.value, testCase.threshold)
+		if severity != testCase.expectedSeverity {
+			t.Errorf("expected %s alert with value %g and threshold %g to be %s, got %s",
+				testCase.rule, testCase.value, testCase.threshold, testCase.expectedSeverity, severity)
+		}
+	}
+}
+
+func TestSeverityUnmarshal(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"renotify_intervals": {"critical": "15m"}, "severities": {"traffic": {"severity": "info"}}}`), &config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.RenotifyIntervals[SeverityCritical].Duration != 15*time.Minute {
+		t.Errorf("expected critical re-notification interval of 15m, got %v", config.RenotifyIntervals)
+	}
+	if config.Severities[trafficRule].Severity != SeverityInfo {
+		t.Errorf("expected traffic alerts to be info, got %v", config.Severities)
+	}
+
+	err = json.Unmarshal([]byte(`{"renotify_intervals": {"fatal": "15m"}}`), &config)
+	if err == nil {
+		t.Error("expected error for unknown severity")
+	}
+}
+
+// This test ensures that alerts escalate and de-escalate with their value, that firing alerts are notified
+// again at the interval of their severity, and that notifiers only receive the severities routed to them
+func TestSeverityEscalation(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	buffer := &bytes.Buffer{}
+	log := NewZeroLog(buffer, JSON)
+
+	recorder := &alertRecorderMock{}
+	notifier := &notifierMock{}
+	pager := &notifierMock{}
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 10
+	config.Severities = map[string]RuleSeverityConfig{
+		trafficRule: {Escalations: []SeverityEscalation{{Severity: SeverityCritical, Factor: 2}}},
+	}
+	config.RenotifyIntervals = map[Severity]Duration{SeverityCritical: {time.Minute}}
+
+	now := baseTime
+	lp := NewLogProcessor(log, log, config, recorder, []Notifier{
+		notifier,
+		routeSeverities(pager, []Severity{SeverityCritical}),
+	}, nil, nil, func() time.Time { return now })
+
+	check := func(trafficMB uint64) {
+		lp.refreshedAt = now
+		lp.checkTrafficThreshold(alertSubject{kind: totalSubject}, trafficMB*1024*1024, 10)
+		now = now.Add(30 * time.Second)
+	}
+
+	check(15) // firing, warning
+	check(25) // escalated to critical
+	check(25) // unchanged
+	check(25) // re-notified
+	check(15) // de-escalated to warning
+	check(15) // unchanged, warnings are not re-notified
+	check(0)  // resolved
+
+	expectedStates := []string{"firing/warning", "firing/critical", "firing/critical", "firing/warning", "resolved/warning"}
+	if len(notifier.alerts) != len(expectedStates) {
+		t.Fatalf("expected %d notifications, got %+v", len(expectedStates), notifier.alerts)
+	}
+	for i, alert := range notifier.alerts {
+		if state := string(alert.State) + "/" + string(alert.Severity); state != expectedStates[i] {
+			t.Errorf("expected notification #%d to be %s, got %s", i+1, expectedStates[i], state)
+		}
+	}
+	if !notifier.alerts[2].Renotified {
+		t.Error("expected third notification to be a re-notification")
+	}
+	if notifier.alerts[4].PeakSeverity != SeverityCritical {
+		t.Errorf("expected resolved alert to have reached critical severity, got %s", notifier.alerts[4].PeakSeverity)
+	}
+
+	// re-notifications are not state changes
+	if len(recorder.alerts) != 4 {
+		t.Errorf("expected 4 alerts to be recorded, got %d", len(recorder.alerts))
+	}
+
+	// the pager only receives critical alerts, and the resolution of the alert that reached critical
+	expectedPages := []AlertState{AlertFiring, AlertFiring, AlertResolved}
+	if len(pager.alerts) != len(expectedPages) {
+		t.Fatalf("expected %d pages, got %+v", len(expectedPages), pager.alerts)
+	}
+	for i, alert := range pager.alerts {
+		if alert.State != expectedPages[i] {
+			t.Errorf("expected page #%d to be %s, got %s", i+1, expectedPages[i], alert.State)
+		}
+	}
+
+	expectedLogs := []string{
+		`{"level":"warn","recent_traffic":"15MB","threshold":"10MB","message":"Total traffic over the last 2 minutes exceeds the configured threshold"}`,
+		`{"level":"error","recent_traffic":"25MB","threshold":"10MB","message":"Total traffic over the last 2 minutes still exceeds the configured threshold"}`,
+		`{"level":"warn","recent_traffic":"15MB","threshold":"10MB","message":"Total traffic over the last 2 minutes still exceeds the configured threshold"}`,
+	}
+	for _, expected := range expectedLogs {
+		if !bytes.Contains(buffer.Bytes(), []byte(expected)) {
+			t.Errorf("expected log %s", expected)
+		}
+	}
+}
+
+// This test ensures that the resolution of an alert that escalated is sent to every notifier that was notified
+// of it, including the ones that only received it before it escalated
+func TestSeverityRouteEscalateThenResolve(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	ticketing := &notifierMock{}
+	pager := &notifierMock{}
+	chat := &notifierMock{}
+
+	config := DefaultConfig()
+	config.Severities = map[string]RuleSeverityConfig{
+		trafficRule: {Escalations: []SeverityEscalation{{Severity: SeverityCritical, Factor: 2}}},
+	}
+
+	now := baseTime
+	log := NewZeroLog(&bytes.Buffer{}, JSON)
+	lp := NewLogProcessor(log, log, config, nil, []Notifier{
+		routeSeverities(ticketing, []Severity{SeverityWarning}),
+		routeSeverities(pager, []Severity{SeverityCritical}),
+		routeSeverities(chat, []Severity{SeverityInfo}),
+	}, nil, nil, func() time.Time { return now })
+
+	for _, trafficMB := range []uint64{15, 25, 0} {
+		lp.refreshedAt = now
+		lp.checkTrafficThreshold(alertSubject{kind: totalSubject}, trafficMB*1024*1024, 10)
+		now = now.Add(30 * time.Second)
+	}
+
+	tests := map[string]struct {
+		notifier *notifierMock
+		expected []string
+	}{
+		"warning":  {ticketing, []string{"firing/warning", "resolved/critical"}},
+		"critical": {pager, []string{"firing/critical", "resolved/critical"}},
+		"info":     {chat, nil},
+	}
+	for name, test := range tests {
+		var states []string
+		for _, alert := range test.notifier.alerts {
+			states = append(states, string(alert.State)+"/"+string(alert.Severity))
+		}
+		if strings.Join(states, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("expected the %s route to receive %v, got %v", name, test.expected, states)
+		}
+	}
+
+	// alerts without notified severities are routed by their peak severity
+	route := routeSeverities(ticketing, []Severity{SeverityWarning})
+	route.Notify(Alert{State: AlertResolved, Severity: SeverityCritical, PeakSeverity: SeverityCritical})
+	if len(ticketing.alerts) != 2 {
+		t.Errorf("expected the resolution of a critical alert not to be routed to warnings, got %+v", ticketing.alerts)
+	}
+}
+
+func TestAlertSummarySeverity(t *testing.T) {
+	alert := Alert{State: AlertFiring, Severity: SeverityCritical, Rule: trafficRule, Subject: sectionSubject, Name: "/api", Value: 3, Threshold: 1, Peak: 3}
+
+	expected := "[FIRING/CRITICAL] Section /api traffic: 3 (threshold 1, peak 3)"
+	if alert.Summary() != expected {
+		t.Errorf("expected summary %q, got %q", expected, alert.Summary())
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// errSilenceNotFound is returned when removing a silence that is not in the silences file
+var errSilenceNotFound = errors.New("silence not found")
+
+// errNoSilencesFile is returned when adding a silence while no silences file is configured
+var errNoSilencesFile = errors.New("no silences file configured, set silences_path in the configuration")
+
+// Silence suppresses the notifications of the alerts it matches between its start and end times.
+// Silenced alerts are still evaluated and recorded into the alert history.
+type Silence struct {
+	ID string `json:"id"`
+
+	// matchers of the silence. Empty matchers match any alert
+	Matcher
+
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// Matcher matches alerts on their rule name, the section they are about and their source file.
+// Empty fields match any alert
+type Matcher struct {
+	Rule    string `json:"rule,omitempty"`
+	Section string `json:"section,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+// Matches returns whether an alert is matched
+func (m Matcher) Matches(alert Alert) bool {
+	if m.Rule != "" && m.Rule != alert.Rule {
+		return false
+	}
+	if m.Section != "" && (alert.Subject != sectionSubject || m.Section != alert.Name) {
+		return false
+	}
+	if m.Source != "" && m.Source != alert.Source {
+		return false
+	}
+	return true
+}
+
+// Active returns whether the silence is active at the given time
+func (s Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// Validate checks that the silence ends after it starts
+func (s Silence) Validate() error {
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("silence must end after it starts")
+	}
+	return nil
+}
+
+// silenceStore holds the silences from the configuration, the ones created from the CLI or the API, which are
+// persisted into a local file, and the maintenance windows. The silences file is reloaded whenever it is modified,
+// so that silences created from the CLI are taken into account by a running agent
+type silenceStore struct {
+	log  *zerolog.Logger
+	path string
+
+	mu          sync.Mutex
+	configured  []Silence
+	silences    []Silence
+	maintenance []maintenanceWindow
+	modTime     time.Time
+}
+
+// newSilenceStore creates a silence store from the configuration, and loads the silences file if it exists
+func newSilenceStore(log *zerolog.Logger, config Config) (*silenceStore, error) {
+	store := &silenceStore{
+		log:  log,
+		path: config.SilencesPath,
+	}
+
+	for _, silence := range config.Silences {
+		if err := silence.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid silence %q: %v", silence.Comment, err)
+		}
+		store.configured = append(store.configured, silence)
+	}
+
+	for _, windowConfig := range config.MaintenanceWindows {
+		window, err := newMaintenanceWindow(windowConfig)
+		if err != nil {
+			return nil, err
+		}
+		store.maintenance = append(store.maintenance, window)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store, store.reload()
+}
+
+// reload reads the silences file again if it was modified since it was last read
+func (s *silenceStore) reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.silences = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var silences []Silence
+	err = json.Unmarshal(data, &silences)
+	if err != nil {
+		return fmt.Errorf("invalid silences file: %v", err)
+	}
+
+	s.silences = silences
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes silences into the silences file, removing expired ones, and makes them the silences of the store
+// once they are written, so that the silences in memory always match the file
+func (s *silenceStore) save(silences []Silence, now time.Time) error {
+	if s.path == "" {
+		return errNoSilencesFile
+	}
+
+	active := []Silence{}
+	for _, silence := range silences {
+		if now.Before(silence.EndsAt) {
+			active = append(active, silence)
+		}
+	}
+
+	data, err := json.MarshalIndent(active, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(s.path, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.silences = active
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Add validates a silence, assigns it an identifier and persists it. Silences can only be added when a silences
+// file is configured, so that they are not lost when the agent restarts
+func (s *silenceStore) Add(silence Silence, now time.Time) (Silence, error) {
+	if err := silence.Validate(); err != nil {
+		return silence, err
+	}
+	if s.path == "" {
+		return silence, errNoSilencesFile
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return silence, err
+	}
+	silence.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return silence, err
+	}
+	silences := append(append([]Silence{}, s.silences...), silence)
+	return silence, s.save(silences, now)
+}
+
+// Remove removes a silence from the silences file
+func (s *silenceStore) Remove(id string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			silences := append(append([]Silence{}, s.silences[:i]...), s.silences[i+1:]...)
+			return s.save(silences, now)
+		}
+	}
+	return errSilenceNotFound
+}
+
+// List returns the silences from the configuration and from the silences file that did not expire yet,
+// sorted by start time
+func (s *silenceStore) List(now time.Time) ([]Silence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	silences := []Silence{}
+	for _, silence := range s.all() {
+		if now.Before(silence.EndsAt) {
+			silences = append(silences, silence)
+		}
+	}
+
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].StartsAt.Before(silences[j].StartsAt)
+	})
+	return silences, nil
+}
+
+// all returns the silences from the configuration and from the silences file
+func (s *silenceStore) all() []Silence {
+	silences := make([]Silence, 0, len(s.configured)+len(s.silences))
+	silences = append(silences, s.configured...)
+	return append(silences, s.silences...)
+}
+
+// Silenced returns whether the notifications of an alert are suppressed by an active silence or maintenance
+// window, and describes what silenced it
+func (s *silenceStore) Silenced(alert Alert, now time.Time) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.reload()
+	if err != nil {
+		s.log.Error().Err(err).Str("silences_path", s.path).Msg("Could not reload silences")
+	}
+
+	for _, silence := range s.all() {
+		if silence.Active(now) && silence.Matches(alert) {
+			if silence.ID != "" {
+				return true, "silence " + silence.ID
+			}
+			return true, "silence " + silence.Comment
+		}
+	}
+
+	for _, window := range s.maintenance {
+		if window.Active(now) && window.Matches(alert) {
+			return true, "maintenance window " + window.schedule.expression
+		}
+	}
+
+	return false, ""
+}
+
+// alertsSilenceCommand adds, lists and removes the silences stored in the silences file
+func alertsSilenceCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: hk-agent alerts silence add|list|remove [flags]")
+	}
+
+	flags := flag.NewFlagSet("alerts silence "+args[0], flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON configuration file overriding the default values")
+
+	switch args[0] {
+	case "add":
+		var silence Silence
+		flags.StringVar(&silence.Rule, "rule", "", "only silence alerts raised by this rule")
+		flags.StringVar(&silence.Section, "section", "", "only silence alerts about this section")
+		flags.StringVar(&silence.Source, "source", "", "only silence alerts about this log file")
+		flags.StringVar(&silence.Comment, "comment", "", "reason for the silence")
+		startStr := flags.String("start", "", "start time of the silence (date or RFC3339 time), now by default")
+		endStr := flags.String("end", "", "end time of the silence (date or RFC3339 time)")
+		duration := flags.Duration("duration", time.Hour, "duration of the silence, when no end time is given")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		store, err := silenceStoreFlag(*configPath)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		silence.StartsAt = now
+		if *startStr != "" {
+			if silence.StartsAt, err = parseTimeFilter(*startStr, now); err != nil {
+				return err
+			}
+		}
+		silence.EndsAt = silence.StartsAt.Add(*duration)
+		if *endStr != "" {
+			if silence.EndsAt, err = parseTimeFilter(*endStr, now); err != nil {
+				return err
+			}
+		}
+
+		silence, err = store.Add(silence, now)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, silence.ID)
+		return nil
+	case "list":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		store, err := silenceStoreFlag(*configPath)
+		if err != nil {
+			return err
+		}
+
+		silences, err := store.List(time.Now())
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tRULE\tSECTION\tSOURCE\tSTART\tEND\tCOMMENT")
+		for _, silence := range silences {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				orDash(silence.ID),
+				orDash(silence.Rule),
+				orDash(silence.Section),
+				orDash(silence.Source),
+				silence.StartsAt.Format(time.RFC3339),
+				silence.EndsAt.Format(time.RFC3339),
+				silence.Comment,
+			)
+		}
+		return writer.Flush()
+	case "remove":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New("usage: hk-agent alerts silence remove [flags] <id>")
+		}
+
+		store, err := silenceStoreFlag(*configPath)
+		if err != nil {
+			return err
+		}
+		return store.Remove(flags.Arg(0), time.Now())
+	default:
+		return fmt.Errorf("unknown alerts silence subcommand %q", args[0])
+	}
+}
+
+// silenceStoreFlag loads the silence store described in the configuration file given with the config flag
+func silenceStoreFlag(configPath string) (*silenceStore, error) {
+	config, err := loadConfigFlag(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSilenceStore(NewZeroLog(ioutil.Discard, JSON), config)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifierMock keeps notified alerts in memory
+type notifierMock struct {
+	alerts []Alert
+}
+
+func (m *notifierMock) Notify(alert Alert) error {
+	m.alerts = append(m.alerts, alert)
+	return nil
+}
+
+func TestMatcher(t *testing.T) {
+	alert := Alert{Rule: trafficRule, Subject: sectionSubject, Name: "/api", Source: "/var/log/access.log"}
+
+	testCases := []struct {
+		matcher Matcher
+
+		expectedMatch bool
+	}{
+		{matcher: Matcher{}, expectedMatch: true},
+		{matcher: Matcher{Rule: trafficRule}, expectedMatch: true},
+		{matcher: Matcher{Rule: serverErrorRateRule}, expectedMatch: false},
+		{matcher: Matcher{Section: "/api"}, expectedMatch: true},
+		{matcher: Matcher{Section: "/downloads"}, expectedMatch: false},
+		{matcher: Matcher{Rule: trafficRule, Section: "/api", Source: "/var/log/access.log"}, expectedMatch: true},
+		{matcher: Matcher{Source: "/var/log/other.log"}, expectedMatch: false},
+	}
+	for _, testCase := range testCases {
+		if testCase.matcher.Matches(alert) != testCase.expectedMatch {
+			t.Errorf("expected matcher %+v to match: %v", testCase.matcher, testCase.expectedMatch)
+		}
+	}
+
+	if (Matcher{Section: "/api"}).Matches(Alert{Rule: trafficRule, Subject: clientSubject, Name: "/api"}) {
+		t.Error("section matcher should not match alerts about clients")
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	// every Sunday at 2am, for 2 hours
+	window, err := newMaintenanceWindow(MaintenanceWindowConfig{Schedule: "0 2 * * 0", Duration: Duration{2 * time.Hour}})
+	if err != nil {
+		t.Fatalf("could not create maintenance window: %v", err)
+	}
+
+	sunday := time.Date(2018, time.May, 6, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		time time.Time
+
+		expectedActive bool
+	}{
+		{time: sunday.Add(time.Hour + 59*time.Minute), expectedActive: false},
+		{time: sunday.Add(2 * time.Hour), expectedActive: true},
+		{time: sunday.Add(3*time.Hour + 59*time.Minute), expectedActive: true},
+		{time: sunday.Add(4 * time.Hour), expectedActive: false},
+		{time: sunday.Add(24*time.Hour + 2*time.Hour + 30*time.Minute), expectedActive: false},
+	}
+	for _, testCase := range testCases {
+		if window.Active(testCase.time) != testCase.expectedActive {
+			t.Errorf("expected maintenance window to be active at %s: %v", testCase.time, testCase.expectedActive)
+		}
+	}
+
+	// the start of a long window is found without checking every minute since it started
+	window, err = newMaintenanceWindow(MaintenanceWindowConfig{Schedule: "30 23 * * 5", Duration: Duration{3 * 24 * time.Hour}})
+	if err != nil {
+		t.Fatalf("could not create maintenance window: %v", err)
+	}
+	friday := time.Date(2018, time.May, 4, 23, 30, 0, 0, time.UTC)
+	if start, ok := window.schedule.Previous(friday.Add(6*24*time.Hour), friday.Add(-time.Hour)); !ok || !start.Equal(friday) {
+		t.Errorf("expected the window to have started at %s, got %s", friday, start)
+	}
+	if !window.Active(friday.Add(3*24*time.Hour - time.Minute)) {
+		t.Error("expected the window to be active until its end")
+	}
+	if window.Active(friday.Add(3 * 24 * time.Hour)) {
+		t.Error("expected the window not to be active after its end")
+	}
+	if window.Active(friday.Add(-time.Minute)) {
+		t.Error("expected the window not to be active before it starts")
+	}
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	schedule, err := parseCronSchedule("*/15 9-17 * 1,6 1-5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Monday, June 4th 2018
+	if !schedule.Matches(time.Date(2018, time.June, 4, 9, 45, 0, 0, time.UTC)) {
+		t.Error("expected schedule to match on a weekday of June at 9:45")
+	}
+	if schedule.Matches(time.Date(2018, time.June, 4, 9, 40, 0, 0, time.UTC)) {
+		t.Error("expected schedule not to match at 9:40")
+	}
+	if schedule.Matches(time.Date(2018, time.June, 3, 9, 45, 0, 0, time.UTC)) {
+		t.Error("expected schedule not to match on Sunday")
+	}
+	if schedule.Matches(time.Date(2018, time.May, 7, 9, 45, 0, 0, time.UTC)) {
+		t.Error("expected schedule not to match in May")
+	}
+
+	// with both day fields restricted, either of them matches: the 1st of the month and every Sunday
+	schedule, err = parseCronSchedule("0 2 1 * 0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	days := map[time.Time]bool{
+		time.Date(2018, time.May, 1, 2, 0, 0, 0, time.UTC):   true,
+		time.Date(2018, time.May, 6, 2, 0, 0, 0, time.UTC):   true,
+		time.Date(2018, time.May, 7, 2, 0, 0, 0, time.UTC):   false,
+		time.Date(2018, time.April, 1, 2, 0, 0, 0, time.UTC): true,
+	}
+	for day, expected := range days {
+		if schedule.Matches(day) != expected {
+			t.Errorf("expected schedule %q to match %s: %v", schedule.expression, day, expected)
+		}
+	}
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * * * 7", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseCronSchedule(expression); err == nil {
+			t.Errorf("expected an error for invalid schedule %q", expression)
+		}
+	}
+}
+
+func TestSilenceStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+	config := DefaultConfig()
+	config.SilencesPath = filepath.Join(dir, "silences.json")
+	config.Silences = []Silence{
+		{Matcher: Matcher{Rule: noDataRule}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour), Comment: "log shipping migration"},
+	}
+	config.MaintenanceWindows = []MaintenanceWindowConfig{
+		{Matcher: Matcher{Section: "/batch"}, Schedule: "0 8 * * *", Duration: Duration{time.Hour}},
+	}
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	store, err := newSilenceStore(log, config)
+	if err != nil {
+		t.Fatalf("could not create silence store: %v", err)
+	}
+
+	silence, err := store.Add(Silence{Matcher: Matcher{Section: "/api"}, StartsAt: now, EndsAt: now.Add(time.Hour)}, now)
+	if err != nil {
+		t.Fatalf("could not add silence: %v", err)
+	}
+	if silence.ID == "" {
+		t.Error("expected silence to be given an identifier")
+	}
+	if _, err := store.Add(Silence{StartsAt: now, EndsAt: now}, now); err == nil {
+		t.Error("expected an error when adding a silence that ends when it starts")
+	}
+
+	// silences added to the file by another process, such as the CLI, are taken into account
+	other, err := newSilenceStore(log, config)
+	if err != nil {
+		t.Fatalf("could not create silence store: %v", err)
+	}
+	if silenced, reason := other.Silenced(Alert{Rule: trafficRule, Subject: sectionSubject, Name: "/api"}, now); !silenced || reason != "silence "+silence.ID {
+		t.Errorf("expected alert to be silenced by the added silence, got %v %q", silenced, reason)
+	}
+
+	testCases := []struct {
+		alert Alert
+		time  time.Time
+
+		expectedSilenced bool
+	}{
+		{alert: Alert{Rule: noDataRule, Subject: totalSubject}, time: now, expectedSilenced: true},
+		{alert: Alert{Rule: noDataRule, Subject: totalSubject}, time: now.Add(2 * time.Hour), expectedSilenced: false},
+		{alert: Alert{Rule: trafficRule, Subject: totalSubject}, time: now, expectedSilenced: false},
+		{alert: Alert{Rule: trafficRule, Subject: sectionSubject, Name: "/batch"}, time: now.Add(30 * time.Minute), expectedSilenced: true},
+		{alert: Alert{Rule: trafficRule, Subject: sectionSubject, Name: "/batch"}, time: now.Add(90 * time.Minute), expectedSilenced: false},
+	}
+	for _, testCase := range testCases {
+		if silenced, _ := store.Silenced(testCase.alert, testCase.time); silenced != testCase.expectedSilenced {
+			t.Errorf("expected alert %+v to be silenced at %s: %v", testCase.alert, testCase.time, testCase.expectedSilenced)
+		}
+	}
+
+	silences, err := store.List(now)
+	if err != nil || len(silences) != 2 {
+		t.Errorf("expected 2 silences to be listed, got %d (%v)", len(silences), err)
+	}
+
+	if err := store.Remove(silence.ID, now); err != nil {
+		t.Errorf("could not remove silence: %v", err)
+	}
+	if err := store.Remove(silence.ID, now); err == nil {
+		t.Error("expected an error when removing a silence that does not exist")
+	}
+	if silenced, _ := store.Silenced(Alert{Rule: trafficRule, Subject: sectionSubject, Name: "/api"}, now); silenced {
+		t.Error("expected alert not to be silenced once the silence is removed")
+	}
+}
+
+// This test ensures that silenced alerts are still recorded into the alert history, but not notified
+func TestSilencedAlertsAreNotNotified(t *testing.T) {
+	baseTime := time.Date(1241, time.December, 11, 8, 42, 24, 0, time.UTC)
+
+	config := DefaultConfig()
+	config.SilencesPath = ""
+	config.Silences = []Silence{
+		{Matcher: Matcher{Rule: trafficRule}, StartsAt: baseTime, EndsAt: baseTime.Add(time.Hour), Comment: "load test"},
+	}
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	silences, err := newSilenceStore(log, config)
+	if err != nil {
+		t.Fatalf("could not create silence store: %v", err)
+	}
+
+	recorder := &alertRecorderMock{}
+	notifier := &notifierMock{}
+	lp := NewLogProcessor(log, log, config, recorder, []Notifier{notifier}, nil, silences, func() time.Time { return baseTime })
+
+	lp.Add([]*HTTPEntry{{Section: "/", Status: 200, Size: 10 * 1024 * 1024, Time: baseTime}})
+	lp.SetLogFileStatus("logs", os.ErrNotExist)
+
+	if len(recorder.alerts) != 2 {
+		t.Fatalf("expected 2 alerts to be recorded, got %d", len(recorder.alerts))
+	}
+	if !recorder.alerts[0].Silenced || recorder.alerts[0].Rule != trafficRule {
+		t.Errorf("expected traffic alert to be recorded as silenced, got %+v", recorder.alerts[0])
+	}
+	if len(notifier.alerts) != 1 || notifier.alerts[0].Rule != logFileRule {
+		t.Errorf("expected only the log file alert to be notified, got %+v", notifier.alerts)
+	}
+}
+
+func TestSilencesAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+	config := DefaultConfig()
+	config.SilencesPath = filepath.Join(dir, "silences.json")
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	store, err := newSilenceStore(log, config)
+	if err != nil {
+		t.Fatalf("could not create silence store: %v", err)
+	}
+
+	server := httptest.NewServer(newAPI(log, nil, store, "", RollupConfig{}, func() time.Time { return now }).Handler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/silences", "application/json", strings.NewReader(`{"rule": "traffic", "ends_at": "2018-05-08T10:00:00Z", "comment": "deploy"}`))
+	if err != nil {
+		t.Fatalf("could not create silence: %v", err)
+	}
+	var created Silence
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.ID == "" || !created.StartsAt.Equal(now) {
+		t.Errorf("unexpected response when creating silence: %d %+v", resp.StatusCode, created)
+	}
+
+	resp, err = http.Post(server.URL+"/api/silences", "application/json", strings.NewReader(`{"rule": "traffic"}`))
+	if err != nil {
+		t.Fatalf("could not create silence: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected invalid silence to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/api/silences")
+	if err != nil {
+		t.Fatalf("could not list silences: %v", err)
+	}
+	var listed []Silence
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Comment != "deploy" {
+		t.Errorf("unexpected silences listed: %+v", listed)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/silences/"+created.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not remove silence: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected silence to be removed, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not remove silence: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown silence not to be found, got %d", resp.StatusCode)
+	}
+
+	// a silences file that can't be read is a server error
+	if err := ioutil.WriteFile(config.SilencesPath, []byte("{"), 0644); err != nil {
+		t.Fatalf("could not write silences file: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/api/silences/"+created.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not remove silence: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a server error when the silences file is invalid, got %d", resp.StatusCode)
+	}
+}
+
+// This test ensures that silences that can't be persisted are not kept in memory, and that the API tells apart
+// the silences that are invalid, those that can't be stored because no silences file is configured, and failures
+// to write the silences file
+func TestSilencesAPIErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, time.May, 8, 8, 0, 0, 0, time.UTC)
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+
+	testCases := []struct {
+		path string
+		body string
+
+		expectedStatus int
+	}{
+		{path: filepath.Join(dir, "silences.json"), body: `{"rule": "traffic"}`, expectedStatus: http.StatusBadRequest},
+		{path: "", body: `{"rule": "traffic", "ends_at": "2018-05-08T10:00:00Z"}`, expectedStatus: http.StatusServiceUnavailable},
+		{path: filepath.Join(dir, "missing", "silences.json"), body: `{"rule": "traffic", "ends_at": "2018-05-08T10:00:00Z"}`, expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, testCase := range testCases {
+		config := DefaultConfig()
+		config.SilencesPath = testCase.path
+		store, err := newSilenceStore(log, config)
+		if err != nil {
+			t.Fatalf("could not create silence store: %v", err)
+		}
+		server := httptest.NewServer(newAPI(log, nil, store, "", RollupConfig{}, func() time.Time { return now }).Handler())
+
+		resp, err := http.Post(server.URL+"/api/silences", "application/json", strings.NewReader(testCase.body))
+		if err != nil {
+			t.Fatalf("could not create silence: %v", err)
+		}
+		resp.Body.Close()
+		server.Close()
+
+		if resp.StatusCode != testCase.expectedStatus {
+			t.Errorf("%q: expected status %d, got %d", testCase.path, testCase.expectedStatus, resp.StatusCode)
+		}
+		if silenced, _ := store.Silenced(Alert{Rule: trafficRule, Subject: totalSubject}, now); silenced {
+			t.Errorf("%q: expected the silence that was not stored not to be active", testCase.path)
+		}
+	}
+}
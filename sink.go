@@ -0,0 +1,139 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// RefreshStats aggregates the entries processed at a refresh, along with the traffic of the last 2 minutes
+type RefreshStats struct {
+	Time time.Time
+	// time up to which entries are expected to have been received, which is the time of the refresh minus the
+	// allowed lateness
+	Watermark time.Time
+
+	// entries received since the last refresh, in total and for each section
+	Hits     int
+	Bytes    uint64
+	Statuses statusCounts
+	Sections map[string]SectionRefreshStats
+	// entries received since the last refresh by the UTC minute of their own time, then by section
+	Minutes map[time.Time]map[string]SectionRefreshStats
+
+	// traffic over the last 2 minutes, its status classes and its top sections
+	WindowHits     int
+	WindowBytes    uint64
+	WindowStatuses statusCounts
+	TopSections    []SectionStats
+
+	// entries received since the agent started
+	TotalEntries int
+
+	// alerts that are currently pending or firing
+	Alerts []Alert
+
+	// time spent processing the entries
+	ProcessingDuration time.Duration
+}
+
+// SectionRefreshStats aggregates the entries of a section processed at a refresh
+type SectionRefreshStats struct {
+	Hits     int
+	Bytes    uint64
+	Statuses statusCounts
+}
+
+// MetricsSink receives the statistics of every refresh, for example to send them to a metrics pipeline.
+// Flush should never block the log processor for long.
+type MetricsSink interface {
+	Flush(stats RefreshStats) error
+}
+
+// newMetricsSinks creates the metrics sinks described in the configuration. Sinks that can't be created are
+// logged and ignored, so that a misconfigured sink does not prevent the agent from running
+func newMetricsSinks(log *zerolog.Logger, config Config) []MetricsSink {
+	var sinks []MetricsSink
+
+	if config.StatsD.Address != "" {
+		statsd, err := newStatsDSink(config.StatsD, config.MetricsMaxSections)
+		if err != nil {
+			log.Error().Err(err).Str("statsd_address", config.StatsD.Address).Msg("Could not create StatsD sink")
+		} else {
+			sinks = append(sinks, statsd)
+		}
+	}
+
+	if config.Export.Path != "" {
+		exporter, err := newReportExporter(config.Export)
+		if err != nil {
+			log.Error().Err(err).Str("export_path", config.Export.Path).Msg("Could not create report exporter")
+		} else {
+			sinks = append(sinks, exporter)
+		}
+	}
+
+	if config.Rollups.Path != "" {
+		rollups, err := newRollupStore(config.Rollups)
+		if err != nil {
+			log.Error().Err(err).Str("rollups_path", config.Rollups.Path).Msg("Could not create rollup store")
+		} else {
+			sinks = append(sinks, rollups)
+		}
+	}
+
+	return sinks
+}
+
+// refreshStats aggregates the entries received since the last refresh, sorted by section
+func (lp *LogProcessor) refreshStats(sortedData map[string][]*HTTPEntry, processing time.Duration) RefreshStats {
+	stats := RefreshStats{
+		Time:               lp.refreshedAt,
+		Watermark:          lp.watermark,
+		Sections:           make(map[string]SectionRefreshStats),
+		Minutes:            make(map[time.Time]map[string]SectionRefreshStats),
+		WindowHits:         lp.recentEntries,
+		WindowBytes:        lp.windowBytes(),
+		WindowStatuses:     lp.recentStatuses,
+		TopSections:        lp.topRecentSections(lp.topHitsNumber),
+		TotalEntries:       lp.totalEntries,
+		Alerts:             lp.activeAlerts(),
+		ProcessingDuration: processing,
+	}
+
+	for section, entries := range sortedData {
+		var sectionStats SectionRefreshStats
+		for _, entry := range entries {
+			sectionStats.Hits++
+			sectionStats.Bytes += entry.Size
+			sectionStats.Statuses.add(entry.Status)
+			stats.Statuses.add(entry.Status)
+
+			minute := entry.Time.UTC().Truncate(time.Minute)
+			if stats.Minutes[minute] == nil {
+				stats.Minutes[minute] = make(map[string]SectionRefreshStats)
+			}
+			minuteStats := stats.Minutes[minute][section]
+			minuteStats.Hits++
+			minuteStats.Bytes += entry.Size
+			minuteStats.Statuses.add(entry.Status)
+			stats.Minutes[minute][section] = minuteStats
+		}
+
+		stats.Hits += sectionStats.Hits
+		stats.Bytes += sectionStats.Bytes
+		stats.Sections[section] = sectionStats
+	}
+
+	return stats
+}
+
+// flush sends the statistics of a refresh to all metrics sinks
+func (lp *LogProcessor) flush(stats RefreshStats) {
+	for _, sink := range lp.sinks {
+		err := sink.Flush(stats)
+		if err != nil {
+			lp.log.Error().Err(err).Msg("Could not flush metrics")
+		}
+	}
+}
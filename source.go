@@ -0,0 +1,76 @@
+package main
+
+import "github.com/rs/zerolog"
+
+// SetLogFileStatus updates the alert about the log file being missing or unreadable, depending on the
+// error that was encountered while reading it, if any
+func (lp *LogProcessor) SetLogFileStatus(path string, err error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	// the value of this rule is 1 when the log file can't be read, and 0 otherwise
+	value := 0.0
+	if err != nil {
+		value = 1
+	}
+
+	var event *zerolog.Event
+	var message string
+	key := alertKey{rule: logFileRule, subject: alertSubject{kind: totalSubject}}
+	switch lp.updateAlertAt(key, lp.now(), value, 1, err != nil) {
+	case alertRaised:
+		event = lp.firingEvent(key).Err(err)
+		message = "Log file is missing or unreadable"
+	case alertOngoing:
+		event = lp.firingEvent(key).Err(err)
+		message = "Log file is still missing or unreadable"
+	case alertResolved:
+		event = lp.report.Info()
+		message = "Log file is readable again"
+	default:
+		return
+	}
+
+	event.
+		Str("log_file_path", path).
+		Msg(message)
+}
+
+// Prints a warning if no entries were received for longer than the configured timeout, and as long
+// as it is the case. Prints an information message when entries are received again.
+func (lp *LogProcessor) checkNoData(entries []*HTTPEntry) {
+	now := lp.refreshedAt
+	if len(entries) > 0 || lp.lastEntryAt.IsZero() {
+		lp.lastEntryAt = now
+	}
+
+	// a timeout of 0 disables this alert
+	if lp.noDataTimeout <= 0 {
+		return
+	}
+
+	silence := now.Sub(lp.lastEntryAt)
+
+	var event *zerolog.Event
+	var message string
+	exceeded := silence >= lp.noDataTimeout
+	key := alertKey{rule: noDataRule, subject: alertSubject{kind: totalSubject}}
+	switch lp.updateAlert(key, silence.Seconds(), lp.noDataTimeout.Seconds(), exceeded) {
+	case alertRaised:
+		event = lp.firingEvent(key)
+		message = "No new log entries were received for longer than the configured timeout"
+	case alertOngoing:
+		event = lp.firingEvent(key)
+		message = "Still no new log entries received"
+	case alertResolved:
+		event = lp.report.Info()
+		message = "New log entries are received again"
+	default:
+		return
+	}
+
+	event.
+		Time("last_entry_at", lp.lastEntryAt).
+		Str("timeout", lp.noDataTimeout.String()).
+		Msg(message)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// stateVersion is the version of the format of the state file. States written with an older version are
+// migrated when they are loaded, and states written with a newer version are not restored, so that the format
+// can change without misreading other files
+const stateVersion = 2
+
+// processorState is a snapshot of the state of the log processor, which is written to the state file and
+// restored when the agent restarts
+type processorState struct {
+	Version int `json:"version"`
+	// time at which the snapshot was taken, and log file from which the entries were read, with the position
+	// up to which they were read so that they are not counted again
+	Time     time.Time   `json:"time"`
+	Source   string      `json:"source"`
+	Position logPosition `json:"position"`
+
+	TotalEntries int       `json:"total_entries"`
+	LastEntryAt  time.Time `json:"last_entry_at"`
+
+	// most frequent keys of every dimension. The count-min sketches are not saved, so the counts of the keys
+	// that are not tracked start over
+	Sections   []HeavyHitter `json:"sections"`
+	Paths      []HeavyHitter `json:"paths"`
+	Clients    []HeavyHitter `json:"clients"`
+	UserAgents []HeavyHitter `json:"user_agents"`
+	// hits of every section, written by the version 1 of the format and migrated to the most frequent sections
+	Hits map[string]int `json:"hits,omitempty"`
+
+	// entries of the current window, and the ones newer than the watermark
+	Recent []stateEntry `json:"recent"`
+	// alerts that are pending or firing
+	Alerts []stateAlert `json:"alerts"`
+
+	// moving averages of the anomaly detection, when it is enabled
+	HitsDetector  *stateDetector `json:"hits_detector,omitempty"`
+	BytesDetector *stateDetector `json:"bytes_detector,omitempty"`
+}
+
+// stateEntry contains the fields of an HTTP entry that are used by the recent traffic
+type stateEntry struct {
+	Time          time.Time `json:"time"`
+	Section       string    `json:"section"`
+	ClientAddress string    `json:"client_address"`
+	Status        uint64    `json:"status"`
+	Size          uint64    `json:"size"`
+}
+
+// stateAlert is an active alert, with the last time its notifiers were notified so that it is not notified
+// again too early after a restart
+type stateAlert struct {
+	Alert
+	NotifiedAt time.Time `json:"notified_at"`
+}
+
+// stateDetector is the learned state of an anomaly detector
+type stateDetector struct {
+	Samples  int     `json:"samples"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+}
+
+// Snapshot returns the current state of the log processor
+func (lp *LogProcessor) Snapshot() processorState {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	state := processorState{
+		Version:      stateVersion,
+		Time:         lp.now(),
+		Source:       lp.source,
+		Position:     lp.position,
+		TotalEntries: lp.totalEntries,
+		LastEntryAt:  lp.lastEntryAt,
+		Recent:       make([]stateEntry, 0, len(lp.recent)),
+		Alerts:       make([]stateAlert, 0, len(lp.alerts)),
+	}
+
+	if lp.hits != nil {
+		state.Sections = lp.hits.sections.top(lp.hits.sections.capacity)
+		state.Paths = lp.hits.paths.top(lp.hits.paths.capacity)
+		state.Clients = lp.hits.clients.top(lp.hits.clients.capacity)
+		state.UserAgents = lp.hits.userAgents.top(lp.hits.userAgents.capacity)
+	}
+
+	for _, entry := range lp.recent {
+		state.Recent = append(state.Recent, stateEntry{
+			Time:          entry.Time,
+			Section:       entry.Section,
+			ClientAddress: entry.ClientAddress,
+			Status:        entry.Status,
+			Size:          entry.Size,
+		})
+	}
+
+	for _, alert := range lp.alerts {
+		state.Alerts = append(state.Alerts, stateAlert{Alert: *alert, NotifiedAt: alert.notifiedAt})
+	}
+
+	if lp.hitsDetector != nil && lp.bytesDetector != nil {
+		state.HitsDetector = lp.hitsDetector.state()
+		state.BytesDetector = lp.bytesDetector.state()
+	}
+
+	return state
+}
+
+// Restore replaces the state of the log processor with a snapshot. Entries that are older than the current
+// window are discarded, and the alerts are evaluated again at the next refresh
+func (lp *LogProcessor) Restore(state processorState) error {
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d, expected %d", state.Version, stateVersion)
+	}
+	if state.Source != lp.source {
+		return fmt.Errorf("state of log file %q, expected %q", state.Source, lp.source)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.position = state.Position
+	lp.totalEntries = state.TotalEntries
+	lp.lastEntryAt = state.LastEntryAt
+
+	if lp.hits == nil {
+		lp.hits = newTopKeys(HeavyHittersConfig{})
+	}
+	lp.hits.sections.restore(state.Sections)
+	lp.hits.paths.restore(state.Paths)
+	lp.hits.clients.restore(state.Clients)
+	lp.hits.userAgents.restore(state.UserAgents)
+
+	windowStart := lp.now().Add(-lp.allowedLateness - 120*time.Second)
+	lp.recent = nil
+	for _, entry := range state.Recent {
+		if !entry.Time.After(windowStart) {
+			continue
+		}
+		lp.recent = append(lp.recent, &HTTPEntry{
+			Time:          entry.Time,
+			Section:       entry.Section,
+			ClientAddress: entry.ClientAddress,
+			Status:        entry.Status,
+			Size:          entry.Size,
+		})
+	}
+
+	lp.alerts = make(map[alertKey]*Alert, len(state.Alerts))
+	for _, restored := range state.Alerts {
+		alert := restored.Alert
+		alert.notifiedAt = restored.NotifiedAt
+		lp.alerts[alertKey{rule: alert.Rule, subject: alertSubject{kind: alert.Subject, name: alert.Name}}] = &alert
+	}
+
+	if lp.hitsDetector != nil && state.HitsDetector != nil {
+		lp.hitsDetector.restore(state.HitsDetector)
+	}
+	if lp.bytesDetector != nil && state.BytesDetector != nil {
+		lp.bytesDetector.restore(state.BytesDetector)
+	}
+
+	return nil
+}
+
+func (d *ewmaDetector) state() *stateDetector {
+	return &stateDetector{Samples: d.samples, Mean: d.mean, Variance: d.variance}
+}
+
+func (d *ewmaDetector) restore(state *stateDetector) {
+	d.samples = state.Samples
+	d.mean = state.Mean
+	d.variance = state.Variance
+}
+
+// loadState reads a snapshot from the state file
+func loadState(path string) (processorState, error) {
+	var state processorState
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("invalid state file: %v", err)
+	}
+	state.migrate()
+	return state, nil
+}
+
+// migrate converts a state written with an older version of the format to the current one. The version 1
+// counted the hits of every section, which become the most frequent sections, without any error
+func (state *processorState) migrate() {
+	if state.Version != 1 {
+		return
+	}
+
+	for section, hits := range state.Hits {
+		state.Sections = append(state.Sections, HeavyHitter{Key: section, Count: uint64(hits)})
+	}
+	sort.Slice(state.Sections, func(i, j int) bool {
+		if state.Sections[i].Count == state.Sections[j].Count {
+			return state.Sections[i].Key < state.Sections[j].Key
+		}
+		return state.Sections[i].Count > state.Sections[j].Count
+	})
+	state.Hits = nil
+	state.Version = stateVersion
+}
+
+// saveState writes a snapshot to the state file. It is written to a temporary file first, so that the state
+// file is never left partially written
+func saveState(path string, state processorState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreState restores the state of the log processor from the state file, if there is one
+func restoreState(log *zerolog.Logger, path string, logProcessor *LogProcessor) {
+	state, err := loadState(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = logProcessor.Restore(state)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("state_path", path).Msg("Could not restore state, starting from scratch")
+		return
+	}
+
+	log.Info().
+		Str("state_path", path).
+		Time("snapshot_time", state.Time).
+		Int64("log_file_offset", state.Position.Offset).
+		Int("total_entries", state.TotalEntries).
+		Int("active_alerts", len(state.Alerts)).
+		Msg("Restored state")
+}
+
+// snapshotState periodically writes the state of the log processor to the state file
+func snapshotState(log *zerolog.Logger, path string, interval time.Duration, logProcessor *LogProcessor) {
+	for range time.Tick(interval) {
+		err := saveState(path, logProcessor.Snapshot())
+		if err != nil {
+			log.Error().Err(err).Str("state_path", path).Msg("Could not save state")
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test ensures that the state of the log processor is restored after a restart: the all-time hits, the
+// entries that are still in the window and the firing alerts, which are not notified again
+func TestStateRestore(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 2
+	config.NoDataTimeout = Duration{}
+	config.RenotifyIntervals = map[Severity]Duration{SeverityWarning: {time.Hour}}
+	config.Anomaly.Enabled = true
+
+	log := NewZeroLog(ioutil.Discard, JSON)
+	lp := NewLogProcessor(log, log, config, nil, nil, nil, nil, func() time.Time { return now })
+
+	lp.Add([]*HTTPEntry{
+		{Section: "/old", Status: 200, Size: 10, Time: baseTime.Add(-100 * time.Second)},
+		{Section: "/api", ClientAddress: "10.0.0.1", Status: 200, Size: 3 * 1024 * 1024, Time: baseTime},
+		{Section: "/api", ClientAddress: "10.0.0.1", Status: 500, Size: 10, Time: baseTime},
+	})
+
+	path := filepath.Join(dir, "state.json")
+	if err := saveState(path, lp.Snapshot()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the agent restarts 30 seconds later, so the oldest entry is no longer in the window
+	now = baseTime.Add(30 * time.Second)
+	report := &bytes.Buffer{}
+	restored := NewLogProcessor(log, NewZeroLog(report, JSON), config, nil, nil, nil, nil, func() time.Time { return now })
+	if err := restored.Restore(state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(restored.recent) != 2 || restored.totalEntries != 3 || restored.hits.sections.count("/api") != 2 || restored.hits.sections.count("/old") != 1 {
+		t.Errorf("unexpected restored state: %d recent entries, %d entries, sections %+v", len(restored.recent), restored.totalEntries, restored.hits.sections.top(10))
+	}
+	if restored.hits.clients.count("10.0.0.1") != 2 {
+		t.Errorf("expected the top clients to be restored, got %+v", restored.hits.clients.top(10))
+	}
+	if restored.hitsDetector.samples != 1 {
+		t.Errorf("expected the anomaly detection to be restored, got %+v", restored.hitsDetector)
+	}
+
+	alert, ok := restored.alerts[alertKey{rule: trafficRule, subject: alertSubject{kind: totalSubject}}]
+	if !ok || alert.State != AlertFiring || !alert.notifiedAt.Equal(baseTime) {
+		t.Fatalf("expected the firing traffic alert to be restored, got %+v", restored.alerts)
+	}
+
+	// the alert keeps firing without being raised or notified again
+	restored.Add(nil)
+	if strings.Contains(report.String(), "exceeds the configured threshold") || strings.Contains(report.String(), "back to normal") {
+		t.Errorf("expected the restored alert to keep firing silently, got %s", report.String())
+	}
+	if restored.WindowStats().Entries != 2 {
+		t.Errorf("expected the restored entries to be in the window, got %+v", restored.WindowStats())
+	}
+
+	state.Version = stateVersion + 1
+	if err := restored.Restore(state); err == nil {
+		t.Error("expected a state with another version to be refused")
+	}
+
+	state.Version = stateVersion
+	state.Source = "other.log"
+	if err := restored.Restore(state); err == nil {
+		t.Error("expected the state of another log file to be refused")
+	}
+}
+
+// This test ensures that the log file is read from where it was read before a restart, so that its entries are
+// not counted twice, and that it is read from the beginning again when it was rotated while the agent was stopped
+func TestStateResumesLogFile(t *testing.T) {
+	now := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "access.log")
+	write := func(flag int, lines ...string) {
+		f, err := os.OpenFile(logPath, flag|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("could not write log file: %v", err)
+		}
+		defer f.Close()
+		for _, line := range lines {
+			f.WriteString(line + "\n")
+		}
+	}
+	line := `10.0.0.1 - - [08/May/2018:10:00:00 +0000] "GET /api/user HTTP/1.1" 200 100`
+
+	config := DefaultConfig()
+	config.LogFilePath = logPath
+	config.NoDataTimeout = Duration{}
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	// run reads the new lines of the log file with a new log processor restored from the state, if any
+	statePath := filepath.Join(dir, "state.json")
+	run := func() *LogProcessor {
+		lp := NewLogProcessor(log, log, config, nil, nil, nil, nil, func() time.Time { return now })
+		restoreState(log, statePath, lp)
+
+		file := newLogFile(log, logPath)
+		defer file.Close()
+		file.Resume(lp.LogFilePosition())
+
+		lines, err := file.ReadLines()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		entries := make([]*HTTPEntry, len(lines))
+		for i := range lines {
+			entries[i] = &HTTPEntry{Section: "/api", Status: 200, Size: 100, Time: now}
+		}
+		lp.AddRead(entries, file.Position())
+
+		if err := saveState(statePath, lp.Snapshot()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return lp
+	}
+
+	write(os.O_TRUNC, line, line, line)
+	run()
+
+	// the agent restarts after a line was appended, which is the only one to be read
+	write(os.O_APPEND, line)
+	lp := run()
+	if lp.totalEntries != 4 || lp.hits.sections.count("/api") != 4 || len(lp.recent) != 4 {
+		t.Errorf("expected 4 entries after the restart, got %d entries, %d hits and %d recent entries", lp.totalEntries, lp.hits.sections.count("/api"), len(lp.recent))
+	}
+
+	// the log file is rotated while the agent is stopped, so the new file is read from the beginning
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("could not rotate log file: %v", err)
+	}
+	write(os.O_TRUNC, line, line, line, line, line)
+	lp = run()
+	if lp.totalEntries != 9 {
+		t.Errorf("expected the rotated log file to be read from the beginning, got %d entries", lp.totalEntries)
+	}
+}
+
+// This test ensures that a state written with the version 1 of the format, which counted the hits of every
+// section, is migrated to the most frequent sections when it is restored
+func TestStateMigratesVersion1(t *testing.T) {
+	now := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "state.json")
+	v1 := `{
+		"version": 1,
+		"time": "2018-05-08T09:59:30Z",
+		"source": "logs",
+		"total_entries": 10,
+		"hits": {"/api": 6, "/static": 3, "/admin": 1},
+		"last_entry_at": "2018-05-08T09:59:20Z",
+		"recent": [{"time": "2018-05-08T09:59:20Z", "section": "/api", "client_address": "10.0.0.1", "status": 200, "size": 100}],
+		"alerts": []
+	}`
+	if err := ioutil.WriteFile(statePath, []byte(v1), 0644); err != nil {
+		t.Fatalf("could not write state file: %v", err)
+	}
+
+	state, err := loadState(statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.Version != stateVersion || state.Hits != nil {
+		t.Errorf("expected the state to be migrated to version %d, got %+v", stateVersion, state)
+	}
+
+	buffer := &bytes.Buffer{}
+	log := NewZeroLog(buffer, JSON)
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil, nil, nil, nil, func() time.Time { return now })
+	restoreState(log, statePath, lp)
+	if !strings.Contains(buffer.String(), "Restored state") {
+		t.Fatalf("expected the state to be restored, got %s", buffer.String())
+	}
+
+	top := lp.hits.sections.top(10)
+	if len(top) != 3 || top[0].Key != "/api" || top[0].Count != 6 || top[1].Key != "/static" || top[2].Key != "/admin" {
+		t.Errorf("expected the hits of every section to be restored, got %+v", top)
+	}
+	if lp.totalEntries != 10 || len(lp.recent) != 1 {
+		t.Errorf("expected 10 entries and 1 recent entry to be restored, got %d and %d", lp.totalEntries, len(lp.recent))
+	}
+}
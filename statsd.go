@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// invalidStatsDName matches the characters that can't be used in StatsD metric names
+var invalidStatsDName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// statsdTagEscaper replaces the characters that have a meaning in DogStatsD tags
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdSink sends the statistics of every refresh to a StatsD server over UDP. With DogStatsD, sections
+// and status classes are sent as tags, otherwise they are part of the metric names
+type statsdSink struct {
+	config StatsDConfig
+	conn   net.Conn
+
+	// sections that have their own metrics, at most maxSections of them. The traffic of the other sections
+	// is sent with the "other" section, so that the number of metrics stays bounded
+	maxSections int
+	sections    map[string]bool
+}
+
+// newStatsDSink creates a StatsD sink sending metrics to the configured address, with metrics for at most
+// maxSections sections, 0 meaning no limit
+func newStatsDSink(config StatsDConfig, maxSections int) (*statsdSink, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{config: config, conn: conn, maxSections: maxSections, sections: make(map[string]bool)}, nil
+}
+
+// Flush sends the statistics of a refresh: counters for the hits, bytes and status classes, and gauges for the
+// traffic over the last 2 minutes
+func (s *statsdSink) Flush(stats RefreshStats) error {
+	var lines []string
+
+	lines = append(lines,
+		s.line("hits", stats.Hits, "c", nil),
+		s.line("bytes", stats.Bytes, "c", nil),
+	)
+	for class := 1; class < len(stats.Statuses); class++ {
+		lines = append(lines, s.line("status", stats.Statuses[class], "c", []string{"class", statusClasses[class]}))
+	}
+
+	// sections are tracked in alphabetical order when too many of them are received at once
+	received := make([]string, 0, len(stats.Sections))
+	for section := range stats.Sections {
+		received = append(received, section)
+	}
+	sort.Strings(received)
+
+	bySection := make(map[string]SectionRefreshStats)
+	for _, section := range received {
+		name := s.trackSection(section)
+		sectionStats := bySection[name]
+		sectionStats.Hits += stats.Sections[section].Hits
+		sectionStats.Bytes += stats.Sections[section].Bytes
+		bySection[name] = sectionStats
+	}
+
+	sections := make([]string, 0, len(bySection))
+	for section := range bySection {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		sectionStats := bySection[section]
+		lines = append(lines,
+			s.line("section.hits", sectionStats.Hits, "c", []string{"section", section}),
+			s.line("section.bytes", sectionStats.Bytes, "c", []string{"section", section}),
+		)
+	}
+
+	lines = append(lines,
+		s.line("window.hits", stats.WindowHits, "g", nil),
+		s.line("window.bytes", stats.WindowBytes, "g", nil),
+	)
+
+	return s.send(lines)
+}
+
+// trackSection returns the section under which the metrics of a section are sent: the section itself if it
+// already has its own metrics or if there is room for it, and the "other" section otherwise
+func (s *statsdSink) trackSection(section string) string {
+	if s.sections[section] {
+		return section
+	}
+	if s.maxSections > 0 && len(s.sections) >= s.maxSections {
+		return otherSection
+	}
+	s.sections[section] = true
+	return section
+}
+
+// line formats a metric. The label is sent as a tag with DogStatsD, and otherwise inserted into the metric
+// name: "section.hits" with the section "/api" becomes "section.api.hits"
+func (s *statsdSink) line(name string, value interface{}, kind string, label []string) string {
+	var tags []string
+	if len(label) == 2 {
+		if s.config.DogStatsD {
+			tags = append(tags, label[0]+":"+statsdTagEscaper.Replace(label[1]))
+		} else {
+			name = insertStatsDLabel(name, label[1])
+		}
+	}
+
+	line := fmt.Sprintf("%s%s:%v|%s", s.config.Prefix, name, value, kind)
+	if s.config.DogStatsD {
+		tags = append(tags, s.globalTags()...)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	}
+	return line
+}
+
+// globalTags returns the tags configured for all metrics, sorted by name
+func (s *statsdSink) globalTags() []string {
+	tags := make([]string, 0, len(s.config.Tags))
+	for name, value := range s.config.Tags {
+		tags = append(tags, statsdTagEscaper.Replace(name)+":"+statsdTagEscaper.Replace(value))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// insertStatsDLabel inserts a label after the first component of a metric name, sanitizing it so that it
+// forms a single component
+func insertStatsDLabel(name, label string) string {
+	label = strings.Trim(invalidStatsDName.ReplaceAllString(label, "_"), "_")
+	if label == "" {
+		label = "root"
+	}
+
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 1 {
+		return name + "." + label
+	}
+	return parts[0] + "." + label + "." + parts[1]
+}
+
+// send sends metric lines, packing as many of them as possible in each packet
+func (s *statsdSink) send(lines []string) error {
+	packet := &bytes.Buffer{}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.config.MaxPacketSize {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(packet.Bytes())
+	return err
+}
+
+// Close closes the connection to the StatsD server
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsD starts a local UDP listener and returns the metric lines it receives
+func listenStatsD(t *testing.T) (*net.UDPConn, func(packets int) []string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen on UDP: %v", err)
+	}
+
+	receive := func(packets int) []string {
+		var lines []string
+		buffer := make([]byte, 65536)
+		for i := 0; i < packets; i++ {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(buffer)
+			if err != nil {
+				t.Fatalf("expected %d packets, got %d: %v", packets, i, err)
+			}
+			lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+		}
+		return lines
+	}
+
+	return conn, receive
+}
+
+func TestStatsDSink(t *testing.T) {
+	stats := RefreshStats{
+		Hits:  3,
+		Bytes: 1500,
+		Sections: map[string]SectionRefreshStats{
+			"/api":  {Hits: 2, Bytes: 1000},
+			"/user": {Hits: 1, Bytes: 500},
+		},
+		WindowHits:         10,
+		WindowBytes:        4200,
+		ProcessingDuration: 1500 * time.Microsecond,
+	}
+	stats.Statuses.add(200)
+	stats.Statuses.add(200)
+	stats.Statuses.add(503)
+
+	testCases := []struct {
+		name   string
+		config StatsDConfig
+
+		expectedLines []string
+	}{
+		{
+			name:   "statsd",
+			config: StatsDConfig{Prefix: "hk.", MaxPacketSize: 1432, Tags: map[string]string{"env": "test"}},
+			expectedLines: []string{
+				"hk.hits:3|c",
+				"hk.bytes:1500|c",
+				"hk.status.2xx:2|c",
+				"hk.status.5xx:1|c",
+				"hk.section.api.hits:2|c",
+				"hk.section.user.bytes:500|c",
+				"hk.window.hits:10|g",
+				"hk.window.bytes:4200|g",
+			},
+		},
+		{
+			name:   "dogstatsd",
+			config: StatsDConfig{Prefix: "hk.", MaxPacketSize: 1432, DogStatsD: true, Tags: map[string]string{"env": "test"}},
+			expectedLines: []string{
+				"hk.hits:3|c|#env:test",
+				"hk.status:2|c|#class:2xx,env:test",
+				"hk.section.hits:2|c|#section:/api,env:test",
+				"hk.section.bytes:500|c|#section:/user,env:test",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		listener, receive := listenStatsD(t)
+
+		testCase.config.Address = listener.LocalAddr().String()
+		sink, err := newStatsDSink(testCase.config, 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", testCase.name, err)
+		}
+
+		err = sink.Flush(stats)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.name, err)
+		}
+
+		lines := receive(1)
+		for _, expected := range testCase.expectedLines {
+			found := false
+			for _, line := range lines {
+				found = found || line == expected
+			}
+			if !found {
+				t.Errorf("%s: expected metric %s, got %v", testCase.name, expected, lines)
+			}
+		}
+
+		sink.Close()
+		listener.Close()
+	}
+}
+
+// This test ensures that only the first sections have their own metrics, and that the traffic of the other
+// sections is sent with the "other" section
+func TestStatsDSinkMaxSections(t *testing.T) {
+	listener, receive := listenStatsD(t)
+	defer listener.Close()
+
+	sink, err := newStatsDSink(StatsDConfig{Address: listener.LocalAddr().String(), Prefix: "hk.", MaxPacketSize: 1432}, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	flushes := []map[string]SectionRefreshStats{
+		{"/api": {Hits: 2}, "/static": {Hits: 1}},
+		{"/api": {Hits: 1}, "/probe1": {Hits: 3}, "/probe2": {Hits: 4}},
+	}
+	var lines []string
+	for _, sections := range flushes {
+		if err := sink.Flush(RefreshStats{Sections: sections}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		lines = append(lines, receive(1)...)
+	}
+
+	for _, expected := range []string{"hk.section.api.hits:2|c", "hk.section.static.hits:1|c", "hk.section.api.hits:1|c", "hk.section.other.hits:7|c"} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+		if !found {
+			t.Errorf("expected metric %s, got %v", expected, lines)
+		}
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "probe") {
+			t.Errorf("unexpected metric %s for a section past the maximum", line)
+		}
+	}
+}
+
+// This test ensures that metrics are split into several packets when they don't fit into a single one
+func TestStatsDSinkPacketSize(t *testing.T) {
+	listener, receive := listenStatsD(t)
+	defer listener.Close()
+
+	sink, err := newStatsDSink(StatsDConfig{Address: listener.LocalAddr().String(), Prefix: "hk.", MaxPacketSize: 64}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	err = sink.send([]string{"hk.hits:3|c", "hk.bytes:1500|c", "hk.status.2xx:2|c", "hk.status.5xx:1|c", "hk.window.hits:10|g"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := receive(2)
+	if len(lines) != 5 {
+		t.Errorf("expected 5 metrics in 2 packets, got %v", lines)
+	}
+}
+
+func TestInsertStatsDLabel(t *testing.T) {
+	testCases := []struct {
+		name  string
+		label string
+
+		expected string
+	}{
+		{name: "section.hits", label: "/api", expected: "section.api.hits"},
+		{name: "section.hits", label: "/", expected: "section.root.hits"},
+		{name: "section.hits", label: "/my.page", expected: "section.my_page.hits"},
+		{name: "status", label: "2xx", expected: "status.2xx"},
+	}
+
+	for _, testCase := range testCases {
+		if name := insertStatsDLabel(testCase.name, testCase.label); name != testCase.expected {
+			t.Errorf("expected %s with label %s to be %s, got %s", testCase.name, testCase.label, testCase.expected, name)
+		}
+	}
+}
+
+// This test ensures that the log processor flushes the statistics of every refresh to its sinks
+func TestRefreshStats(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	listener, receive := listenStatsD(t)
+	defer listener.Close()
+
+	sink, err := newStatsDSink(StatsDConfig{Address: listener.LocalAddr().String(), Prefix: "hk.", MaxPacketSize: 1432}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	lp := NewLogProcessor(log, log, DefaultConfig(), nil, nil, []MetricsSink{sink}, nil, func() time.Time { return baseTime })
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 100, Time: baseTime},
+		{Section: "/api", Status: 404, Size: 50, Time: baseTime},
+	})
+
+	lines := strings.Join(receive(1), "\n")
+	for _, expected := range []string{"hk.hits:2|c", "hk.bytes:150|c", "hk.status.4xx:1|c", "hk.section.api.hits:2|c", "hk.window.hits:2|g"} {
+		if !strings.Contains(lines, expected+"\n") {
+			t.Errorf("expected metric %s, got:\n%s", expected, lines)
+		}
+	}
+}
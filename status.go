@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+// statusClasses are the names of the HTTP status classes, indexed by their first digit
+var statusClasses = [...]string{1: "1xx", 2: "2xx", 3: "3xx", 4: "4xx", 5: "5xx"}
+
+// statusCounts counts HTTP entries by status class, indexed by the first digit of their status
+type statusCounts [len(statusClasses)]int
+
+// add counts an entry with the given status, ignoring statuses that don't belong to any class
+func (sc *statusCounts) add(status uint64) {
+	class := status / 100
+	if class < 1 || class >= uint64(len(sc)) {
+		return
+	}
+	sc[class]++
+}
+
+// total returns the number of entries that were counted
+func (sc statusCounts) total() int {
+	total := 0
+	for _, count := range sc {
+		total += count
+	}
+	return total
+}
+
+// rate returns the percentage of counted entries that belong to the given status class
+func (sc statusCounts) rate(class int) float64 {
+	total := sc.total()
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(sc[class]) / float64(total)
+}
+
+// log adds the count of each status class to a log event
+func (sc statusCounts) log(event *zerolog.Event) *zerolog.Event {
+	for class := 1; class < len(sc); class++ {
+		event = event.Int(statusClasses[class], sc[class])
+	}
+	return event
+}
+
+// MarshalJSON writes the count of each status class, such as {"2xx": 12, "5xx": 1, ...}
+func (sc statusCounts) MarshalJSON() ([]byte, error) {
+	counts := make(map[string]int)
+	for class := 1; class < len(sc); class++ {
+		counts[statusClasses[class]] = sc[class]
+	}
+	return json.Marshal(counts)
+}
+
+// UnmarshalJSON reads the count of each status class written by MarshalJSON, ignoring unknown classes
+func (sc *statusCounts) UnmarshalJSON(data []byte) error {
+	var counts map[string]int
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+
+	*sc = statusCounts{}
+	for class := 1; class < len(sc); class++ {
+		sc[class] = counts[statusClasses[class]]
+	}
+	return nil
+}
+
+// StatusBreakdown contains the status classes of the entries from the last 2 minutes, in total and for
+// each section
+type StatusBreakdown struct {
+	Total    statusCounts            `json:"total"`
+	Sections map[string]statusCounts `json:"sections"`
+}
+
+// StatusBreakdown returns the status classes of the entries from the last 2 minutes
+func (lp *LogProcessor) StatusBreakdown() StatusBreakdown {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	breakdown := StatusBreakdown{
+		Total:    lp.recentStatuses,
+		Sections: make(map[string]statusCounts),
+	}
+	for section, counts := range lp.recentSectionStatuses {
+		breakdown.Sections[section] = counts
+	}
+	return breakdown
+}
+
+// errorRateRule describes an alerting rule on the ratio of a status class
+type errorRateRule struct {
+	rule      string
+	title     string
+	class     int
+	threshold float64
+}
+
+// Processes the status classes of the entries from the last 2 minutes, and checks whether
+// the ratio of server errors (5xx) and client errors (4xx) exceeds the configured thresholds
+// both for the total traffic and for each section.
+func (lp *LogProcessor) checkErrorRates(window []*HTTPEntry) {
+	lp.recentStatuses = statusCounts{}
+	lp.recentSectionStatuses = make(map[string]statusCounts)
+	for _, entry := range window {
+		lp.recentStatuses.add(entry.Status)
+
+		sectionStatuses := lp.recentSectionStatuses[entry.Section]
+		sectionStatuses.add(entry.Status)
+		lp.recentSectionStatuses[entry.Section] = sectionStatuses
+	}
+
+	rules := []errorRateRule{
+		{rule: serverErrorRateRule, title: "server error rate", class: 5, threshold: lp.serverErrorRateThreshold},
+		{rule: clientErrorRateRule, title: "client error rate", class: 4, threshold: lp.clientErrorRateThreshold},
+	}
+	for _, rule := range rules {
+		// a threshold of 0 disables the rule
+		if rule.threshold <= 0 {
+			continue
+		}
+
+		lp.checkErrorRate(rule, alertSubject{kind: totalSubject}, lp.recentStatuses)
+
+		sections := make(map[string]statusCounts)
+		for section, statuses := range lp.recentSectionStatuses {
+			sections[section] = statuses
+		}
+		// sections that are currently alerting need to be checked even if they are no longer in the window
+		// so that their alert can be resolved
+		for _, section := range lp.alertingSubjects(rule.rule, sectionSubject) {
+			sections[section] = lp.recentSectionStatuses[section]
+		}
+
+		for section, statuses := range sections {
+			lp.checkErrorRate(rule, alertSubject{kind: sectionSubject, name: section}, statuses)
+		}
+	}
+}
+
+// Compares the error rate of a subject to the threshold of a rule and updates the state of its alert.
+// Subjects with less requests than the configured minimum are considered as not exceeding the threshold.
+func (lp *LogProcessor) checkErrorRate(rule errorRateRule, subject alertSubject, statuses statusCounts) {
+	requests := statuses.total()
+	errorRate := statuses.rate(rule.class)
+	exceeded := requests >= lp.errorRateMinRequests && errorRate >= rule.threshold
+
+	var event *zerolog.Event
+	var message string
+	key := alertKey{rule: rule.rule, subject: subject}
+	switch lp.updateAlert(key, errorRate, rule.threshold, exceeded) {
+	case alertRaised:
+		event = lp.firingEvent(key)
+		message = "over the last 2 minutes exceeds the configured threshold"
+	case alertOngoing:
+		event = lp.firingEvent(key)
+		message = "over the last 2 minutes still exceeds the configured threshold"
+	case alertResolved:
+		event = lp.report.Info()
+		message = "over the last 2 minutes is back to normal"
+	default:
+		return
+	}
+
+	if subject.kind != totalSubject {
+		event = event.Str(subject.kind, subject.name)
+	}
+	event.
+		Str("error_rate", fmt.Sprintf("%.1f%%", errorRate)).
+		Str("threshold", fmt.Sprintf("%.1f%%", rule.threshold)).
+		Int("requests", requests).
+		Msgf("%s %s %s", alertSubjectTitles[subject.kind], rule.title, message)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// logFile reads the lines that are appended to a log file. It reopens the file when it
+// disappears and comes back, or when it is replaced by a new one, for example after a rotation
+type logFile struct {
+	log  *zerolog.Logger
+	path string
+
+	file *os.File
+	info os.FileInfo
+
+	// position from which the file is read when it is opened, for example after a restart
+	resume *logPosition
+}
+
+// logPosition is the position up to which a log file was read, with the identity of the file so that the
+// position is not used to read another file after a rotation
+type logPosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func newLogFile(log *zerolog.Logger, path string) *logFile {
+	return &logFile{
+		log:  log,
+		path: path,
+	}
+}
+
+// Resume makes the log file read from a position at which it was previously read, if it is still the same file
+// when it is opened and it was not truncated since. Otherwise, it is read from the beginning
+func (lf *logFile) Resume(position logPosition) {
+	if position.Offset > 0 {
+		lf.resume = &position
+	}
+}
+
+// Position returns the position up to which the log file was read
+func (lf *logFile) Position() logPosition {
+	if lf.file == nil {
+		return logPosition{}
+	}
+
+	offset, err := lf.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return logPosition{}
+	}
+	return logPosition{Inode: fileInode(lf.info), Offset: offset}
+}
+
+// ReadLines returns the lines that were written to the log file since the last call.
+// It returns an error if the log file is missing or can't be read. When the file was rotated, the lines written
+// to the previous file before it was replaced are returned first, along with the error if there is no new file.
+func (lf *logFile) ReadLines() ([]string, error) {
+	info, err := os.Stat(lf.path)
+	if err != nil {
+		lines, _ := lf.drain()
+		return lines, err
+	}
+
+	var lines []string
+	if lf.file != nil && !os.SameFile(lf.info, info) {
+		lf.log.Info().Str("log_file_path", lf.path).Msg("Log file was replaced, reopening it")
+		lines, err = lf.drain()
+		if err != nil {
+			lf.log.Error().Err(err).Str("log_file_path", lf.path).Msg("Could not read the end of the replaced log file")
+		}
+	}
+
+	if lf.file == nil {
+		lf.file, err = os.Open(lf.path)
+		if err != nil {
+			return lines, err
+		}
+		if err = lf.seekResume(info); err != nil {
+			return lines, err
+		}
+	}
+	lf.info = info
+
+	// if the file was truncated, start reading it from the beginning again
+	offset, err := lf.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return lines, err
+	}
+	if info.Size() < offset {
+		lf.log.Info().Str("log_file_path", lf.path).Msg("Log file was truncated, reading it from the beginning")
+		if _, err = lf.file.Seek(0, io.SeekStart); err != nil {
+			return lines, err
+		}
+	}
+
+	newLines, err := readLines(lf.file)
+	return append(lines, newLines...), err
+}
+
+// drain reads the lines that were written to the open file until it was rotated or removed, and closes it
+func (lf *logFile) drain() ([]string, error) {
+	if lf.file == nil {
+		return nil, nil
+	}
+
+	lines, err := readLines(lf.file)
+	lf.Close()
+	return lines, err
+}
+
+// readLines reads the lines of a file from its current offset to its end
+func readLines(file *os.File) ([]string, error) {
+	// Recreate scanner at every call to ensure that it gets the new data
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+// seekResume seeks the position from which the file is resumed, if it is the file that was previously read
+func (lf *logFile) seekResume(info os.FileInfo) error {
+	if lf.resume == nil {
+		return nil
+	}
+	position := *lf.resume
+	lf.resume = nil
+
+	if fileInode(info) != position.Inode || info.Size() < position.Offset {
+		lf.log.Info().Str("log_file_path", lf.path).Msg("Log file changed since it was last read, reading it from the beginning")
+		return nil
+	}
+
+	lf.log.Info().Str("log_file_path", lf.path).Int64("offset", position.Offset).Msg("Resuming log file from where it was last read")
+	_, err := lf.file.Seek(position.Offset, io.SeekStart)
+	return err
+}
+
+// Close closes the log file if it is open
+func (lf *logFile) Close() {
+	if lf.file == nil {
+		return
+	}
+
+	lf.file.Close()
+	lf.file = nil
+	lf.info = nil
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// fileInode returns 0, as files are not identified by an inode on this platform. A log file is then resumed
+// as long as it was not truncated
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
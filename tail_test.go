@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hk-agent")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	file := newLogFile(log, path)
+	defer file.Close()
+
+	// missing file
+	if _, err := file.ReadLines(); err == nil {
+		t.Error("expected an error when the log file is missing")
+	}
+
+	write := func(flag int, content string) {
+		f, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("could not write log file: %v", err)
+		}
+		defer f.Close()
+		f.WriteString(content)
+	}
+
+	testCases := []struct {
+		description string
+		write       func()
+
+		expectedLines []string
+	}{
+		{
+			description:   "file created",
+			write:         func() { write(os.O_TRUNC, "first\nsecond\n") },
+			expectedLines: []string{"first", "second"},
+		},
+		{
+			description:   "no new lines",
+			write:         func() {},
+			expectedLines: nil,
+		},
+		{
+			description:   "lines appended",
+			write:         func() { write(os.O_APPEND, "third\n") },
+			expectedLines: []string{"third"},
+		},
+		{
+			description: "file rotated",
+			write: func() {
+				write(os.O_APPEND, "before rotation\n")
+				os.Rename(path, path+".1")
+				write(os.O_TRUNC, "rotated\n")
+			},
+			expectedLines: []string{"before rotation", "rotated"},
+		},
+		{
+			description:   "file truncated",
+			write:         func() { write(os.O_TRUNC, "new\n") },
+			expectedLines: []string{"new"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase.write()
+
+		lines, err := file.ReadLines()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.description, err)
+		}
+		if !reflect.DeepEqual(lines, testCase.expectedLines) {
+			t.Errorf("%s: expected lines to be %v, were %v instead", testCase.description, testCase.expectedLines, lines)
+		}
+	}
+
+	// the lines written before the file is rotated are read even if the new file is not created yet
+	write(os.O_APPEND, "last\n")
+	os.Rename(path, path+".2")
+	lines, err := file.ReadLines()
+	if err == nil {
+		t.Error("expected an error when the log file is missing")
+	}
+	if !reflect.DeepEqual(lines, []string{"last"}) {
+		t.Errorf("expected the end of the rotated file to be read, got %v", lines)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/rs/zerolog"
+)
+
+type networkThreshold struct {
+	network   *net.IPNet
+	threshold uint64
+}
+
+// clientThresholds resolves the traffic threshold that applies to a client address, either from
+// an exact address match or from the most specific CIDR range containing it. The threshold of a CIDR range
+// applies to the traffic of all the clients it contains, rather than to each of them
+type clientThresholds struct {
+	addresses map[string]uint64
+	networks  []networkThreshold
+}
+
+// newClientThresholds parses a set of thresholds keyed by client address or CIDR range
+func newClientThresholds(log *zerolog.Logger, thresholds map[string]uint64) clientThresholds {
+	ct := clientThresholds{
+		addresses: make(map[string]uint64),
+	}
+
+	for key, threshold := range thresholds {
+		_, network, err := net.ParseCIDR(key)
+		if err != nil {
+			// not a CIDR range, consider it as a plain client address such as "::1" or "localhost"
+			ct.addresses[key] = threshold
+			continue
+		}
+		ct.networks = append(ct.networks, networkThreshold{network: network, threshold: threshold})
+	}
+
+	// sort networks from the most specific to the least specific one, so that the first match wins
+	sort.Slice(ct.networks, func(i, j int) bool {
+		iOnes, _ := ct.networks[i].network.Mask.Size()
+		jOnes, _ := ct.networks[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+
+	log.Debug().
+		Int("client_addresses", len(ct.addresses)).
+		Int("client_networks", len(ct.networks)).
+		Msg("Client traffic thresholds loaded")
+
+	return ct
+}
+
+// lookup returns the subject of the threshold that applies to the given client address, if any, along with the
+// threshold: the address itself when it has its own threshold, or the CIDR range containing it, such as
+// "10.0.0.0/24", whose threshold applies to the traffic of all its clients
+func (ct clientThresholds) lookup(address string) (string, uint64, bool) {
+	if threshold, ok := ct.addresses[address]; ok {
+		return address, threshold, true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", 0, false
+	}
+
+	for _, network := range ct.networks {
+		if network.network.Contains(ip) {
+			return network.network.String(), network.threshold, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// threshold returns the threshold of a subject returned by lookup, if it still has one
+func (ct clientThresholds) threshold(subject string) (uint64, bool) {
+	if threshold, ok := ct.addresses[subject]; ok {
+		return threshold, true
+	}
+
+	for _, network := range ct.networks {
+		if network.network.String() == subject {
+			return network.threshold, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// defaultWebhookTemplate sends the alert as JSON
+const defaultWebhookTemplate = `{{ json . }}`
+
+// webhookTemplateFuncs are the functions available in webhook body templates
+var webhookTemplateFuncs = template.FuncMap{
+	// json encodes a value as JSON, which allows to safely include strings in JSON bodies
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+}
+
+// webhookNotifier sends alert state changes to an HTTP endpoint. Notifications are queued and sent
+// asynchronously, so that a slow endpoint never blocks the log processor
+type webhookNotifier struct {
+	log    *zerolog.Logger
+	config WebhookConfig
+	client *http.Client
+	body   *template.Template
+
+	queue chan Alert
+	done  sync.WaitGroup
+	// sleep is time.Sleep, which can be replaced to test retries
+	sleep func(time.Duration)
+}
+
+// newWebhookNotifier creates a webhook notifier and starts sending its queued notifications
+func newWebhookNotifier(log *zerolog.Logger, config WebhookConfig) (*webhookNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook has no URL")
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.Template == "" {
+		config.Template = defaultWebhookTemplate
+	}
+
+	body, err := template.New(config.URL).Funcs(webhookTemplateFuncs).Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+
+	w := &webhookNotifier{
+		log:    log,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout.Duration},
+		body:   body,
+		queue:  make(chan Alert, config.QueueSize),
+		sleep:  time.Sleep,
+	}
+
+	w.done.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Notify queues an alert to be sent to the webhook, or returns an error if the queue is full
+func (w *webhookNotifier) Notify(alert Alert) error {
+	select {
+	case w.queue <- alert:
+		return nil
+	default:
+		return errNotificationQueueFull
+	}
+}
+
+// Close stops accepting notifications and waits for the queued ones to be sent
+func (w *webhookNotifier) Close() error {
+	close(w.queue)
+	w.done.Wait()
+	return nil
+}
+
+func (w *webhookNotifier) run() {
+	defer w.done.Done()
+
+	for alert := range w.queue {
+		err := w.send(alert)
+		if err != nil {
+			w.log.Error().
+				Err(err).
+				Str("webhook_url", w.config.URL).
+				Str("rule", alert.Rule).
+				Str("state", string(alert.State)).
+				Msg("Could not send alert to webhook")
+		}
+	}
+}
+
+// send sends an alert to the webhook, retrying with an exponential backoff when the
+// request fails or when the endpoint returns a server error
+func (w *webhookNotifier) send(alert Alert) error {
+	body := &bytes.Buffer{}
+	err := w.body.Execute(body, alert)
+	if err != nil {
+		return fmt.Errorf("could not render webhook template: %v", err)
+	}
+
+	backoff := w.config.RetryBackoff.Duration
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body.Bytes())
+		if err == nil {
+			w.log.Debug().Str("webhook_url", w.config.URL).Str("rule", alert.Rule).Msg("Alert sent to webhook")
+			return nil
+		}
+		if !retry || attempt >= w.config.MaxRetries {
+			return err
+		}
+
+		w.log.Warn().
+			Err(err).
+			Str("webhook_url", w.config.URL).
+			Int("attempt", attempt+1).
+			Str("backoff", backoff.String()).
+			Msg("Could not send alert to webhook, retrying")
+
+		w.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a request to the webhook, and returns whether it can be retried in case of failure
+func (w *webhookNotifier) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(w.config.Method, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// only server errors and rate limiting are worth retrying
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook returned status %s", resp.Status)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var headers []http.Header
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		// fail the first request to test retries
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		headers = append(headers, r.Header)
+	}))
+	defer server.Close()
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	webhook, err := newWebhookNotifier(log, WebhookConfig{
+		URL:          server.URL,
+		Headers:      map[string]string{"Authorization": "Bearer token"},
+		Template:     `{"text": {{ json .Summary }}, "state": "{{ .State }}"}`,
+		MaxRetries:   2,
+		RetryBackoff: Duration{time.Millisecond},
+		QueueSize:    10,
+	})
+	if err != nil {
+		t.Fatalf("could not create webhook notifier: %v", err)
+	}
+
+	var backoffs []time.Duration
+	webhook.sleep = func(d time.Duration) {
+		backoffs = append(backoffs, d)
+	}
+
+	alert := Alert{State: AlertFiring, Rule: trafficRule, Subject: sectionSubject, Name: "/api", Value: 3, Peak: 3, Threshold: 2}
+	if err := webhook.Notify(alert); err != nil {
+		t.Fatalf("unexpected error when notifying webhook: %v", err)
+	}
+	webhook.Close()
+
+	if requests != 2 {
+		t.Errorf("expected 2 requests to be made to the webhook, got %d", requests)
+	}
+	if len(backoffs) != 1 || backoffs[0] != time.Millisecond {
+		t.Errorf("expected to wait 1ms before retrying, waited %v", backoffs)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 successful request, got %d", len(bodies))
+	}
+
+	var body map[string]string
+	if err := json.Unmarshal([]byte(bodies[0]), &body); err != nil {
+		t.Fatalf("webhook body is not valid JSON: %v: %s", err, bodies[0])
+	}
+	if body["text"] != "[FIRING] Section /api traffic: 3 (threshold 2, peak 3)" || body["state"] != "firing" {
+		t.Errorf("unexpected webhook body %s", bodies[0])
+	}
+	if headers[0].Get("Authorization") != "Bearer token" || headers[0].Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected webhook headers %v", headers[0])
+	}
+}
+
+func TestWebhookNotifierDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	webhook, err := newWebhookNotifier(log, WebhookConfig{URL: server.URL, MaxRetries: 3, QueueSize: 1})
+	if err != nil {
+		t.Fatalf("could not create webhook notifier: %v", err)
+	}
+	webhook.sleep = func(time.Duration) {}
+
+	webhook.Notify(Alert{State: AlertFiring, Rule: trafficRule, Subject: totalSubject})
+	webhook.Close()
+
+	if requests != 1 {
+		t.Errorf("expected client errors not to be retried, got %d requests", requests)
+	}
+}
+
+func TestWebhookNotifierQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+	webhook, err := newWebhookNotifier(log, WebhookConfig{URL: server.URL, QueueSize: 1})
+	if err != nil {
+		t.Fatalf("could not create webhook notifier: %v", err)
+	}
+
+	alert := Alert{State: AlertFiring, Rule: trafficRule, Subject: totalSubject}
+
+	// the first notification is being sent, the second one fills the queue
+	webhook.Notify(alert)
+	time.Sleep(50 * time.Millisecond)
+	webhook.Notify(alert)
+
+	start := time.Now()
+	if err := webhook.Notify(alert); err != errNotificationQueueFull {
+		t.Errorf("expected queue full error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Millisecond {
+		t.Error("notifying a slow webhook should not block")
+	}
+
+	close(release)
+	webhook.Close()
+}
+
+func TestNewWebhookNotifierErrors(t *testing.T) {
+	log := NewZeroLog(bytes.NewBuffer([]byte{}), JSON)
+
+	if _, err := newWebhookNotifier(log, WebhookConfig{}); err == nil {
+		t.Error("expected an error when the webhook has no URL")
+	}
+	if _, err := newWebhookNotifier(log, WebhookConfig{URL: "http://localhost", Template: "{{ .Unknown"}); err == nil {
+		t.Error("expected an error when the webhook template is invalid")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// webUIPoints is the number of refreshes kept to draw the charts of the web UI when a browser connects
+const webUIPoints = 360
+
+// webUIClientEvents is the number of events waiting to be sent to a browser, after which new events are
+// dropped for that browser
+const webUIClientEvents = 16
+
+// webPoint is the traffic received at a refresh, drawn in the charts of the web UI
+type webPoint struct {
+	Time  time.Time `json:"time"`
+	Hits  int       `json:"hits"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// webRefresh is the state of the log processor sent to browsers at every refresh
+type webRefresh struct {
+	Point        webPoint        `json:"point"`
+	Stats        WindowStats     `json:"stats"`
+	TopSections  []SectionStats  `json:"top_sections"`
+	Statuses     StatusBreakdown `json:"statuses"`
+	ActiveAlerts []Alert         `json:"active_alerts"`
+}
+
+// webInit is sent to browsers when they connect, so that they can draw the past refreshes and alerts
+type webInit struct {
+	Source  string      `json:"source"`
+	Points  []webPoint  `json:"points"`
+	Alerts  []Alert     `json:"alerts"`
+	Refresh *webRefresh `json:"refresh"`
+}
+
+// webEvent is a Server-Sent Event
+type webEvent struct {
+	name string
+	data []byte
+}
+
+// webUI serves a single-page web dashboard, updated with Server-Sent Events at every refresh of the log
+// processor. It receives the statistics of every refresh as a metrics sink and alerts as a notifier
+type webUI struct {
+	log       *zerolog.Logger
+	processor *LogProcessor
+	source    string
+	topN      int
+
+	mu      sync.Mutex
+	points  []webPoint
+	alerts  []Alert
+	last    *webRefresh
+	clients map[chan webEvent]struct{}
+
+	refresh chan webPoint
+}
+
+func newWebUI(log *zerolog.Logger, config Config) *webUI {
+	return &webUI{
+		log:     log,
+		source:  config.LogFilePath,
+		topN:    config.TopHitsNumber,
+		clients: make(map[chan webEvent]struct{}),
+		refresh: make(chan webPoint, 1),
+	}
+}
+
+// Flush records the traffic of a refresh, which is sent to browsers along with the state of the log
+// processor by Run
+func (ui *webUI) Flush(stats RefreshStats) error {
+	point := webPoint{Time: stats.Time, Hits: stats.Hits, Bytes: stats.Bytes}
+
+	ui.mu.Lock()
+	ui.points = append(ui.points, point)
+	if len(ui.points) > webUIPoints {
+		ui.points = ui.points[len(ui.points)-webUIPoints:]
+	}
+	ui.mu.Unlock()
+
+	// the state of the log processor can't be read while it flushes, so it is sent from another goroutine
+	select {
+	case ui.refresh <- point:
+	default:
+	}
+	return nil
+}
+
+// Notify sends an alert to browsers, and keeps it for the browsers that connect later
+func (ui *webUI) Notify(alert Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ui.alerts = append(ui.alerts, alert)
+	if len(ui.alerts) > dashboardAlerts {
+		ui.alerts = ui.alerts[len(ui.alerts)-dashboardAlerts:]
+	}
+	ui.broadcast(webEvent{name: "alert", data: data})
+	return nil
+}
+
+// Run sends the state of the log processor to browsers after every refresh
+func (ui *webUI) Run() {
+	for point := range ui.refresh {
+		ui.sendRefresh(point)
+	}
+}
+
+func (ui *webUI) sendRefresh(point webPoint) {
+	refresh := &webRefresh{
+		Point:        point,
+		Stats:        ui.processor.WindowStats(),
+		TopSections:  ui.processor.TopSections(ui.topN),
+		Statuses:     ui.processor.StatusBreakdown(),
+		ActiveAlerts: ui.processor.ActiveAlerts(),
+	}
+
+	data, err := json.Marshal(refresh)
+	if err != nil {
+		ui.log.Error().Err(err).Msg("Could not encode web UI refresh")
+		return
+	}
+
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ui.last = refresh
+	ui.broadcast(webEvent{name: "refresh", data: data})
+}
+
+// broadcast sends an event to all browsers. Browsers that are too slow to receive events miss them, so that
+// they never block the log processor
+func (ui *webUI) broadcast(event webEvent) {
+	for client := range ui.clients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+}
+
+// Handler returns the HTTP handler of the web UI
+func (ui *webUI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ui.handlePage)
+	mux.HandleFunc("/events", ui.handleEvents)
+	return mux
+}
+
+// handlePage serves the page of the web UI
+func (ui *webUI) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, webUIPage)
+}
+
+// handleEvents streams the refreshes and alerts to a browser as Server-Sent Events, starting with an init
+// event containing the past refreshes and alerts
+func (ui *webUI) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan webEvent, webUIClientEvents)
+
+	ui.mu.Lock()
+	init, err := json.Marshal(webInit{Source: ui.source, Points: ui.points, Alerts: ui.alerts, Refresh: ui.last})
+	ui.clients[client] = struct{}{}
+	ui.mu.Unlock()
+
+	defer func() {
+		ui.mu.Lock()
+		delete(ui.clients, client)
+		ui.mu.Unlock()
+	}()
+
+	if err != nil {
+		ui.log.Error().Err(err).Msg("Could not encode web UI init")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeEvent(w, webEvent{name: "init", data: init})
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-client:
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes an event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event webEvent) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\n", event.name)
+	for _, line := range bytes.Split(event.data, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	w.Write(buf.Bytes())
+}
+
+// serveWebUI serves the web UI on the given address
+func serveWebUI(log *zerolog.Logger, address string, handler http.Handler) {
+	log.Info().Str("web_ui_address", address).Msg("Serving web UI")
+
+	err := http.ListenAndServe(address, handler)
+	if err != nil {
+		log.Error().Err(err).Str("web_ui_address", address).Msg("Web UI stopped")
+	}
+}
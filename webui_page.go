@@ -0,0 +1,202 @@
+package main
+
+// webUIPage is the single page of the web UI, which is embedded in the binary so that the agent can be
+// deployed as a single file. It receives the refreshes and alerts from the /events stream
+const webUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hk-agent</title>
+<style>
+  body { font-family: sans-serif; margin: 0; background: #f5f6f8; color: #222; }
+  header { background: #1f2933; color: #fff; padding: 12px 24px; display: flex; justify-content: space-between; }
+  header h1 { font-size: 18px; margin: 0; }
+  #status { font-size: 14px; }
+  main { display: grid; grid-template-columns: 1fr 1fr; gap: 16px; padding: 16px 24px; }
+  section { background: #fff; border-radius: 4px; padding: 12px 16px; box-shadow: 0 1px 2px rgba(0, 0, 0, 0.1); }
+  section.wide { grid-column: 1 / 3; }
+  h2 { font-size: 14px; margin: 0 0 8px; text-transform: uppercase; color: #52606d; }
+  canvas { width: 100%; height: 160px; }
+  table { width: 100%; border-collapse: collapse; font-size: 14px; }
+  th, td { text-align: right; padding: 4px 8px; border-bottom: 1px solid #e4e7eb; }
+  th:first-child, td:first-child { text-align: left; }
+  .bar { display: flex; align-items: center; font-size: 14px; margin: 4px 0; }
+  .bar span { width: 40px; }
+  .bar div { height: 14px; margin-right: 8px; }
+  .class-1, .class-2, .class-3 { background: #3ebd93; }
+  .class-4 { background: #f7c948; }
+  .class-5 { background: #e12d39; }
+  #alerts { list-style: none; margin: 0; padding: 0; max-height: 320px; overflow-y: auto; font-size: 14px; }
+  #alerts li { padding: 4px 0 4px 8px; border-left: 4px solid #9aa5b1; margin-bottom: 4px; }
+  #alerts li.firing { border-color: #e12d39; }
+  #alerts li.pending { border-color: #f7c948; }
+  #alerts li.resolved { border-color: #3ebd93; }
+  #alerts time { color: #7b8794; margin-right: 8px; }
+</style>
+</head>
+<body>
+<header><h1>hk-agent</h1><div id="status">connecting...</div></header>
+<main>
+  <section><h2>Hits per refresh</h2><canvas id="hits"></canvas></section>
+  <section><h2>Bandwidth per refresh</h2><canvas id="bytes"></canvas></section>
+  <section><h2>Top sections (last 2 minutes)</h2>
+    <table><thead><tr><th>Section</th><th>Hits</th><th>Bytes</th></tr></thead><tbody id="sections"></tbody></table>
+  </section>
+  <section><h2>Status codes (last 2 minutes)</h2><div id="statuses"></div></section>
+  <section class="wide"><h2>Alerts</h2><ul id="alerts"></ul></section>
+</main>
+<script>
+(function() {
+  var maxPoints = 360;
+  var points = [];
+
+  function formatBytes(bytes) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+      bytes /= 1024;
+      i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + units[i];
+  }
+
+  function formatTime(time) {
+    return new Date(time).toLocaleTimeString();
+  }
+
+  function drawChart(id, key, color, format) {
+    var canvas = document.getElementById(id);
+    var width = canvas.width = canvas.clientWidth;
+    var height = canvas.height = canvas.clientHeight;
+    var ctx = canvas.getContext("2d");
+    ctx.clearRect(0, 0, width, height);
+
+    var max = 0;
+    points.forEach(function(point) { max = Math.max(max, point[key]); });
+    ctx.fillStyle = "#7b8794";
+    ctx.font = "12px sans-serif";
+    ctx.fillText(format(max), 4, 12);
+    if (points.length < 2 || max === 0) {
+      return;
+    }
+
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    points.forEach(function(point, i) {
+      var x = i * width / (points.length - 1);
+      var y = height - 2 - point[key] / max * (height - 20);
+      if (i === 0) {
+        ctx.moveTo(x, y);
+      } else {
+        ctx.lineTo(x, y);
+      }
+    });
+    ctx.stroke();
+  }
+
+  function drawCharts() {
+    drawChart("hits", "hits", "#2680c2", String);
+    drawChart("bytes", "bytes", "#8719e0", formatBytes);
+  }
+
+  function addPoint(point) {
+    points.push(point);
+    if (points.length > maxPoints) {
+      points.shift();
+    }
+  }
+
+  function cell(row, text) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    row.appendChild(td);
+  }
+
+  function showRefresh(refresh) {
+    document.getElementById("status").textContent = formatTime(refresh.stats.time) + " - " +
+      refresh.stats.entries + " hits, " + formatBytes(refresh.stats.bytes) + " over the last 2 minutes, " +
+      refresh.active_alerts.length + " active alerts";
+
+    var tbody = document.getElementById("sections");
+    tbody.innerHTML = "";
+    refresh.top_sections.forEach(function(section) {
+      var row = document.createElement("tr");
+      cell(row, section.section);
+      cell(row, section.hits);
+      cell(row, formatBytes(section.bytes));
+      tbody.appendChild(row);
+    });
+
+    var statuses = document.getElementById("statuses");
+    statuses.innerHTML = "";
+    var total = 0;
+    for (var name in refresh.statuses.total) {
+      total += refresh.statuses.total[name];
+    }
+    ["1xx", "2xx", "3xx", "4xx", "5xx"].forEach(function(name) {
+      var count = refresh.statuses.total[name] || 0;
+      var bar = document.createElement("div");
+      bar.className = "bar";
+      var label = document.createElement("span");
+      label.textContent = name;
+      var fill = document.createElement("div");
+      fill.className = "class-" + name.charAt(0);
+      fill.style.width = (total ? count / total * 70 : 0) + "%";
+      bar.appendChild(label);
+      bar.appendChild(fill);
+      bar.appendChild(document.createTextNode(count));
+      statuses.appendChild(bar);
+    });
+  }
+
+  function showAlert(alert) {
+    var item = document.createElement("li");
+    item.className = alert.state;
+    var time = document.createElement("time");
+    time.textContent = formatTime(alert.time);
+    item.appendChild(time);
+
+    var state = alert.state.toUpperCase();
+    if (alert.severity) {
+      state += "/" + alert.severity.toUpperCase();
+    }
+    var text = "[" + state + "] " + alert.rule + " " + alert.subject + (alert.name ? " " + alert.name : "") +
+      ": " + alert.value + " (threshold " + alert.threshold + ", peak " + alert.peak + ")";
+    item.appendChild(document.createTextNode(text));
+
+    var list = document.getElementById("alerts");
+    list.insertBefore(item, list.firstChild);
+  }
+
+  var events = new EventSource("events");
+  events.addEventListener("init", function(e) {
+    var init = JSON.parse(e.data);
+    document.querySelector("header h1").textContent = "hk-agent - " + init.source;
+    points = [];
+    (init.points || []).forEach(addPoint);
+    document.getElementById("alerts").innerHTML = "";
+    (init.alerts || []).forEach(showAlert);
+    if (init.refresh) {
+      showRefresh(init.refresh);
+    }
+    drawCharts();
+  });
+  events.addEventListener("refresh", function(e) {
+    var refresh = JSON.parse(e.data);
+    addPoint(refresh.point);
+    showRefresh(refresh);
+    drawCharts();
+  });
+  events.addEventListener("alert", function(e) {
+    showAlert(JSON.parse(e.data));
+  });
+  events.onerror = function() {
+    document.getElementById("status").textContent = "disconnected, reconnecting...";
+  };
+  window.addEventListener("resize", drawCharts);
+})();
+</script>
+</body>
+</html>
+`
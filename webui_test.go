@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test ensures that the web UI serves its page, and streams the past refreshes and alerts to browsers
+// when they connect, then the new ones at every refresh
+func TestWebUI(t *testing.T) {
+	baseTime := time.Date(2018, time.May, 8, 10, 0, 0, 0, time.UTC)
+	now := baseTime
+	log := NewZeroLog(ioutil.Discard, JSON)
+
+	config := DefaultConfig()
+	config.TrafficThreshold = 1
+	config.TopHitsNumber = 2
+
+	ui := newWebUI(log, config)
+	lp := NewLogProcessor(log, log, config, nil, []Notifier{ui}, []MetricsSink{ui}, nil, func() time.Time { return now })
+	ui.processor = lp
+	go ui.Run()
+
+	server := httptest.NewServer(ui.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), `new EventSource("events")`) {
+		t.Errorf("unexpected page with status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/unknown")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", resp.StatusCode)
+	}
+
+	// a first refresh is received before the browser connects
+	lp.Add([]*HTTPEntry{{Section: "/api", Status: 200, Size: 10, Time: now}})
+
+	resp, err = http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected events to be streamed, got content type %q", contentType)
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	readEvent := func(value interface{}) string {
+		var name, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("could not read event: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				name = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				data += strings.TrimPrefix(line, "data: ")
+			}
+		}
+
+		if err := json.Unmarshal([]byte(data), value); err != nil {
+			t.Errorf("could not decode %s event: %v", name, err)
+		}
+		return name
+	}
+
+	var init webInit
+	if name := readEvent(&init); name != "init" {
+		t.Fatalf("expected init event, got %q", name)
+	}
+	if init.Source != config.LogFilePath || len(init.Points) != 1 || init.Points[0].Hits != 1 || len(init.Alerts) != 0 {
+		t.Errorf("unexpected init event %+v", init)
+	}
+
+	// the traffic exceeds the threshold, so an alert is sent along with the refresh
+	now = now.Add(10 * time.Second)
+	lp.Add([]*HTTPEntry{
+		{Section: "/api", Status: 200, Size: 2 * 1024 * 1024, Time: now},
+		{Section: "/static", Status: 500, Size: 10, Time: now},
+		{Section: "/user", Status: 404, Size: 10, Time: now},
+	})
+
+	var alert Alert
+	if name := readEvent(&alert); name != "alert" {
+		t.Fatalf("expected alert event, got %q", name)
+	}
+	if alert.Rule != trafficRule || alert.State != AlertFiring {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+
+	var refresh webRefresh
+	if name := readEvent(&refresh); name != "refresh" {
+		t.Fatalf("expected refresh event, got %q", name)
+	}
+	if refresh.Point.Hits != 3 || !refresh.Point.Time.Equal(now) {
+		t.Errorf("unexpected refresh point %+v", refresh.Point)
+	}
+	if len(refresh.TopSections) != 2 || refresh.TopSections[0].Section != "/api" || refresh.TopSections[0].Hits != 2 {
+		t.Errorf("unexpected top sections %+v", refresh.TopSections)
+	}
+	if refresh.Stats.Entries != 4 || refresh.Statuses.Total[5] != 1 || len(refresh.ActiveAlerts) != 1 {
+		t.Errorf("unexpected refresh %+v", refresh)
+	}
+}